@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"time"
 )
 
 const InternalCmdPrefix = "--"
@@ -17,8 +18,28 @@ const (
 	InternalDevice  = "dev"
 )
 
+//global options, placed before [device]
+const (
+	OptionRead      = "read"
+	OptionWrite     = "write"
+	OptionWriteSize = "write-size"
+	OptionWriteTime = "write-time"
+	OptionWriteKeep = "write-keep"
+	OptionFormat    = "format"
+	OptionOutput       = "output"
+	OptionOutputBuffer = "output-buffer"
+	OptionOutputSize   = "output-size"
+	OptionOutputKeep   = "output-keep"
+	OptionKeyLog       = "keylog"
+)
+
 type Cmd struct {
 	Device string
+	ReadFile string
+	Write WriteOption
+	Format string
+	Output OutputOption
+	KeyLog string
 	plugHandle *Plug
 }
 
@@ -38,20 +59,113 @@ func (cm *Cmd) Run() {
 		os.Exit(1)
 	}
 
+	//parse global options
+	args := cm.parseOption(os.Args[1:])
+
 	//parse command
-	firstArg := string(os.Args[1])
+	if len(args) == 0 {
+		cm.printHelpMessage()
+		os.Exit(1)
+	}
+	firstArg := string(args[0])
 	if strings.HasPrefix(firstArg, InternalCmdPrefix) {
-		cm.parseInternalCmd()
+		cm.parseInternalCmd(args)
 	} else {
-		cm.parsePlugCmd()
+		cm.parsePlugCmd(args)
 	}
 }
 
+//parse global options
+//like --read dump.pcap, returns the remaining args
+func (cm *Cmd) parseOption(args []string) []string {
+
+	for len(args) > 0 && strings.HasPrefix(args[0], InternalCmdPrefix) {
+
+		opt := strings.TrimPrefix(args[0], InternalCmdPrefix)
+		val := ""
+		if len(args) > 1 {
+			val = args[1]
+		}
+
+		switch opt {
+		case OptionRead:
+			cm.ReadFile = mustOptionValue(opt, val)
+		case OptionWrite:
+			cm.Write.File = mustOptionValue(opt, val)
+		case OptionWriteSize:
+			size, err := strconv.ParseInt(mustOptionValue(opt, val), 10, 64)
+			if err != nil || size < 0 {
+				fmt.Println("ERR : --" + opt + " need a size in MB")
+				os.Exit(1)
+			}
+			cm.Write.Size = size << 20
+		case OptionWriteTime:
+			age, err := time.ParseDuration(mustOptionValue(opt, val))
+			if err != nil || age < 0 {
+				fmt.Println("ERR : --" + opt + " need a duration, like 10m or 1h")
+				os.Exit(1)
+			}
+			cm.Write.Age = age
+		case OptionWriteKeep:
+			keep, err := strconv.Atoi(mustOptionValue(opt, val))
+			if err != nil || keep < 0 {
+				fmt.Println("ERR : --" + opt + " need a number of files")
+				os.Exit(1)
+			}
+			cm.Write.Keep = keep
+		case OptionFormat:
+			format := mustOptionValue(opt, val)
+			if format != FormatText && format != FormatJson {
+				fmt.Println("ERR : --" + opt + " need text or json")
+				os.Exit(1)
+			}
+			cm.Format = format
+		case OptionOutput:
+			cm.Output.Sinks = append(cm.Output.Sinks, mustOptionValue(opt, val))
+		case OptionOutputBuffer:
+			buffer, err := strconv.Atoi(mustOptionValue(opt, val))
+			if err != nil || buffer <= 0 {
+				fmt.Println("ERR : --" + opt + " need a number of lines")
+				os.Exit(1)
+			}
+			cm.Output.Buffer = buffer
+		case OptionOutputSize:
+			size, err := strconv.ParseInt(mustOptionValue(opt, val), 10, 64)
+			if err != nil || size < 0 {
+				fmt.Println("ERR : --" + opt + " need a size in MB")
+				os.Exit(1)
+			}
+			cm.Output.Size = size << 20
+		case OptionOutputKeep:
+			keep, err := strconv.Atoi(mustOptionValue(opt, val))
+			if err != nil || keep < 0 {
+				fmt.Println("ERR : --" + opt + " need a number of files")
+				os.Exit(1)
+			}
+			cm.Output.Keep = keep
+		case OptionKeyLog:
+			cm.KeyLog = mustOptionValue(opt, val)
+		default:
+			return args
+		}
+		args = args[2:]
+	}
+	return args
+}
+
+func mustOptionValue(opt, val string) string {
+	if val == "" {
+		fmt.Println("ERR : --" + opt + " need a value")
+		os.Exit(1)
+	}
+	return val
+}
+
 //parse internal commend
 //like --help, --env, --device
-func (cm *Cmd) parseInternalCmd() {
+func (cm *Cmd) parseInternalCmd(args []string) {
 
-	arg := string(os.Args[1])
+	arg := string(args[0])
 	cmd := strings.Trim(arg, InternalCmdPrefix)
 
 	switch cmd {
@@ -86,6 +200,26 @@ func (cm *Cmd) printHelpMessage()  {
 	fmt.Println("          go-sniffer en0 redis          Capture redis packet")
 	fmt.Println("          go-sniffer en0 mysql -p 3306  Capture mysql packet")
 	fmt.Println()
+	fmt.Println("    go-sniffer [options] [device] [plug] [plug's params(optional)]")
+	fmt.Println("               --read [file]  \"read packets from pcap/pcapng file instead of device, - for stdin\"")
+	fmt.Println("               --write [file] \"save captured packets to pcap file, .pcapng for pcapng\"")
+	fmt.Println("               --write-size [MB]   \"rotate saved file by size\"")
+	fmt.Println("               --write-time [1h]   \"rotate saved file by capture time\"")
+	fmt.Println("               --write-keep [num]  \"number of rotated files to keep\"")
+	fmt.Println("               --format [text|json] \"output format, json prints one object per line\"")
+	fmt.Println("               --output [sink]      \"stdout, file:[path], unix:[path], syslog[:tag], http://[url], repeatable\"")
+	fmt.Println("               --output-buffer [num] \"lines queued per output before dropping, default 10000\"")
+	fmt.Println("               --output-size [MB]    \"rotate file output by size\"")
+	fmt.Println("               --output-keep [num]   \"number of rotated output files to keep\"")
+	fmt.Println("               --keylog [file]       \"SSLKEYLOGFILE (NSS format) to decrypt tls 1.2 and 1.3\"")
+	fmt.Println()
+	fmt.Println("    [exp]")
+	fmt.Println("          go-sniffer --read dump.pcap mysql -p 3306  Resolve mysql packet from file")
+	fmt.Println("          go-sniffer --write dump.pcap --write-size 100 --write-keep 10 en0 redis")
+	fmt.Println("          go-sniffer --format json en0 mysql | jq .statement")
+	fmt.Println("          go-sniffer --format json --output file:/var/log/sniffer.log --output http://127.0.0.1:8080/events en0 redis")
+	fmt.Println("          go-sniffer --read dump.pcap --keylog sslkeys.log http -p 443")
+	fmt.Println()
 	fmt.Println("    go-sniffer --[commend]")
 	fmt.Println("               --help \"this page\"")
 	fmt.Println("               --env  \"environment variable\"")
@@ -126,17 +260,21 @@ func (cm *Cmd) printDevice() {
 }
 
 //Parameters needed for plug-ins
-func (cm *Cmd) parsePlugCmd()  {
+func (cm *Cmd) parsePlugCmd(args []string)  {
 
-	if len(os.Args) < 3 {
-		fmt.Println("not found [Plug-in name]")
-		fmt.Println("go-sniffer [device] [plug] [plug's params(optional)]")
-		os.Exit(1)
+	//no device when reading from file
+	if cm.ReadFile == "" {
+		if len(args) < 2 {
+			fmt.Println("not found [Plug-in name]")
+			fmt.Println("go-sniffer [device] [plug] [plug's params(optional)]")
+			os.Exit(1)
+		}
+		cm.Device = args[0]
+		args      = args[1:]
 	}
 
-	cm.Device  = os.Args[1]
-	plugName  := os.Args[2]
-	plugParams:= os.Args[3:]
+	plugName  := args[0]
+	plugParams:= args[1:]
 	cm.plugHandle.SetOption(plugName, plugParams)
 }
 
@@ -8,38 +8,82 @@ import (
 	"github.com/google/gopacket/tcpassembly"
 	"github.com/google/gopacket/tcpassembly/tcpreader"
 	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 )
 
 type Dispatch struct {
 	device string
+	readFile string
+	write WriteOption
+	writer *PcapWriter
+	outputOpt OutputOption
+	format string
+	output *Output
+	keylogFile string
+	keylog *KeyLog
 	payload []byte
 	Plug *Plug
+	wg sync.WaitGroup
 }
 
 func NewDispatch(plug *Plug, cmd *Cmd) *Dispatch {
 	return &Dispatch {
 		Plug: plug,
 		device:cmd.Device,
+		readFile:cmd.ReadFile,
+		write:cmd.Write,
+		outputOpt:cmd.Output,
+		format:cmd.Format,
+		keylogFile:cmd.KeyLog,
 	}
 }
 
 func (d *Dispatch) Capture() {
 
-	//init device
-	handle, err := pcap.OpenLive(d.device, 65535, false, pcap.BlockForever)
+	//init device or file
+	handle, err := d.openHandle()
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
+	defer handle.Close()
+
+	//secrets to decrypt tls
+	if d.keylogFile != "" {
+		d.keylog, err = LoadKeyLog(d.keylogFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	//set filter
-	fmt.Println(d.Plug.BPF)
+	fmt.Fprintln(os.Stderr, d.Plug.BPF)
 	err = handle.SetBPFFilter(d.Plug.BPF)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	//decoded output, sinks may block
+	//only when there is no live capture to stall
+	d.output, err = NewOutput(d.format, d.outputOpt, d.readFile != "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer d.output.Close()
+	if d.Plug.Flush != nil {
+		defer d.Plug.Flush(d.output)
+	}
+
+	//save raw packets
+	if d.write.File != "" {
+		d.writer = NewPcapWriter(d.write, handle.LinkType(), handle.SnapLen())
+		defer d.writer.Close()
+	}
+
 	//capture
 	src     := gopacket.NewPacketSource(handle, handle.LinkType())
 	packets := src.Packets()
@@ -52,34 +96,113 @@ func (d *Dispatch) Capture() {
 	assembler  := NewAssembler(streamPool)
 	ticker     := time.Tick(time.Minute)
 
-	//loop until ctrl+z
+	//periodic reports of plug-ins, on the wall clock of a live
+	//capture, an offline file is reported on its capture clock
+	var report <-chan time.Time
+	if d.readFile == "" && d.Plug.Tick != nil {
+		report = time.Tick(time.Second)
+	}
+
+	//capture clock of offline file
+	var lastFlush time.Time
+
+	//stop on ctrl+c, so that saved files are flushed
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	//loop until ctrl+z or end of file
 	for {
 		select {
-		case packet := <-packets:
+		case packet, ok := <-packets:
+			if !ok {
+				//flush remaining streams and wait for plug-in
+				assembler.FlushAll()
+				d.wg.Wait()
+				return
+			}
+			d.writePacket(packet)
 			if packet.NetworkLayer() == nil ||
 				packet.TransportLayer() == nil ||
 				packet.TransportLayer().LayerType() != layers.LayerTypeTCP {
-				fmt.Println("ERR : Unknown Packet -_-")
+				fmt.Fprintln(os.Stderr, "ERR : Unknown Packet -_-")
 				continue
 			}
 			tcp := packet.TransportLayer().(*layers.TCP)
+			seen := packet.Metadata().Timestamp
 			assembler.AssembleWithTimestamp(
 				packet.NetworkLayer().NetworkFlow(),
-				tcp, packet.Metadata().Timestamp,
+				tcp, seen,
 			)
+
+			//offline file is flushed by packet time, not wall-clock time
+			if d.readFile != "" {
+				if lastFlush.IsZero() {
+					lastFlush = seen
+				} else if seen.Sub(lastFlush) >= time.Minute {
+					assembler.FlushOlderThan(seen.Add(time.Minute * -2))
+					lastFlush = seen
+				}
+			}
 		case <-ticker:
-			assembler.FlushOlderThan(time.Now().Add(time.Minute * -2))
+			if d.readFile == "" {
+				assembler.FlushOlderThan(time.Now().Add(time.Minute * -2))
+			}
+		case now := <-report:
+			d.Plug.Tick(now, d.output)
+		case <-sig:
+			//as the end of file, plug-ins report what is left
+			assembler.FlushAll()
+			d.wg.Wait()
+			return
 		}
 	}
 }
 
+//tee packet into --write file
+func (d *Dispatch) writePacket(packet gopacket.Packet) {
+
+	if d.writer == nil {
+		return
+	}
+	err := d.writer.WritePacket(packet.Metadata().CaptureInfo, packet.Data())
+	if err != nil {
+		log.Println("ERR : Write packet", err, ", stop saving packets")
+		d.writer.Close()
+		d.writer = nil
+	}
+}
+
+//open live device, or pcap/pcapng file with --read ("-" is stdin)
+func (d *Dispatch) openHandle() (*pcap.Handle, error) {
+	if d.readFile != "" {
+		return pcap.OpenOffline(d.readFile)
+	}
+	return pcap.OpenLive(d.device, 65535, false, pcap.BlockForever)
+}
+
 type ProtocolStreamFactory struct {
 	dispatch *Dispatch
+	tls      tlsConns
 }
 
+//ProtocolStream is the reader handed to plug-ins,
+//it also reports the capture time of the bytes being read
 type ProtocolStream struct {
 	net, transport gopacket.Flow
 	r              tcpreader.ReaderStream
+	mu             sync.Mutex
+	seen           time.Time
+
+	//ended by FIN or RST, or encrypted, not flushed idle
+	closed         bool
+
+	//tls is detected before the bytes reach the plug-in, which
+	//gets the plaintext with --keylog, EOF instead of ciphertext without
+	factory        *ProtocolStreamFactory
+	conn           *tlsConn
+	tls            *tlsStream
+	started        bool
+	complete       bool
 }
 
 func (m *ProtocolStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
@@ -89,13 +212,118 @@ func (m *ProtocolStreamFactory) New(net, transport gopacket.Flow) tcpassembly.St
 		net:       net,
 		transport: transport,
 		r:         tcpreader.NewReaderStream(),
+		factory:   m,
+		conn:      m.tls.get(net, transport),
 	}
 
 	//new stream
-	fmt.Println("# Start new stream:", net, transport)
+	fmt.Fprintln(os.Stderr, "# Start new stream:", net, transport)
 
 	//decode packet
-	go m.dispatch.Plug.ResolveStream(net, transport, &(stm.r))
+	d := m.dispatch
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.Plug.ResolveStream(net, transport, stm, d.output)
 
-	return &(stm.r)
-}
\ No newline at end of file
+		//plug-in gave up, drain the rest or the assembler blocks
+		tcpreader.DiscardBytesToEOF(stm)
+	}()
+
+	return stm
+}
+
+//hand over one reassembly at a time, so that
+//Seen matches the bytes the plug-in is reading
+func (s *ProtocolStream) Reassembled(reassembly []tcpassembly.Reassembly) {
+	for i := range reassembly {
+		s.mu.Lock()
+		s.seen = reassembly[i].Seen
+		if reassembly[i].End {
+			s.closed = true
+		}
+		s.mu.Unlock()
+		if s.checkTLS(reassembly[i].Bytes, reassembly[i].Seen) {
+			continue
+		}
+		s.r.Reassembled(reassembly[i : i+1])
+	}
+}
+
+func (s *ProtocolStream) ReassemblyComplete() {
+	s.completePlug()
+	if s.factory.tls.done(s.net, s.transport, s.conn) {
+		s.conn.report(s.factory.dispatch.output)
+	}
+}
+
+//end of the bytes for the plug-in
+func (s *ProtocolStream) completePlug() {
+	if !s.complete {
+		s.complete = true
+		s.r.ReassemblyComplete()
+	}
+}
+
+//the rest of the connection can not be read, the
+//plug-in takes the end of its stream for the close
+func (s *ProtocolStream) encrypted() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.completePlug()
+}
+
+//checkTLS returns true for the bytes of a tls stream, the hello at
+//its start is reported with the connection, and the records are
+//decrypted for the plug-in if the key log has the secrets
+func (s *ProtocolStream) checkTLS(b []byte, seen time.Time) bool {
+
+	start := !s.started
+	s.started = true
+	if s.tls == nil {
+		if !IsTLSRecord(b, start) {
+			return false
+		}
+		d := s.factory.dispatch
+		s.conn.encrypt(s.net, s.transport, seen)
+		s.tls = newTLSStream(s.net, s.transport, s.conn, d.keylog, d.output)
+
+		//captured after the handshake, there is nothing to read
+		if b[0] != tlsHandshake {
+			s.tls.done = true
+		}
+		if s.tls.done || d.keylog == nil {
+			s.encrypted()
+		}
+	}
+
+	plain, err := s.tls.feed(b)
+	if err != nil {
+		log.Println("ERR : TLS", s.net, s.transport, err)
+		s.encrypted()
+	}
+	if len(plain) > 0 && !s.complete {
+		s.r.Reassembled([]tcpassembly.Reassembly{{Bytes: plain, Seen: seen}})
+	}
+	return true
+}
+
+func (s *ProtocolStream) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+//capture timestamp of the bytes last read
+func (s *ProtocolStream) Seen() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seen
+}
+
+//the connection was closed, the end of an idle
+//stream or of the capture is not its close
+func (s *ProtocolStream) Closed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
@@ -0,0 +1,182 @@
+package event
+
+import (
+	"encoding/json"
+	"github.com/google/gopacket"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Direction string
+
+const (
+	Request  Direction = "request"
+	Response Direction = "response"
+)
+
+//Event is a decoded request or response,
+//shared by all plug-ins
+type Event struct {
+	Time      time.Time
+	Client    string //ip:port
+	Server    string //ip:port
+	Protocol  string //mysql, redis, http, mongodb
+	Direction Direction
+	Operation string //Query, GET, Insert ...
+	Statement string //sql, command, url ...
+	Status    string //OK, ERR, 200 ...
+	Latency   time.Duration
+	Bytes     int
+	Error     string
+
+	//plug-in specific fields
+	Attrs map[string]interface{}
+
+	//human readable line of the text format,
+	//every plug-in keeps its own layout
+	Text string
+}
+
+//Emitter receives the events of plug-ins,
+//it is safe to call from many streams at once
+type Emitter interface {
+	Emit(e *Event)
+}
+
+type EmitterFunc func(e *Event)
+
+func (f EmitterFunc) Emit(e *Event) {
+	f(e)
+}
+
+//New returns an event of the flow, the side
+//using port is the server
+func New(protocol string, net, transport gopacket.Flow, port int) *Event {
+
+	e := &Event{
+		Time:     time.Now(),
+		Protocol: protocol,
+	}
+	e.Client, e.Server = Endpoints(net, transport, port)
+	if transport.Src().String() == strconv.Itoa(port) {
+		e.Direction = Response
+	} else {
+		e.Direction = Request
+	}
+	return e
+}
+
+//Endpoints returns client and server address of the flow,
+//the side using port is the server
+func Endpoints(net, transport gopacket.Flow, port int) (client, server string) {
+
+	src := joinHostPort(net.Src().String(), transport.Src().String())
+	dst := joinHostPort(net.Dst().String(), transport.Dst().String())
+
+	if transport.Src().String() == strconv.Itoa(port) {
+		return dst, src
+	}
+	return src, dst
+}
+
+func joinHostPort(host, port string) string {
+	if strings.Contains(host, ":") {
+		return "[" + host + "]:" + port
+	}
+	return host + ":" + port
+}
+
+//Set a plug-in specific field
+func (e *Event) Set(key string, val interface{}) *Event {
+	if e.Attrs == nil {
+		e.Attrs = make(map[string]interface{})
+	}
+	e.Attrs[key] = val
+	return e
+}
+
+//String returns Text, or a generic line
+//for plug-ins without their own layout
+func (e *Event) String() string {
+
+	if e.Text != "" {
+		return e.Text
+	}
+
+	msg := e.Time.Format("2006-01-02 15:04:05")
+	if e.Direction == Response {
+		msg += "| ser -> cli |"
+	} else {
+		msg += "| cli -> ser |"
+	}
+	if e.Operation != "" {
+		msg += " [" + e.Operation + "]"
+	}
+	if e.Statement != "" {
+		msg += " " + e.Statement
+	}
+	if e.Status != "" {
+		msg += " " + e.Status
+	}
+	if e.Error != "" {
+		msg += " " + e.Error
+	}
+	return msg
+}
+
+//field names of the json format, the same for all plug-ins
+type jsonEvent struct {
+	Time      string                 `json:"time"`
+	Protocol  string                 `json:"protocol"`
+	Client    string                 `json:"client"`
+	Server    string                 `json:"server"`
+	Direction Direction              `json:"direction"`
+	Operation string                 `json:"operation"`
+	Statement string                 `json:"statement"`
+	Status    string                 `json:"status"`
+	LatencyMs float64                `json:"latency_ms"`
+	Bytes     int                    `json:"bytes"`
+	Error     string                 `json:"error"`
+	Attrs     map[string]interface{} `json:"attrs,omitempty"`
+}
+
+func (e *Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonEvent{
+		Time:      e.Time.Format(time.RFC3339Nano),
+		Protocol:  e.Protocol,
+		Client:    e.Client,
+		Server:    e.Server,
+		Direction: e.Direction,
+		Operation: e.Operation,
+		Statement: e.Statement,
+		Status:    e.Status,
+		LatencyMs: float64(e.Latency) / float64(time.Millisecond),
+		Bytes:     e.Bytes,
+		Error:     e.Error,
+		Attrs:     e.Attrs,
+	})
+}
+
+//Seen returns the capture time of the bytes last read from r,
+//or wall-clock time if the reader does not track it
+func Seen(r io.Reader) time.Time {
+	if s, ok := r.(interface{ Seen() time.Time }); ok {
+		if t := s.Seen(); !t.IsZero() {
+			return t
+		}
+	}
+	return time.Now()
+}
+
+//Closed is true at the end of r if no more of the connection
+//will be read: it was closed, or the rest is encrypted. False if
+//its stream was flushed idle or the capture ended. Readers which
+//do not track it are closed at their end
+func Closed(r io.Reader) bool {
+	if c, ok := r.(interface{ Closed() bool }); ok {
+		return c.Closed()
+	}
+	return true
+}
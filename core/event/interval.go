@@ -0,0 +1,44 @@
+package event
+
+import (
+	"time"
+)
+
+//Interval schedules the periodic reports of the plug-ins which
+//aggregate events instead of printing them. A report covers the
+//capture time from its first event: events close it on the capture
+//clock, so that --read gives the reports of the live capture, and
+//Due closes it on the wall clock when a live capture is quiet
+type Interval struct {
+	//0 reports on exit only
+	Every time.Duration
+
+	//capture time of the first and last event of the report
+	Start time.Time
+	Last  time.Time
+	Count int
+}
+
+//Add counts an event seen at its capture time,
+//true if the report is due
+func (iv *Interval) Add(seen time.Time) bool {
+	if iv.Count == 0 {
+		iv.Start = seen
+	}
+	if seen.After(iv.Last) {
+		iv.Last = seen
+	}
+	iv.Count++
+	return iv.Every > 0 && seen.Sub(iv.Start) >= iv.Every
+}
+
+//Due is true if the report is due at now, on the wall clock
+func (iv *Interval) Due(now time.Time) bool {
+	return iv.Every > 0 && iv.Count > 0 && now.Sub(iv.Start) >= iv.Every
+}
+
+//Reset starts the next report
+func (iv *Interval) Reset() {
+	iv.Start = time.Time{}
+	iv.Count = 0
+}
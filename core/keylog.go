@@ -0,0 +1,88 @@
+package core
+
+import (
+	"bufio"
+	"encoding/hex"
+	"os"
+	"strings"
+	"sync"
+)
+
+//labels of the NSS key log format
+const (
+	keyLogClientRandom     = "CLIENT_RANDOM"
+	keyLogClientHandshake  = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogServerHandshake  = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogClientTraffic    = "CLIENT_TRAFFIC_SECRET_0"
+	keyLogServerTraffic    = "SERVER_TRAFFIC_SECRET_0"
+)
+
+//KeyLog holds the secrets of a SSLKEYLOGFILE, by client random.
+//The file is read again when a secret is missing and it has grown,
+//as browsers and libraries append to it while the capture runs
+type KeyLog struct {
+	path    string
+	mu      sync.Mutex
+	size    int64
+	secrets map[string]map[string][]byte
+}
+
+func LoadKeyLog(path string) (*KeyLog, error) {
+	k := &KeyLog{
+		path:    path,
+		secrets: make(map[string]map[string][]byte),
+	}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+//lines of "label client_random secret", in hex
+func (k *KeyLog) load() error {
+
+	f, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err == nil {
+		k.size = fi.Size()
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		random := strings.ToLower(fields[1])
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil {
+			continue
+		}
+		if k.secrets[random] == nil {
+			k.secrets[random] = make(map[string][]byte)
+		}
+		k.secrets[random][fields[0]] = secret
+	}
+	return scanner.Err()
+}
+
+//Secret returns the secret of label for the connection
+//of the client random, nil if unknown
+func (k *KeyLog) Secret(random []byte, label string) []byte {
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key := hex.EncodeToString(random)
+	if secret, ok := k.secrets[key][label]; ok {
+		return secret
+	}
+	if fi, err := os.Stat(k.path); err == nil && fi.Size() != k.size {
+		k.load()
+	}
+	return k.secrets[key][label]
+}
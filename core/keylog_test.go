@@ -0,0 +1,57 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyLog(t *testing.T) {
+
+	random := bytes.Repeat([]byte{0xab}, 32)
+	path := filepath.Join(t.TempDir(), "sslkeys.log")
+	lines := "# SSL/TLS secrets log file\n" +
+		"CLIENT_RANDOM " + "AB" + hexRepeat("ab", 31) + " 0102\n" +
+		"CLIENT_TRAFFIC_SECRET_0 " + hexRepeat("ab", 32) + " 0304\n" +
+		"SERVER_TRAFFIC_SECRET_0 " + hexRepeat("ab", 32) + " zz\n" +
+		"CLIENT_HANDSHAKE_TRAFFIC_SECRET " + hexRepeat("ab", 32) + "\n"
+	if err := os.WriteFile(path, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := LoadKeyLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		label string
+		want  []byte
+	}{
+		{keyLogClientRandom, []byte{1, 2}},
+		{keyLogClientTraffic, []byte{3, 4}},
+		{keyLogServerTraffic, nil},
+		{keyLogClientHandshake, nil},
+	}
+	for _, tt := range tests {
+		if got := k.Secret(random, tt.label); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: %x, want %x", tt.label, got, tt.want)
+		}
+	}
+
+	//secrets appended during the capture are read again
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("SERVER_TRAFFIC_SECRET_0 " + hexRepeat("ab", 32) + " 0506\n")
+	f.Close()
+	if got := k.Secret(random, keyLogServerTraffic); !bytes.Equal(got, []byte{5, 6}) {
+		t.Errorf("appended secret %x", got)
+	}
+
+	if _, err := LoadKeyLog(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("missing file: no error")
+	}
+}
+
+func hexRepeat(s string, n int) string {
+	return string(bytes.Repeat([]byte(s), n))
+}
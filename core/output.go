@@ -0,0 +1,191 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/40t/go-sniffer/core/event"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//--format
+const (
+	FormatText = "text"
+	FormatJson = "json"
+)
+
+const (
+	DefaultOutputBuffer = 10000
+	outputFlushInterval = time.Second
+)
+
+//--output options
+//Sinks defaults to stdout, Buffer is the number of lines
+//queued per sink, Size and Keep rotate file sinks
+type OutputOption struct {
+	Sinks  []string
+	Buffer int
+	Size   int64
+	Keep   int
+}
+
+//Output formats the events of plug-ins, one line
+//per event, and hands them to every sink
+type Output struct {
+	format string
+	queues []*sinkQueue
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewOutput(format string, opt OutputOption, block bool) (*Output, error) {
+
+	if format == "" {
+		format = FormatText
+	}
+	if len(opt.Sinks) == 0 {
+		opt.Sinks = []string{SinkStdout}
+	}
+	if opt.Buffer <= 0 {
+		opt.Buffer = DefaultOutputBuffer
+	}
+
+	o := &Output{
+		format: format,
+	}
+	for _, spec := range opt.Sinks {
+		sink, err := NewSink(spec, opt)
+		if err != nil {
+			o.Close()
+			return nil, err
+		}
+		o.queues = append(o.queues, newSinkQueue(spec, sink, opt.Buffer, block))
+	}
+	return o, nil
+}
+
+func (o *Output) Emit(e *event.Event) {
+
+	line, err := o.Format(e)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERR : Format event", err)
+		return
+	}
+
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.closed {
+		return
+	}
+	for _, q := range o.queues {
+		q.push(line)
+	}
+}
+
+//Format returns the event as one line
+//of text, or of json (JSON Lines)
+func (o *Output) Format(e *event.Event) ([]byte, error) {
+
+	if o.format == FormatJson {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		return append(line, '\n'), nil
+	}
+	return []byte(e.String() + "\n"), nil
+}
+
+//Close drains every sink and reports lost lines
+func (o *Output) Close() {
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	o.closed = true
+
+	for _, q := range o.queues {
+		q.close()
+		if dropped, failed := q.stats(); dropped > 0 || failed > 0 {
+			fmt.Fprintf(os.Stderr, "# output %s : %d dropped, %d write errors\n", q.name, dropped, failed)
+		}
+	}
+}
+
+//sinkQueue is the bounded buffer in front of a sink, so that
+//a slow sink never stalls the capture. Lines are dropped
+//when it is full, unless block is set (reading from file)
+type sinkQueue struct {
+	name    string
+	sink    Sink
+	lines   chan []byte
+	block   bool
+	done    chan bool
+	dropped uint64
+	failed  uint64
+}
+
+func newSinkQueue(name string, sink Sink, size int, block bool) *sinkQueue {
+	q := &sinkQueue{
+		name:  name,
+		sink:  sink,
+		lines: make(chan []byte, size),
+		block: block,
+		done:  make(chan bool),
+	}
+	go q.run()
+	return q
+}
+
+func (q *sinkQueue) push(line []byte) {
+
+	if q.block {
+		q.lines <- line
+		return
+	}
+	select {
+	case q.lines <- line:
+	default:
+		atomic.AddUint64(&q.dropped, 1)
+	}
+}
+
+func (q *sinkQueue) run() {
+
+	ticker := time.NewTicker(outputFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case line, ok := <-q.lines:
+			if !ok {
+				q.check(q.sink.Flush())
+				q.check(q.sink.Close())
+				close(q.done)
+				return
+			}
+			q.check(q.sink.Write(line))
+		case <-ticker.C:
+			q.check(q.sink.Flush())
+		}
+	}
+}
+
+func (q *sinkQueue) check(err error) {
+	if err != nil {
+		atomic.AddUint64(&q.failed, 1)
+	}
+}
+
+func (q *sinkQueue) close() {
+	close(q.lines)
+	<-q.done
+}
+
+func (q *sinkQueue) stats() (dropped, failed uint64) {
+	return atomic.LoadUint64(&q.dropped), atomic.LoadUint64(&q.failed)
+}
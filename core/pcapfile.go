@@ -0,0 +1,156 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//--write options
+//Size and Age of 0 disable the rotation, Keep of 0 keeps every file
+type WriteOption struct {
+	File string
+	Size int64
+	Age  time.Duration
+	Keep int
+}
+
+type packetWriter interface {
+	WritePacket(ci gopacket.CaptureInfo, data []byte) error
+}
+
+//PcapWriter tees raw packets into pcap files,
+//or pcapng files if the name ends with .pcapng
+type PcapWriter struct {
+	opt      WriteOption
+	linkType layers.LinkType
+	snapLen  uint32
+
+	file   *os.File
+	buf    *bufio.Writer
+	ng     *pcapgo.NgWriter
+	w      packetWriter
+	size   int64
+	opened time.Time
+	seq    int
+	files  []string
+}
+
+func NewPcapWriter(opt WriteOption, linkType layers.LinkType, snapLen int) *PcapWriter {
+	return &PcapWriter{
+		opt:      opt,
+		linkType: linkType,
+		snapLen:  uint32(snapLen),
+	}
+}
+
+//write packet, rotating by size and capture time
+func (pw *PcapWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+
+	if pw.w == nil || pw.shouldRotate(ci.Timestamp) {
+		if err := pw.rotate(ci.Timestamp); err != nil {
+			return err
+		}
+	}
+
+	if err := pw.w.WritePacket(ci, data); err != nil {
+		return err
+	}
+	pw.size += int64(16 + len(data))
+	return nil
+}
+
+func (pw *PcapWriter) shouldRotate(ts time.Time) bool {
+	if pw.opt.Size > 0 && pw.size >= pw.opt.Size {
+		return true
+	}
+	if pw.opt.Age > 0 && ts.Sub(pw.opened) >= pw.opt.Age {
+		return true
+	}
+	return false
+}
+
+func (pw *PcapWriter) rotating() bool {
+	return pw.opt.Size > 0 || pw.opt.Age > 0
+}
+
+//close current file, open the next one and apply retention
+func (pw *PcapWriter) rotate(ts time.Time) error {
+
+	if err := pw.Close(); err != nil {
+		return err
+	}
+
+	name := pw.opt.File
+	if pw.rotating() {
+		pw.seq++
+		ext  := filepath.Ext(name)
+		name  = fmt.Sprintf("%s-%s-%d%s",
+			strings.TrimSuffix(name, ext), ts.Format("20060102150405"), pw.seq, ext)
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(name, ".pcapng") {
+		ng, err := pcapgo.NewNgWriter(f, pw.linkType)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		pw.ng = ng
+		pw.w  = ng
+	} else {
+		pw.buf = bufio.NewWriter(f)
+		w := pcapgo.NewWriter(pw.buf)
+		if err := w.WriteFileHeader(pw.snapLen, pw.linkType); err != nil {
+			f.Close()
+			return err
+		}
+		pw.w = w
+	}
+
+	pw.file   = f
+	pw.size   = 0
+	pw.opened = ts
+
+	//retention
+	pw.files = append(pw.files, name)
+	for pw.opt.Keep > 0 && len(pw.files) > pw.opt.Keep {
+		os.Remove(pw.files[0])
+		pw.files = pw.files[1:]
+	}
+	return nil
+}
+
+//flush and close current file
+func (pw *PcapWriter) Close() error {
+
+	if pw.file == nil {
+		return nil
+	}
+
+	var err error
+	if pw.ng != nil {
+		err = pw.ng.Flush()
+	} else if pw.buf != nil {
+		err = pw.buf.Flush()
+	}
+	if cerr := pw.file.Close(); err == nil {
+		err = cerr
+	}
+
+	pw.file = nil
+	pw.buf  = nil
+	pw.ng   = nil
+	pw.w    = nil
+	return err
+}
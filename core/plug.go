@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"plugin"
 	"github.com/google/gopacket"
+	"github.com/40t/go-sniffer/core/event"
 	"io"
 	mysql "github.com/40t/go-sniffer/plugSrc/mysql/build"
 	redis "github.com/40t/go-sniffer/plugSrc/redis/build"
@@ -12,12 +13,15 @@ import (
 	"path/filepath"
 	"fmt"
 	"path"
+	"time"
 )
 
 type Plug struct {
 
 	dir string
-	ResolveStream func(net gopacket.Flow, transport gopacket.Flow, r io.Reader)
+	ResolveStream func(net gopacket.Flow, transport gopacket.Flow, r io.Reader, emit event.Emitter)
+	Flush func(emit event.Emitter)
+	Tick func(now time.Time, emit event.Emitter)
 	BPF string
 
 	InternalPlugList map[string]PlugInterface
@@ -25,17 +29,29 @@ type Plug struct {
 }
 
 // All internal plug-ins must implement this interface
-// ResolvePacket - entry
+// ResolvePacket - entry, decoded requests and responses go to emit
 // BPFFilter     - set BPF, like: mysql(tcp and port 3306)
 // SetFlag       - plug-in params
 // Version       - plug-in version
 type PlugInterface interface {
-	ResolveStream(net gopacket.Flow, transport gopacket.Flow, r io.Reader)
+	ResolveStream(net gopacket.Flow, transport gopacket.Flow, r io.Reader, emit event.Emitter)
 	BPFFilter() string
 	SetFlag([]string)
 	Version() string
 }
 
+// Internal plug-ins holding results across streams may also implement
+// Flush - emit what is left, called once when the capture ends
+type PlugFlusher interface {
+	Flush(emit event.Emitter)
+}
+
+// Internal plug-ins reporting periodically may also implement
+// Tick - report what is due at now, called every second of a live capture
+type PlugTicker interface {
+	Tick(now time.Time, emit event.Emitter)
+}
+
 type ExternalPlug struct {
 	Name          string
 	Version       string
@@ -149,6 +165,12 @@ func (p *Plug) SetOption(plugName string, plugParams []string) {
 	if internalPlug, ok := p.InternalPlugList[plugName]; ok {
 
 		p.ResolveStream = internalPlug.ResolveStream
+		if flusher, ok := internalPlug.(PlugFlusher); ok {
+			p.Flush = flusher.Flush
+		}
+		if ticker, ok := internalPlug.(PlugTicker); ok {
+			p.Tick = ticker.Tick
+		}
 		internalPlug.SetFlag(plugParams)
 		p.BPF =  internalPlug.BPFFilter()
 
@@ -172,7 +194,11 @@ func (p *Plug) SetOption(plugName string, plugParams []string) {
 	if err != nil {
 		panic(err)
 	}
-	p.ResolveStream = resolvePacket.(func(net gopacket.Flow, transport gopacket.Flow, r io.Reader))
+	//external plug-ins print by themselves
+	resolve := resolvePacket.(func(net gopacket.Flow, transport gopacket.Flow, r io.Reader))
+	p.ResolveStream = func(net gopacket.Flow, transport gopacket.Flow, r io.Reader, _ event.Emitter) {
+		resolve(net, transport, r)
+	}
 	setFlag.(func([]string))(plugParams)
 	p.BPF = BPFFilter.(func()string)()
 }
\ No newline at end of file
@@ -0,0 +1,279 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"github.com/40t/go-sniffer/plugSrc/mongodb/build/bson"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+//go test ./core -run TestReplay -update
+var update = flag.Bool("update", false, "write the pcaps of testdata and their output")
+
+//bytes sent by one side of a connection in one segment
+type segment struct {
+	client bool
+	data   string
+}
+
+func client(data ...string) segment {
+	return segment{true, strings.Join(data, "")}
+}
+
+func server(data ...string) segment {
+	return segment{false, strings.Join(data, "")}
+}
+
+//one connection of each plug-in, from 10.0.0.1:50000 to 10.0.0.2
+var conversations = []struct {
+	plugin   string
+	port     uint16
+	segments []segment
+}{
+	{"mysql", 3306, []segment{
+		server(mysqlPacket(0, mysqlGreeting())),
+		client(mysqlPacket(1, mysqlLogin("app", "shop"))),
+		server(mysqlPacket(2, "\x00\x00\x00\x02\x00\x00\x00")),
+		client(mysqlPacket(0, "\x03select id, name from users where id = 1")),
+		server(mysqlPacket(1, "\x02"), mysqlPacket(2, mysqlColumn("id", 0x08)), mysqlPacket(3, mysqlColumn("name", 0xfd)),
+			mysqlPacket(4, "\xfe\x00\x00\x02\x00"), mysqlPacket(5, "\x011\x05alice"), mysqlPacket(6, "\xfe\x00\x00\x02\x00")),
+		client(mysqlPacket(0, "\x03insert into users (name) values ('bob')")),
+		server(mysqlPacket(1, "\x00\x01\x02\x02\x00\x00\x00")),
+		client(mysqlPacket(0, "\x03select * from missing")),
+		server(mysqlPacket(1, "\xff\x7a\x04#42S02Table 'shop.missing' doesn't exist")),
+		client(mysqlPacket(0, "\x01")),
+	}},
+	{"redis", 6379, []segment{
+		client("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\nvalue\r\n"),
+		server("+OK\r\n"),
+		client("*2\r\n$3\r\nGET\r\n$1\r\nk\r\n*2\r\n$4\r\nINCR\r\n$1\r\nn\r\n"),
+		server("$5\r\nvalue\r\n", ":1\r\n"),
+		client("*2\r\n$7\r\nHGETALL\r\n$1\r\nh\r\n"),
+		server("*4\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r\n"),
+		client("*1\r\n$3\r\nFOO\r\n"),
+		server("-ERR unknown command 'FOO'\r\n"),
+	}},
+	{"http", 80, []segment{
+		client("GET /index.html?q=1 HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		server("HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: 5\r\n\r\nhello"),
+		client("POST /login HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 8\r\n\r\n"),
+		client("user=app"),
+		server("HTTP/1.1 302 Found\r\nLocation: /\r\nContent-Length: 0\r\n\r\n"),
+	}},
+	{"mongodb", 27017, []segment{
+		client(mongoMessage(2002, int32(0), "shop.orders", bson.M{"id": 1, "total": 9.5})),
+		client(mongoMessage(2004, int32(0), "shop.orders", int32(0), int32(1), bson.M{"id": 1})),
+		server(mongoMessage(1, int32(0), int64(0), int32(0), int32(1), bson.M{"id": 1, "total": 9.5})),
+		client(mongoMessage(2006, int32(0), "shop.orders", int32(0), bson.M{"id": 1})),
+	}},
+}
+
+//packet of the mysql protocol: length(3), sequence, payload
+func mysqlPacket(seq byte, payload string) string {
+	n := len(payload)
+	return string([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq}) + payload
+}
+
+//HandshakeV10 of a 8.0 server with mysql_native_password
+func mysqlGreeting() string {
+	capability := uint32(1<<9 | 1<<15 | 1<<19)
+	b := []byte("\x0a8.0.36\x00\x07\x00\x00\x0001234567\x00")
+	b = binary.LittleEndian.AppendUint16(b, uint16(capability))
+	b = append(b, 0x21, 2, 0)
+	b = binary.LittleEndian.AppendUint16(b, uint16(capability>>16))
+	b = append(b, 21)
+	b = append(b, make([]byte, 10)...)
+	return string(b) + "89abcdefghij\x00mysql_native_password\x00"
+}
+
+//HandshakeResponse41 with a database and an auth plugin
+func mysqlLogin(user, db string) string {
+	capability := uint32(1<<3 | 1<<9 | 1<<15 | 1<<19)
+	b := binary.LittleEndian.AppendUint32(nil, capability)
+	b = binary.LittleEndian.AppendUint32(b, 1<<24)
+	b = append(b, 0x21)
+	b = append(b, make([]byte, 23)...)
+	return string(b) + user + "\x00\x1401234567890123456789" + db + "\x00mysql_native_password\x00"
+}
+
+//ColumnDefinition41 of the table shop.users
+func mysqlColumn(name string, typ byte) string {
+	lenenc := func(s string) string {
+		return string([]byte{byte(len(s))}) + s
+	}
+	return lenenc("def") + lenenc("shop") + lenenc("users") + lenenc("users") + lenenc(name) + lenenc(name) +
+		"\x0c\x21\x00\x00\x01\x00\x00" + string([]byte{typ}) + "\x00\x00\x00\x00\x00"
+}
+
+//message of the mongodb wire protocol with the fields of opCode
+func mongoMessage(opCode int32, fields ...interface{}) string {
+	var body bytes.Buffer
+	for _, f := range fields {
+		switch f := f.(type) {
+		case int32:
+			binary.Write(&body, binary.LittleEndian, f)
+		case int64:
+			binary.Write(&body, binary.LittleEndian, f)
+		case string:
+			body.WriteString(f + "\x00")
+		case bson.M:
+			doc, err := bson.Marshal(f)
+			if err != nil {
+				panic(err)
+			}
+			body.Write(doc)
+		}
+	}
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[0:], uint32(16+body.Len()))
+	binary.LittleEndian.PutUint32(header[4:], 1)
+	binary.LittleEndian.PutUint32(header[12:], uint32(opCode))
+	return string(header) + body.String()
+}
+
+//the connection as captured on ethernet: handshake,
+//segments a millisecond apart, closed by the client
+func writeConversation(path string, port uint16, segments []segment) error {
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		return err
+	}
+
+	seen := time.Date(2026, 10, 18, 15, 4, 5, 0, time.UTC)
+	seq  := map[bool]uint32{true: 1000, false: 5000}
+	write := func(fromClient bool, flags string, data string) error {
+		eth := &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+			DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolTCP,
+			SrcIP:    net.IP{10, 0, 0, 1},
+			DstIP:    net.IP{10, 0, 0, 2},
+		}
+		tcp := &layers.TCP{
+			SrcPort: 50000,
+			DstPort: layers.TCPPort(port),
+			Seq:     seq[fromClient],
+			Ack:     seq[!fromClient],
+			ACK:     flags != "S",
+			SYN:     strings.Contains(flags, "S"),
+			FIN:     strings.Contains(flags, "F"),
+			PSH:     data != "",
+			Window:  65535,
+		}
+		if !fromClient {
+			eth.SrcMAC, eth.DstMAC = eth.DstMAC, eth.SrcMAC
+			ip.SrcIP, ip.DstIP = ip.DstIP, ip.SrcIP
+			tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+		}
+		tcp.SetNetworkLayerForChecksum(ip)
+
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(data)); err != nil {
+			return err
+		}
+		seq[fromClient] += uint32(len(data))
+		if tcp.SYN || tcp.FIN {
+			seq[fromClient]++
+		}
+		seen = seen.Add(time.Millisecond)
+		return w.WritePacket(gopacket.CaptureInfo{Timestamp: seen, CaptureLength: len(buf.Bytes()), Length: len(buf.Bytes())}, buf.Bytes())
+	}
+
+	steps := []segment{{true, "S"}, {false, "SA"}, {true, "A"}}
+	for _, s := range segments {
+		steps = append(steps, segment{s.client, "A" + s.data})
+	}
+	steps = append(steps, segment{true, "FA"}, segment{false, "FA"}, segment{true, "A"})
+	for _, s := range steps {
+		flags, data := s.data, ""
+		if len(s.data) > 2 && s.data[0] == 'A' && s.data != "A" {
+			flags, data = "A", s.data[1:]
+		}
+		if err := write(s.client, flags, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//lines of the plug-in for the pcap of path, read with --read and
+//printed as json, sorted as the directions are read concurrently
+func replay(t *testing.T, plugin, path string) []string {
+	t.Helper()
+
+	p := &Plug{}
+	p.LoadInternalPlugList()
+	p.SetOption(plugin, nil)
+
+	out := filepath.Join(t.TempDir(), plugin+".json")
+	NewDispatch(p, &Cmd{
+		ReadFile: path,
+		Format:   FormatJson,
+		Output:   OutputOption{Sinks: []string{SinkFile + out}},
+	}).Capture()
+
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestReplay(t *testing.T) {
+
+	for _, c := range conversations {
+		pcap := filepath.Join("testdata", c.plugin+".pcap")
+		golden := filepath.Join("testdata", c.plugin+".json")
+		if *update {
+			if err := writeConversation(pcap, c.port, c.segments); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		lines := replay(t, c.plugin, pcap)
+		if *update {
+			if err := os.WriteFile(golden, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(lines, "\n") + "\n"; got != string(want) {
+			t.Errorf("%s:\n%s\nwant:\n%s", c.plugin, got, want)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+//--output
+const (
+	SinkStdout = "stdout"
+	SinkFile   = "file:"
+	SinkUnix   = "unix:"
+	SinkSyslog = "syslog"
+	SinkHttp   = "http://"
+	SinkHttps  = "https://"
+)
+
+//Sink receives formatted lines, one event per line.
+//A sink is only used by one goroutine
+type Sink interface {
+	Write(line []byte) error
+	Flush() error
+	Close() error
+}
+
+//NewSink creates the sink of an --output value, like
+//stdout, file:/var/log/sniffer.log, unix:/run/sniffer.sock,
+//syslog, syslog:tag, http://127.0.0.1:8080/events
+func NewSink(spec string, opt OutputOption) (Sink, error) {
+
+	switch {
+	case spec == SinkStdout:
+		return &stdoutSink{}, nil
+	case strings.HasPrefix(spec, SinkFile):
+		return newFileSink(strings.TrimPrefix(spec, SinkFile), opt.Size, opt.Keep)
+	case strings.HasPrefix(spec, SinkUnix):
+		return newUnixSink(strings.TrimPrefix(spec, SinkUnix)), nil
+	case spec == SinkSyslog || strings.HasPrefix(spec, SinkSyslog+":"):
+		tag := strings.TrimPrefix(strings.TrimPrefix(spec, SinkSyslog), ":")
+		if tag == "" {
+			tag = "go-sniffer"
+		}
+		return newSyslogSink(tag)
+	case strings.HasPrefix(spec, SinkHttp), strings.HasPrefix(spec, SinkHttps):
+		return newHttpSink(spec), nil
+	}
+	return nil, errors.New("unknown output " + spec)
+}
+
+//stdout
+type stdoutSink struct{}
+
+func (s *stdoutSink) Write(line []byte) error {
+	_, err := os.Stdout.Write(line)
+	return err
+}
+
+func (s *stdoutSink) Flush() error {
+	return nil
+}
+
+func (s *stdoutSink) Close() error {
+	return nil
+}
+
+//append-only file, rotated to path.1 ... path.keep
+//when it grows over size (0 means no rotation)
+type fileSink struct {
+	path string
+	size int64
+	keep int
+	file *os.File
+	used int64
+}
+
+func newFileSink(path string, size int64, keep int) (*fileSink, error) {
+	s := &fileSink{
+		path: path,
+		size: size,
+		keep: keep,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.used = fi.Size()
+	return nil
+}
+
+func (s *fileSink) Write(line []byte) error {
+
+	if s.size > 0 && s.used+int64(len(line)) > s.size && s.used > 0 {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.used += int64(n)
+	return err
+}
+
+func (s *fileSink) rotate() error {
+
+	s.file.Close()
+
+	keep := s.keep
+	if keep <= 0 {
+		keep = 1
+	}
+	os.Remove(fmt.Sprintf("%s.%d", s.path, keep))
+	for i := keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *fileSink) Flush() error {
+	return nil
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
+
+//unix domain socket stream, reconnected after errors
+type unixSink struct {
+	path string
+	conn net.Conn
+}
+
+func newUnixSink(path string) *unixSink {
+	return &unixSink{
+		path: path,
+	}
+}
+
+func (s *unixSink) Write(line []byte) error {
+
+	if s.conn == nil {
+		conn, err := net.DialTimeout("unix", s.path, time.Second)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if _, err := s.conn.Write(line); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *unixSink) Flush() error {
+	return nil
+}
+
+func (s *unixSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+//local syslog, one message per event
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink(tag string) (*syslogSink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{
+		w: w,
+	}, nil
+}
+
+func (s *syslogSink) Write(line []byte) error {
+	return s.w.Info(string(bytes.TrimRight(line, "\n")))
+}
+
+func (s *syslogSink) Flush() error {
+	return nil
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
+
+//batching POST of lines to an http endpoint
+const (
+	httpSinkBatch   = 500
+	httpSinkTimeout = 5 * time.Second
+)
+
+type httpSink struct {
+	url    string
+	client *http.Client
+	buf    bytes.Buffer
+	lines  int
+}
+
+func newHttpSink(url string) *httpSink {
+	return &httpSink{
+		url:    url,
+		client: &http.Client{Timeout: httpSinkTimeout},
+	}
+}
+
+func (s *httpSink) Write(line []byte) error {
+	s.buf.Write(line)
+	s.lines++
+	if s.lines >= httpSinkBatch {
+		return s.Flush()
+	}
+	return nil
+}
+
+//post pending lines, the batch is dropped on error
+func (s *httpSink) Flush() error {
+
+	if s.lines == 0 {
+		return nil
+	}
+	defer func() {
+		s.buf.Reset()
+		s.lines = 0
+	}()
+
+	resp, err := s.client.Post(s.url, "application/x-ndjson", bytes.NewReader(s.buf.Bytes()))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("http output " + resp.Status)
+	}
+	return nil
+}
+
+func (s *httpSink) Close() error {
+	return s.Flush()
+}
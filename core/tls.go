@@ -0,0 +1,575 @@
+package core
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/40t/go-sniffer/core/event"
+	"github.com/google/gopacket"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tlsRecordHeader     = 5
+	tlsMaxRecord        = 16384 + 2048
+	tlsChangeCipherSpec = 0x14
+	tlsAlert            = 0x15
+	tlsHandshake        = 0x16
+	tlsApplicationData  = 0x17
+
+	tlsClientHello = 0x01
+	tlsServerHello = 0x02
+	tlsFinished    = 20
+	tlsKeyUpdate   = 24
+
+	tlsVersion12 = 0x0303
+	tlsVersion13 = 0x0304
+
+	extServerName        = 0
+	extALPN              = 16
+	extEncryptThenMAC    = 22
+	extSupportedVersions = 43
+
+	//largest handshake message gathered from the stream
+	tlsMaxHello = 1 << 16
+)
+
+var (
+	errTLSHello     = errors.New("ERR : Invalid tls hello")
+	errTLSHandshake = errors.New("handshake not captured")
+	errTLSRecord    = errors.New("invalid record")
+)
+
+var tlsVersions = map[uint16]string{
+	0x0300: "SSL 3.0",
+	0x0301: "TLS 1.0",
+	0x0302: "TLS 1.1",
+	0x0303: "TLS 1.2",
+	0x0304: "TLS 1.3",
+}
+
+func TLSVersionName(v uint16) string {
+	if name, ok := tlsVersions[v]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+//TLSHello is a ClientHello or a ServerHello,
+//the client lists what it offers, the server what it picked
+type TLSHello struct {
+	Client   bool
+	Version  uint16
+	Random   []byte
+	Ciphers  []uint16
+	SNI      string
+	ALPN     []string
+	Versions []uint16
+
+	//RFC 7366, for cbc cipher suites
+	EncryptThenMAC bool
+}
+
+//random of a ServerHello asking for another ClientHello
+var helloRetryRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+//IsTLSRecord reports whether b starts with the record of a hello,
+//or at the start of a stream with any record, for connections
+//captured after the handshake
+func IsTLSRecord(b []byte, start bool) bool {
+
+	if len(b) < tlsRecordHeader || b[1] != 3 || b[2] > 4 {
+		return false
+	}
+	length := int(binary.BigEndian.Uint16(b[3:5]))
+	if length == 0 || length > tlsMaxRecord {
+		return false
+	}
+
+	switch b[0] {
+	case tlsHandshake:
+		//hello type, length(3) and legacy version
+		return len(b) >= 11 && (b[5] == tlsClientHello || b[5] == tlsServerHello) &&
+			b[9] == 3 && b[10] <= 4
+	case 0x14, 0x15, tlsApplicationData:
+		return start && b[2] >= 1
+	}
+	return false
+}
+
+//version(2), random(32), session id; cipher suites and compression
+//methods (a list for the client, one for the server); extensions
+func parseHello(b []byte, client bool) (*TLSHello, error) {
+
+	h := &TLSHello{
+		Client: client,
+	}
+	if len(b) < 35 {
+		return nil, errTLSHello
+	}
+	h.Version = binary.BigEndian.Uint16(b[0:2])
+	h.Random  = append([]byte{}, b[2:34]...)
+	pos := 34 + 1 + int(b[34])
+
+	if client {
+		if pos+2 > len(b) {
+			return nil, errTLSHello
+		}
+		l := int(binary.BigEndian.Uint16(b[pos : pos+2]))
+		pos += 2
+		if pos+l > len(b) {
+			return nil, errTLSHello
+		}
+		for i := 0; i+1 < l; i += 2 {
+			h.Ciphers = append(h.Ciphers, binary.BigEndian.Uint16(b[pos+i:pos+i+2]))
+		}
+		pos += l
+		if pos >= len(b) {
+			return nil, errTLSHello
+		}
+		pos += 1 + int(b[pos])
+	} else {
+		if pos+3 > len(b) {
+			return nil, errTLSHello
+		}
+		h.Ciphers = []uint16{binary.BigEndian.Uint16(b[pos : pos+2])}
+		pos += 3
+	}
+
+	//no extensions
+	if pos+2 > len(b) {
+		return h, nil
+	}
+	end := pos + 2 + int(binary.BigEndian.Uint16(b[pos:pos+2]))
+	if end > len(b) {
+		return nil, errTLSHello
+	}
+	for pos += 2; pos+4 <= end; {
+		typ := binary.BigEndian.Uint16(b[pos : pos+2])
+		l   := int(binary.BigEndian.Uint16(b[pos+2 : pos+4]))
+		pos += 4
+		if pos+l > end {
+			return nil, errTLSHello
+		}
+		h.parseExtension(typ, b[pos:pos+l])
+		pos += l
+	}
+	return h, nil
+}
+
+func (h *TLSHello) parseExtension(typ uint16, b []byte) {
+
+	switch typ {
+
+	case extServerName:
+		//list length(2), then name type(1), length(2), name
+		if len(b) >= 5 && b[2] == 0 {
+			l := int(binary.BigEndian.Uint16(b[3:5]))
+			if 5+l <= len(b) {
+				h.SNI = string(b[5 : 5+l])
+			}
+		}
+
+	case extALPN:
+		//list length(2), then length(1), protocol
+		for pos := 2; pos < len(b); {
+			l := int(b[pos])
+			if pos+1+l > len(b) {
+				break
+			}
+			h.ALPN = append(h.ALPN, string(b[pos+1:pos+1+l]))
+			pos += 1 + l
+		}
+
+	case extEncryptThenMAC:
+		h.EncryptThenMAC = true
+
+	case extSupportedVersions:
+		//the client lists them, the server picks one
+		if !h.Client {
+			if len(b) >= 2 {
+				h.Versions = []uint16{binary.BigEndian.Uint16(b)}
+			}
+			return
+		}
+		if len(b) < 1 {
+			return
+		}
+		for pos := 1; pos+2 <= len(b) && pos <= int(b[0]); pos += 2 {
+			h.Versions = append(h.Versions, binary.BigEndian.Uint16(b[pos:pos+2]))
+		}
+	}
+}
+
+//negotiated version, from supported_versions since tls 1.3
+func (h *TLSHello) NegotiatedVersion() uint16 {
+	if !h.Client && len(h.Versions) > 0 {
+		return h.Versions[0]
+	}
+	return h.Version
+}
+
+func (h *TLSHello) IsHelloRetry() bool {
+	return !h.Client && bytes.Equal(h.Random, helloRetryRandom)
+}
+
+//tlsStream reads the records of one direction of a tls connection:
+//the hello, and with a key log all the records, decrypted for the plug-in
+type tlsStream struct {
+	net, transport gopacket.Flow
+	conn      *tlsConn
+	keylog    *KeyLog
+	emit      event.Emitter
+
+	//the direction of the ClientHello
+	client    bool
+	records   []byte
+	handshake []byte
+	cipher    *tlsCipher
+
+	//tls 1.3, the traffic secret follows the Finished
+	application bool
+	done        bool
+}
+
+func newTLSStream(net, transport gopacket.Flow, conn *tlsConn, keylog *KeyLog, emit event.Emitter) *tlsStream {
+	return &tlsStream{
+		net:       net,
+		transport: transport,
+		conn:      conn,
+		keylog:    keylog,
+		emit:      emit,
+	}
+}
+
+//feed returns the plaintext of the records completed by b
+func (t *tlsStream) feed(b []byte) ([]byte, error) {
+
+	if t.done {
+		return nil, nil
+	}
+	t.records = append(t.records, b...)
+
+	var plain []byte
+	for len(t.records) >= tlsRecordHeader && !t.done {
+		length := int(binary.BigEndian.Uint16(t.records[3:5]))
+		if length > tlsMaxRecord {
+			t.done = true
+			return plain, errTLSRecord
+		}
+		if len(t.records) < tlsRecordHeader+length {
+			break
+		}
+		p, err := t.record(t.records[:tlsRecordHeader+length])
+		if err != nil {
+			//not decrypted, as far as the handshake was read
+			t.done = true
+			t.conn.report(t.emit)
+			return plain, err
+		}
+		plain = append(plain, p...)
+		t.records = t.records[tlsRecordHeader+length:]
+	}
+	if t.done {
+		t.records = nil
+	}
+	return plain, nil
+}
+
+//one record, application data is returned
+func (t *tlsStream) record(rec []byte) ([]byte, error) {
+
+	typ := rec[0]
+	if t.cipher == nil {
+		switch typ {
+		case tlsHandshake:
+			return nil, t.readHandshake(rec[tlsRecordHeader:], false)
+		case tlsChangeCipherSpec:
+			//tls 1.3 sends it for middleboxes only, from the first
+			//ClientHello or HelloRetryRequest on; tls 1.2 not before
+			//the ServerHello
+			if v := t.conn.version(); v == tlsVersion13 || v == 0 {
+				return nil, nil
+			}
+			return nil, t.install12()
+		case tlsAlert:
+			return nil, nil
+		}
+		//encrypted handshake of tls 1.3
+		if err := t.install13(); err != nil {
+			return nil, err
+		}
+	}
+	if typ == tlsChangeCipherSpec {
+		return nil, nil
+	}
+
+	inner, plain, err := t.cipher.open(rec)
+	if err != nil {
+		return nil, err
+	}
+	switch inner {
+	case tlsApplicationData:
+		t.conn.decrypt(t.emit)
+		return plain, nil
+	case tlsHandshake:
+		return nil, t.readHandshake(plain, true)
+	}
+	return nil, nil
+}
+
+//handshake messages may span records: type(1), length(3), body
+func (t *tlsStream) readHandshake(b []byte, encrypted bool) error {
+
+	t.handshake = append(t.handshake, b...)
+	for len(t.handshake) >= 4 && !t.done {
+		size := int(t.handshake[1])<<16 | int(t.handshake[2])<<8 | int(t.handshake[3])
+		if size > tlsMaxHello {
+			return errTLSRecord
+		}
+		if len(t.handshake) < 4+size {
+			break
+		}
+		typ, msg := t.handshake[0], t.handshake[4:4+size]
+		t.handshake = t.handshake[4+size:]
+		if err := t.message(typ, msg, encrypted); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tlsStream) message(typ byte, msg []byte, encrypted bool) error {
+
+	switch {
+
+	case !encrypted && (typ == tlsClientHello || typ == tlsServerHello):
+		h, err := parseHello(msg, typ == tlsClientHello)
+		if err != nil {
+			return err
+		}
+		t.client = h.Client
+
+		//the real ServerHello follows a second ClientHello,
+		//the version is known from the retry until then
+		if h.IsHelloRetry() {
+			t.conn.helloRetry(h)
+			return nil
+		}
+
+		//the hello is all there is to read without keys, with
+		//them the connection is reported once a record opens
+		if t.conn.hello(h, t.net, t.transport) && t.keylog == nil {
+			t.conn.report(t.emit)
+		}
+		if t.keylog == nil {
+			t.done = true
+		}
+
+	case encrypted && typ == tlsFinished && !t.application && t.conn.version() == tlsVersion13:
+		t.application = true
+		t.cipher = nil
+		return t.install13()
+
+	case encrypted && typ == tlsKeyUpdate && t.application:
+		t.cipher.update()
+	}
+	return nil
+}
+
+//tlsConn is the tls state of a connection,
+//shared by the streams of both directions
+type tlsConn struct {
+	mu       sync.Mutex
+	client   string
+	server   string
+	seen     time.Time
+
+	encrypted bool
+	decrypted bool
+	reported  bool
+	clientHello *TLSHello
+	serverHello *TLSHello
+	retry       *TLSHello
+
+	//streams not complete yet
+	streams  int
+}
+
+//tlsConns pairs the streams of a connection
+type tlsConns struct {
+	mu    sync.Mutex
+	conns map[uint64]*tlsConn
+}
+
+func (c *tlsConns) get(net, transport gopacket.Flow) *tlsConn {
+
+	//FastHash is the same for both directions
+	key := net.FastHash() ^ transport.FastHash()*31
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns == nil {
+		c.conns = make(map[uint64]*tlsConn)
+	}
+	conn, ok := c.conns[key]
+	if !ok {
+		conn = &tlsConn{}
+		c.conns[key] = conn
+	}
+	conn.streams++
+	return conn
+}
+
+//the stream of a direction is complete, true for the last one
+func (c *tlsConns) done(net, transport gopacket.Flow, conn *tlsConn) bool {
+
+	key := net.FastHash() ^ transport.FastHash()*31
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn.streams--
+	if conn.streams > 0 {
+		return false
+	}
+	if c.conns[key] == conn {
+		delete(c.conns, key)
+	}
+	return true
+}
+
+//the stream of a direction has turned out to be tls
+func (t *tlsConn) encrypt(net, transport gopacket.Flow, seen time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.encrypted = true
+	if t.seen.IsZero() {
+		t.seen = seen
+	}
+	if t.client == "" {
+		t.client, t.server = joinAddr(net.Src(), transport.Src()), joinAddr(net.Dst(), transport.Dst())
+	}
+}
+
+//record a hello, true once the connection can be reported
+func (t *tlsConn) hello(h *TLSHello, net, transport gopacket.Flow) bool {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if h.Client {
+		t.clientHello = h
+		t.client, t.server = joinAddr(net.Src(), transport.Src()), joinAddr(net.Dst(), transport.Dst())
+		return false
+	}
+	t.serverHello = h
+	if t.clientHello == nil {
+		t.client, t.server = joinAddr(net.Dst(), transport.Dst()), joinAddr(net.Src(), transport.Src())
+	}
+	return true
+}
+
+//a HelloRetryRequest, the ServerHello to come picks the same version
+func (t *tlsConn) helloRetry(h *TLSHello) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.retry = h
+}
+
+//the application data of the connection could be read
+func (t *tlsConn) decrypt(emit event.Emitter) {
+	t.mu.Lock()
+	reported := t.reported
+	t.decrypted = true
+	t.mu.Unlock()
+	if !reported {
+		t.report(emit)
+	}
+}
+
+//report the connection once, with what is known of the handshake
+func (t *tlsConn) report(emit event.Emitter) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.encrypted || t.reported || emit == nil {
+		return
+	}
+	t.reported = true
+
+	e := &event.Event{
+		Time:      t.seen,
+		Client:    t.client,
+		Server:    t.server,
+		Protocol:  "tls",
+		Direction: event.Request,
+		Operation: "TLS",
+	}
+
+	var fields []string
+	if c := t.clientHello; c != nil && c.SNI != "" {
+		e.Set("sni", c.SNI)
+		fields = append(fields, "sni:"+c.SNI)
+	}
+	if s := t.serverHello; s != nil {
+		version := TLSVersionName(s.NegotiatedVersion())
+		cipher  := tls.CipherSuiteName(s.Ciphers[0])
+		e.Set("version", version).Set("cipher", cipher)
+		fields = append(fields, "version:"+version, "cipher:"+cipher)
+	}
+
+	//tls 1.3 servers pick the protocol in the encrypted
+	//extensions, then only the offer of the client is known
+	if s := t.serverHello; s != nil && len(s.ALPN) > 0 {
+		e.Set("alpn", s.ALPN[0])
+		fields = append(fields, "alpn:"+s.ALPN[0])
+	} else if c := t.clientHello; c != nil && len(c.ALPN) > 0 {
+		e.Set("alpn_offered", c.ALPN)
+		fields = append(fields, "alpn offered:"+strings.Join(c.ALPN, ","))
+	}
+	if t.clientHello == nil && t.serverHello == nil {
+		fields = append(fields, "handshake not captured")
+	}
+
+	e.Statement = strings.Join(fields, " ")
+	e.Status    = "encrypted"
+	if t.decrypted {
+		e.Status = "decrypted"
+	}
+	emit.Emit(e)
+}
+
+//hellos of both sides, nil until captured
+func (t *tlsConn) hellos() (client, server *TLSHello) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.clientHello, t.serverHello
+}
+
+//negotiated version, 0 before the ServerHello
+//or the HelloRetryRequest
+func (t *tlsConn) version() uint16 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case t.serverHello != nil:
+		return t.serverHello.NegotiatedVersion()
+	case t.retry != nil:
+		return t.retry.NegotiatedVersion()
+	}
+	return 0
+}
+
+func joinAddr(host, port gopacket.Endpoint) string {
+	h := host.String()
+	if strings.Contains(h, ":") {
+		h = "[" + h + "]"
+	}
+	return h + ":" + port.String()
+}
@@ -0,0 +1,498 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/40t/go-sniffer/core/event"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+//keys of the handshake and application traffic of RFC 8448, simple 1-RTT
+func TestExpandLabel(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		secret string
+		key    string
+		iv     string
+	}{
+		{"server handshake", "b6 7b 7d 69 0c c1 6c 4e 75 e5 42 13 cb 2d 37 b4 e9 c9 12 bc de d9 10 5d 42 be fd 59 d3 91 ad 38",
+			"3f ce 51 60 09 c2 17 27 d0 f2 e4 e8 6e e4 03 bc", "5d 31 3e b2 67 12 76 ee 13 00 0b 30"},
+		{"client handshake", "b3 ed db 12 6e 06 7f 35 a7 80 b3 ab f4 5e 2d 8f 3b 1a 95 07 38 f5 2e 96 00 74 6a 0e 27 a5 5a 21",
+			"db fa a6 93 d1 76 2c 5b 66 6a f5 d9 50 25 8d 01", "5b d3 c7 1b 83 6e 0b 76 bb 73 26 5f"},
+		{"server application", "a1 1a f9 f0 55 31 f8 56 ad 47 11 6b 45 a9 50 32 82 04 b4 f4 4b fb 6b 3a 4b 4f 1f 3f cb 63 16 43",
+			"9f 02 28 3b 6c 9c 07 ef c2 6b b9 f2 ac 92 e3 56", "cf 78 2b 88 dd 83 54 9a ad f1 e9 84"},
+	}
+
+	for _, tt := range tests {
+		secret := unhex(tt.secret)
+		key := expandLabel(sha256.New, secret, "key", 16)
+		iv  := expandLabel(sha256.New, secret, "iv", 12)
+		if hex.EncodeToString(key) != hex.EncodeToString(unhex(tt.key)) || hex.EncodeToString(iv) != hex.EncodeToString(unhex(tt.iv)) {
+			t.Errorf("%s: key %x iv %x", tt.name, key, iv)
+		}
+	}
+}
+
+//P_SHA256 test vector of the TLS working group
+func TestPRF12(t *testing.T) {
+
+	out := prf12(sha256.New, unhex("9b be 43 6b a9 40 f0 17 b1 76 52 84 9a 71 db 35"), "test label",
+		unhex("a0 ba 9f 93 6c da 31 18 27 a6 f7 96 ff d5 19 8c"), 100)
+	want := "e3f229ba727be17b8d122620557cd453c2aab21d07c3d495329b52d4e61edb5a" +
+		"6b301791e90d35c9c9a46b4e14baf9af0fa022f7077def17abfd3797c0564bab" +
+		"4fbc91666e9def9b97fce34f796789baa48082d122ee42c5a72e5a5110fff701" +
+		"87347b66"
+	if got := hex.EncodeToString(out); got != want {
+		t.Errorf("prf12 %s", got)
+	}
+}
+
+func record(typ byte, body []byte) []byte {
+	rec := []byte{typ, 3, 3, byte(len(body) >> 8), byte(len(body))}
+	return append(rec, body...)
+}
+
+//records sealed as the peers do, opened in sequence
+func TestTLSCipherOpen(t *testing.T) {
+
+	plain := []byte("select 1")
+	key16, key32 := unhex("3f ce 51 60 09 c2 17 27 d0 f2 e4 e8 6e e4 03 bc"), make([]byte, 32)
+	for i := range key32 {
+		key32[i] = byte(i)
+	}
+	macKey := []byte("0123456789abcdefghij")
+
+	nonce := func(iv []byte, seq uint64) []byte {
+		c := &tlsCipher{iv: iv, seq: seq}
+		return c.nonce()
+	}
+	ad12 := func(seq uint64, n int) []byte {
+		c := &tlsCipher{seq: seq}
+		return c.additionalData(tlsApplicationData, n)
+	}
+
+	//tls 1.3, inner type and padding in the plaintext
+	seal13 := func(aead cipher.AEAD, iv []byte) func(seq uint64) []byte {
+		return func(seq uint64) []byte {
+			inner := append(append([]byte{}, plain...), tlsApplicationData, 0, 0)
+			n := len(inner) + aead.Overhead()
+			header := []byte{tlsApplicationData, 3, 3, byte(n >> 8), byte(n)}
+			return append(header, aead.Seal(nil, nonce(iv, seq), inner, header)...)
+		}
+	}
+
+	//tls 1.2 aes-gcm, explicit nonce in the record
+	gcm12 := func(aead cipher.AEAD, salt []byte) func(seq uint64) []byte {
+		return func(seq uint64) []byte {
+			explicit := make([]byte, 8)
+			binary.BigEndian.PutUint64(explicit, seq+1000)
+			sealed := aead.Seal(nil, append(append([]byte{}, salt...), explicit...), plain, ad12(seq, len(plain)))
+			return record(tlsApplicationData, append(explicit, sealed...))
+		}
+	}
+
+	//tls 1.2 chacha20-poly1305, implicit nonce
+	chacha12 := func(aead cipher.AEAD, iv []byte) func(seq uint64) []byte {
+		return func(seq uint64) []byte {
+			return record(tlsApplicationData, aead.Seal(nil, nonce(iv, seq), plain, ad12(seq, len(plain))))
+		}
+	}
+
+	//tls 1.2 cbc, mac then encrypt or encrypt then mac (RFC 7366)
+	cbc12 := func(block cipher.Block, etm bool) func(seq uint64) []byte {
+		return func(seq uint64) []byte {
+			iv := make([]byte, block.BlockSize())
+			rand.Read(iv)
+			data := append([]byte{}, plain...)
+			if !etm {
+				mac := hmac.New(sha1.New, macKey)
+				mac.Write(ad12(seq, len(plain)))
+				mac.Write(plain)
+				data = mac.Sum(data)
+			}
+			pad := block.BlockSize() - len(data)%block.BlockSize()
+			for i := 0; i < pad; i++ {
+				data = append(data, byte(pad-1))
+			}
+			cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+			body := append(iv, data...)
+			if etm {
+				mac := hmac.New(sha1.New, macKey)
+				mac.Write(ad12(seq, len(body)))
+				mac.Write(body)
+				body = mac.Sum(body)
+			}
+			return record(tlsApplicationData, body)
+		}
+	}
+
+	gcm, _ := aesGCM(key16)
+	chacha, _ := chacha20poly1305.New(key32)
+	block, _ := aes.NewCipher(key16)
+	iv12 := unhex("5d 31 3e b2 67 12 76 ee 13 00 0b 30")
+
+	tests := []struct {
+		name    string
+		version uint16
+		suite   uint16
+		key     []byte
+		iv      []byte
+		etm     bool
+		seal    func(seq uint64) []byte
+	}{
+		{"tls 1.3 aes-gcm", tlsVersion13, 0x1301, key16, iv12, false, seal13(gcm, iv12)},
+		{"tls 1.3 chacha20", tlsVersion13, 0x1303, key32, iv12, false, seal13(chacha, iv12)},
+		{"tls 1.2 aes-gcm", tlsVersion12, 0xc02f, key16, iv12[:4], false, gcm12(gcm, iv12[:4])},
+		{"tls 1.2 chacha20", tlsVersion12, 0xcca8, key32, iv12, false, chacha12(chacha, iv12)},
+		{"tls 1.2 cbc", tlsVersion12, 0xc013, key16, nil, false, cbc12(block, false)},
+		{"tls 1.2 cbc encrypt then mac", tlsVersion12, 0xc013, key16, nil, true, cbc12(block, true)},
+	}
+
+	for _, tt := range tests {
+		c, err := newTLSCipher(tt.version, tlsSuites[tt.suite], tt.key, tt.iv)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		c.encryptThenMAC = tt.etm
+		for seq := uint64(0); seq < 3; seq++ {
+			typ, got, err := c.open(tt.seal(seq))
+			if err != nil || typ != tlsApplicationData || string(got) != string(plain) {
+				t.Errorf("%s, record %d: %d %q %v", tt.name, seq, typ, got, err)
+			}
+		}
+	}
+}
+
+//self-signed certificate of the test server
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+//bytes written by either side, in order
+type tlsCapture struct {
+	mu     sync.Mutex
+	writes []tlsWrite
+}
+
+type tlsWrite struct {
+	client bool
+	b      []byte
+}
+
+type captureConn struct {
+	net.Conn
+	capture *tlsCapture
+	client  bool
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	c.capture.mu.Lock()
+	c.capture.writes = append(c.capture.writes, tlsWrite{c.client, append([]byte{}, b...)})
+	c.capture.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+//a client sends "ping", the server answers "pong"
+func captureTLS(t *testing.T, client, server *tls.Config) *tlsCapture {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("no loopback:", err)
+	}
+	defer ln.Close()
+
+	capture := &tlsCapture{}
+	done := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		s := tls.Server(&captureConn{conn, capture, false}, server)
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(s, b); err != nil {
+			done <- err
+			return
+		}
+		_, err = s.Write([]byte("pong"))
+		done <- err
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := tls.Client(&captureConn{conn, capture, true}, client)
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return capture
+}
+
+//the capture read by the streams of both directions,
+//returns their plaintext and the reports of the connection
+func readTLS(capture *tlsCapture, keylog *KeyLog) (client, server string, reports []*event.Event) {
+
+	net := gopacket.NewFlow(layers.EndpointIPv4, []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2})
+	transport := gopacket.NewFlow(layers.EndpointTCPPort, []byte{0x13, 0x88}, []byte{0x0c, 0xea})
+	emit := event.EmitterFunc(func(e *event.Event) { reports = append(reports, e) })
+
+	conn := &tlsConn{}
+	streams := map[bool]*tlsStream{
+		true:  newTLSStream(net, transport, conn, keylog, emit),
+		false: newTLSStream(net.Reverse(), transport.Reverse(), conn, keylog, emit),
+	}
+	conn.encrypt(net, transport, time.Now())
+
+	plain := map[bool]string{}
+	for _, w := range capture.writes {
+		p, _ := streams[w.client].feed(w.b)
+		plain[w.client] += string(p)
+	}
+	conn.report(emit)
+	return plain[true], plain[false], reports
+}
+
+func TestTLSStream(t *testing.T) {
+
+	cert := testCertificate(t)
+	tests := []struct {
+		name    string
+		version uint16
+		suite   uint16
+		retry   bool
+	}{
+		{"tls 1.3", tls.VersionTLS13, 0, false},
+		{"tls 1.3 hello retry", tls.VersionTLS13, 0, true},
+		{"tls 1.2 aes-gcm", tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, false},
+		{"tls 1.2 chacha20", tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256, false},
+		{"tls 1.2 cbc", tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA, false},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "keylog")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client := &tls.Config{
+			InsecureSkipVerify: true,
+			KeyLogWriter:       f,
+			MinVersion:         tt.version,
+			MaxVersion:         tt.version,
+			CurvePreferences:   []tls.CurveID{tls.X25519, tls.CurveP256},
+		}
+		server := &tls.Config{
+			Certificates:           []tls.Certificate{cert},
+			SessionTicketsDisabled: true,
+			MaxVersion:             tt.version,
+		}
+		if tt.suite != 0 {
+			client.CipherSuites = []uint16{tt.suite}
+		}
+		if tt.retry {
+			//the key share of the client is not the one of the server
+			server.CurvePreferences = []tls.CurveID{tls.CurveP256}
+		}
+		capture := captureTLS(t, client, server)
+		f.Close()
+
+		keylog, err := LoadKeyLog(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, s, reports := readTLS(capture, keylog)
+		if c != "ping" || s != "pong" {
+			t.Errorf("%s: client %q server %q", tt.name, c, s)
+		}
+		if len(reports) != 1 || reports[0].Status != "decrypted" {
+			t.Errorf("%s: reports %v", tt.name, reports)
+		}
+
+		//without the secrets of the connection
+		os.WriteFile(path, nil, 0644)
+		keylog, _ = LoadKeyLog(path)
+		c, s, reports = readTLS(capture, keylog)
+		if c != "" || s != "" || len(reports) != 1 || reports[0].Status != "encrypted" {
+			t.Errorf("%s without keys: client %q server %q reports %v", tt.name, c, s, reports)
+		}
+	}
+}
+
+//body of a hello: version, random, session id, ciphers,
+//compression and the extensions of type and data
+func helloBody(client bool, random []byte, ciphers []uint16, ext ...[]byte) []byte {
+	b := []byte{3, 3}
+	b = append(b, random...)
+	b = append(b, 0)
+	if client {
+		b = binary.BigEndian.AppendUint16(b, uint16(2*len(ciphers)))
+		for _, c := range ciphers {
+			b = binary.BigEndian.AppendUint16(b, c)
+		}
+		b = append(b, 1, 0)
+	} else {
+		b = binary.BigEndian.AppendUint16(b, ciphers[0])
+		b = append(b, 0)
+	}
+	if len(ext) == 0 {
+		return b
+	}
+	var exts []byte
+	for _, e := range ext {
+		exts = append(exts, e...)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(exts)))
+	return append(b, exts...)
+}
+
+func extension(typ uint16, data ...byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+func TestParseHello(t *testing.T) {
+
+	random := make([]byte, 32)
+	random[0] = 1
+	sni := extension(extServerName, 0, 14, 0, 0, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm')
+	alpn := extension(extALPN, 0, 12, 2, 'h', '2', 8, 'h', 't', 't', 'p', '/', '1', '.', '1')
+
+	tests := []struct {
+		name    string
+		b       []byte
+		client  bool
+		want    TLSHello
+		version uint16
+		err     bool
+	}{
+		{"client", helloBody(true, random, []uint16{0x1301, 0xc02f}, sni, alpn, extension(extSupportedVersions, 4, 3, 4, 3, 3)), true, TLSHello{
+			Client:   true,
+			Version:  tlsVersion12,
+			Random:   random,
+			Ciphers:  []uint16{0x1301, 0xc02f},
+			SNI:      "example.com",
+			ALPN:     []string{"h2", "http/1.1"},
+			Versions: []uint16{tlsVersion13, tlsVersion12},
+		}, tlsVersion12, false},
+		{"server tls 1.3", helloBody(false, random, []uint16{0x1301}, extension(extSupportedVersions, 3, 4)), false, TLSHello{
+			Version:  tlsVersion12,
+			Random:   random,
+			Ciphers:  []uint16{0x1301},
+			Versions: []uint16{tlsVersion13},
+		}, tlsVersion13, false},
+		{"server encrypt then mac", helloBody(false, random, []uint16{0xc013}, extension(extEncryptThenMAC)), false, TLSHello{
+			Version:        tlsVersion12,
+			Random:         random,
+			Ciphers:        []uint16{0xc013},
+			EncryptThenMAC: true,
+		}, tlsVersion12, false},
+		{"no extensions", helloBody(false, random, []uint16{0xc02f}), false, TLSHello{
+			Version: tlsVersion12,
+			Random:  random,
+			Ciphers: []uint16{0xc02f},
+		}, tlsVersion12, false},
+		{"truncated extension", helloBody(true, random, []uint16{0x1301}, sni)[:45], true, TLSHello{}, 0, true},
+		{"truncated", random, true, TLSHello{}, 0, true},
+	}
+
+	for _, tt := range tests {
+		h, err := parseHello(tt.b, tt.client)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(*h, tt.want) || h.NegotiatedVersion() != tt.version {
+			t.Errorf("%s: %+v %v, want %+v", tt.name, h, err, tt.want)
+		}
+	}
+
+	retry, _ := parseHello(helloBody(false, helloRetryRandom, []uint16{0x1301}), false)
+	if !retry.IsHelloRetry() {
+		t.Errorf("HelloRetryRequest not recognized")
+	}
+}
+
+func TestIsTLSRecord(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		b     []byte
+		start bool
+		want  bool
+	}{
+		{"client hello", []byte{tlsHandshake, 3, 1, 0, 100, tlsClientHello, 0, 0, 96, 3, 3}, false, true},
+		{"server hello", []byte{tlsHandshake, 3, 3, 0, 100, tlsServerHello, 0, 0, 96, 3, 3}, false, true},
+		{"other handshake", []byte{tlsHandshake, 3, 3, 0, 100, 11, 0, 0, 96, 3, 3}, false, false},
+		{"application data at the start", []byte{tlsApplicationData, 3, 3, 0, 32}, true, true},
+		{"application data", []byte{tlsApplicationData, 3, 3, 0, 32}, false, false},
+		{"empty record", []byte{tlsApplicationData, 3, 3, 0, 0}, true, false},
+		{"http", []byte("GET / HTTP/1.1\r\n"), true, false},
+		{"ssl 2", []byte{0x80, 0x2e, 0x01, 0x00, 0x02}, true, false},
+	}
+
+	for _, tt := range tests {
+		if got := IsTLSRecord(tt.b, tt.start); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
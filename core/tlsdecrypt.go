@@ -0,0 +1,306 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"hash"
+)
+
+var errTLSNoKey = errors.New("no secret in the key log")
+
+//tlsSuite is what the record layer needs of a cipher suite,
+//aead is nil for cbc suites
+type tlsSuite struct {
+	key  int
+	iv   int
+	mac  int
+	hash func() hash.Hash
+	aead func(key []byte) (cipher.AEAD, error)
+}
+
+var tlsSuites = map[uint16]*tlsSuite{
+
+	//tls 1.3
+	0x1301: {16, 12, 0, sha256.New, aesGCM},
+	0x1302: {32, 12, 0, sha512.New384, aesGCM},
+	0x1303: {32, 12, 0, sha256.New, chacha20poly1305.New},
+
+	//tls 1.2 aead
+	0x009c: {16, 4, 0, sha256.New, aesGCM},
+	0x009d: {32, 4, 0, sha512.New384, aesGCM},
+	0x009e: {16, 4, 0, sha256.New, aesGCM},
+	0x009f: {32, 4, 0, sha512.New384, aesGCM},
+	0xc02b: {16, 4, 0, sha256.New, aesGCM},
+	0xc02c: {32, 4, 0, sha512.New384, aesGCM},
+	0xc02f: {16, 4, 0, sha256.New, aesGCM},
+	0xc030: {32, 4, 0, sha512.New384, aesGCM},
+	0xcca8: {32, 12, 0, sha256.New, chacha20poly1305.New},
+	0xcca9: {32, 12, 0, sha256.New, chacha20poly1305.New},
+	0xccaa: {32, 12, 0, sha256.New, chacha20poly1305.New},
+
+	//tls 1.2 cbc
+	0x002f: {16, 16, 20, sha256.New, nil},
+	0x0035: {32, 16, 20, sha256.New, nil},
+	0x003c: {16, 16, 32, sha256.New, nil},
+	0x003d: {32, 16, 32, sha256.New, nil},
+	0xc009: {16, 16, 20, sha256.New, nil},
+	0xc00a: {32, 16, 20, sha256.New, nil},
+	0xc013: {16, 16, 20, sha256.New, nil},
+	0xc014: {32, 16, 20, sha256.New, nil},
+	0xc023: {16, 16, 32, sha256.New, nil},
+	0xc024: {32, 16, 48, sha512.New384, nil},
+	0xc027: {16, 16, 32, sha256.New, nil},
+	0xc028: {32, 16, 48, sha512.New384, nil},
+}
+
+func aesGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//tls 1.2 keys, from the master secret at ChangeCipherSpec
+func (t *tlsStream) install12() error {
+
+	c, s := t.conn.hellos()
+	if c == nil || s == nil {
+		return errTLSHandshake
+	}
+	if v := s.NegotiatedVersion(); v != tlsVersion12 {
+		return fmt.Errorf("unsupported version %s", TLSVersionName(v))
+	}
+	suite, ok := tlsSuites[s.Ciphers[0]]
+	if !ok {
+		return fmt.Errorf("unsupported cipher suite 0x%04x", s.Ciphers[0])
+	}
+	master := t.keylog.Secret(c.Random, keyLogClientRandom)
+	if master == nil {
+		return errTLSNoKey
+	}
+
+	//client mac, server mac, client key, server key, client iv, server iv
+	seed := append(append([]byte{}, s.Random...), c.Random...)
+	block := prf12(suite.hash, master, "key expansion", seed, 2*(suite.mac+suite.key+suite.iv))
+	keys := block[2*suite.mac:]
+	ivs  := keys[2*suite.key:]
+	key, iv := keys[:suite.key], ivs[:suite.iv]
+	if !t.client {
+		key, iv = keys[suite.key:2*suite.key], ivs[suite.iv:2*suite.iv]
+	}
+
+	cp, err := newTLSCipher(tlsVersion12, suite, key, iv)
+	if err != nil {
+		return err
+	}
+	cp.encryptThenMAC = s.EncryptThenMAC
+	t.cipher = cp
+	return nil
+}
+
+//tls 1.3 keys, of the handshake or of the application
+func (t *tlsStream) install13() error {
+
+	c, s := t.conn.hellos()
+	if c == nil || s == nil {
+		return errTLSHandshake
+	}
+	if v := s.NegotiatedVersion(); v != tlsVersion13 {
+		return fmt.Errorf("unsupported version %s", TLSVersionName(v))
+	}
+	suite, ok := tlsSuites[s.Ciphers[0]]
+	if !ok {
+		return fmt.Errorf("unsupported cipher suite 0x%04x", s.Ciphers[0])
+	}
+
+	var label string
+	switch {
+	case t.client && t.application:
+		label = keyLogClientTraffic
+	case t.client:
+		label = keyLogClientHandshake
+	case t.application:
+		label = keyLogServerTraffic
+	default:
+		label = keyLogServerHandshake
+	}
+	secret := t.keylog.Secret(c.Random, label)
+	if secret == nil {
+		return errTLSNoKey
+	}
+
+	cp, err := newTLSCipher(tlsVersion13, suite, expandLabel(suite.hash, secret, "key", suite.key),
+		expandLabel(suite.hash, secret, "iv", suite.iv))
+	if err != nil {
+		return err
+	}
+	cp.secret = secret
+	t.cipher = cp
+	return nil
+}
+
+//tlsCipher opens the records of one direction
+type tlsCipher struct {
+	version uint16
+	suite   *tlsSuite
+	aead    cipher.AEAD
+	block   cipher.Block
+	iv      []byte
+	seq     uint64
+
+	//tls 1.3 traffic secret, for key updates
+	secret  []byte
+	encryptThenMAC bool
+}
+
+func newTLSCipher(version uint16, suite *tlsSuite, key, iv []byte) (*tlsCipher, error) {
+
+	c := &tlsCipher{
+		version: version,
+		suite:   suite,
+		iv:      iv,
+	}
+	var err error
+	if suite.aead != nil {
+		c.aead, err = suite.aead(key)
+	} else {
+		c.block, err = aes.NewCipher(key)
+	}
+	return c, err
+}
+
+//next traffic secret after a KeyUpdate
+func (c *tlsCipher) update() {
+	h := c.suite.hash
+	c.secret = expandLabel(h, c.secret, "traffic upd", h().Size())
+	key := expandLabel(h, c.secret, "key", c.suite.key)
+	c.iv = expandLabel(h, c.secret, "iv", c.suite.iv)
+	c.aead, _ = c.suite.aead(key)
+	c.seq = 0
+}
+
+//open a record, returns its content type and plaintext
+func (c *tlsCipher) open(rec []byte) (byte, []byte, error) {
+
+	typ, body := rec[0], rec[tlsRecordHeader:]
+	defer func() { c.seq++ }()
+
+	if c.version == tlsVersion13 {
+		//header as additional data, the content type
+		//follows the plaintext and zero padding
+		plain, err := c.aead.Open(nil, c.nonce(), body, rec[:tlsRecordHeader])
+		if err != nil {
+			return 0, nil, err
+		}
+		for i := len(plain) - 1; i >= 0; i-- {
+			if plain[i] != 0 {
+				return plain[i], plain[:i], nil
+			}
+		}
+		return 0, nil, errTLSRecord
+	}
+
+	if c.aead != nil {
+		var nonce []byte
+		if len(c.iv) == 4 {
+			//aes-gcm, explicit part of the nonce in the record
+			if len(body) < 8 {
+				return 0, nil, errTLSRecord
+			}
+			nonce = append(append([]byte{}, c.iv...), body[:8]...)
+			body  = body[8:]
+		} else {
+			nonce = c.nonce()
+		}
+		if len(body) < c.aead.Overhead() {
+			return 0, nil, errTLSRecord
+		}
+		plain, err := c.aead.Open(nil, nonce, body, c.additionalData(typ, len(body)-c.aead.Overhead()))
+		return typ, plain, err
+	}
+
+	//cbc, the mac is not checked
+	mac := c.suite.mac
+	if c.encryptThenMAC {
+		if len(body) < mac {
+			return 0, nil, errTLSRecord
+		}
+		body, mac = body[:len(body)-mac], 0
+	}
+	size := c.block.BlockSize()
+	if len(body) < 2*size || len(body)%size != 0 {
+		return 0, nil, errTLSRecord
+	}
+	plain := make([]byte, len(body)-size)
+	cipher.NewCBCDecrypter(c.block, body[:size]).CryptBlocks(plain, body[size:])
+	pad := int(plain[len(plain)-1]) + 1
+	if pad+mac > len(plain) {
+		return 0, nil, errTLSRecord
+	}
+	return typ, plain[:len(plain)-pad-mac], nil
+}
+
+//iv xor the sequence number
+func (c *tlsCipher) nonce() []byte {
+	nonce := append([]byte{}, c.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(c.seq >> (8 * uint(i)))
+	}
+	return nonce
+}
+
+//tls 1.2: seq(8), type(1), version(2), length(2)
+func (c *tlsCipher) additionalData(typ byte, length int) []byte {
+	ad := make([]byte, 13)
+	binary.BigEndian.PutUint64(ad, c.seq)
+	ad[8] = typ
+	binary.BigEndian.PutUint16(ad[9:], tlsVersion12)
+	binary.BigEndian.PutUint16(ad[11:], uint16(length))
+	return ad
+}
+
+//tls 1.2 P_hash
+func prf12(h func() hash.Hash, secret []byte, label string, seed []byte, n int) []byte {
+	seed = append([]byte(label), seed...)
+	mac := hmac.New(h, secret)
+	out := make([]byte, 0, n)
+	a := seed
+	for len(out) < n {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+	}
+	return out[:n]
+}
+
+//tls 1.3 HKDF-Expand-Label with an empty context
+func expandLabel(h func() hash.Hash, secret []byte, label string, n int) []byte {
+	label = "tls13 " + label
+	info := []byte{byte(n >> 8), byte(n), byte(len(label))}
+	info = append(info, label...)
+	info = append(info, 0)
+
+	mac := hmac.New(h, secret)
+	var out, block []byte
+	for i := byte(1); len(out) < n; i++ {
+		mac.Reset()
+		mac.Write(block)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		block = mac.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:n]
+}
@@ -1,19 +1,22 @@
 package build
 
 import (
+	"github.com/40t/go-sniffer/core/event"
 	"github.com/google/gopacket"
 	"io"
-	"log"
 	"strconv"
 	"fmt"
 	"os"
 	"bufio"
 	"net/http"
+	"sync"
+	"time"
 )
 
 const (
 	Port       = 80
 	Version    = "0.1"
+	Protocol   = "http"
 )
 
 const (
@@ -23,6 +26,49 @@ const (
 type H struct {
 	port       int
 	version    string
+	source     map[string]*stream
+	mu         sync.Mutex
+}
+
+//stream is a keep-alive connection, the requests wait
+//for their response in the order they were sent
+type stream struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	pending    []*exchange
+	flows      int
+
+	//no more requests, the client side is closed
+	closed     bool
+
+	//the client side waits for its next bytes, all
+	//it was given up to now is parsed
+	idle       bool
+
+	//101 Switching Protocols, the rest is not http
+	upgraded   bool
+}
+
+//reader of the side of the client, the responses wait
+//for it to be idle before they are read without request
+type requestReader struct {
+	stm        *stream
+	r          io.Reader
+}
+
+func (rr *requestReader) Read(p []byte) (int, error) {
+	rr.stm.wait(true)
+	n, err := rr.r.Read(p)
+	rr.stm.wait(false)
+	return n, err
+}
+
+type exchange struct {
+	req        *http.Request
+	event      *event.Event
+
+	//capture time of the last byte of the request
+	sent       time.Time
 }
 
 var hp *H
@@ -32,20 +78,73 @@ func NewInstance() *H {
 		hp = &H{
 			port   :Port,
 			version:Version,
+			source :make(map[string]*stream),
 		}
 	}
 	return hp
 }
 
-func (m *H) ResolveStream(net, transport gopacket.Flow, buf io.Reader) {
+func (m *H) ResolveStream(net, transport gopacket.Flow, buf io.Reader, emit event.Emitter) {
+
+	//uuid
+	uuid := fmt.Sprintf("%v:%v", net.FastHash(), transport.FastHash())
+
+	m.mu.Lock()
+	stm, ok := m.source[uuid]
+	if !ok {
+		stm = &stream{}
+		stm.cond = sync.NewCond(&stm.mu)
+		m.source[uuid] = stm
+	}
+	stm.mu.Lock()
+	stm.flows++
+	stm.mu.Unlock()
+	m.mu.Unlock()
+
+	//server -> client || client -> server
+	if transport.Src().String() == strconv.Itoa(m.port) {
+		m.resolveResponses(stm, net, transport, bufio.NewReader(buf), buf, emit)
+	} else {
+		m.resolveRequests(stm, net, transport, bufio.NewReader(&requestReader{stm, buf}), buf)
+	}
+
+	//both directions closed, requests without response
+	m.mu.Lock()
+	stm.mu.Lock()
+	stm.flows--
+	flows := stm.flows
+	stm.mu.Unlock()
+	if flows > 0 {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.source, uuid)
+	m.mu.Unlock()
+
+	for _, x := range stm.pending {
+		emit.Emit(x.event)
+	}
+	stm.pending = nil
+}
+
+func (m *H) resolveRequests(stm *stream, net, transport gopacket.Flow, bio *bufio.Reader, buf io.Reader) {
 
-	bio := bufio.NewReader(buf)
+	defer stm.close()
 	for {
+		if _, err := bio.Peek(1); err != nil {
+			return
+		}
+		start := event.Seen(buf)
+
 		req, err := http.ReadRequest(bio)
 
-		if err == io.EOF {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			return
 		} else if err != nil {
+			if stm.isUpgraded() {
+				io.Copy(io.Discard, bio)
+				return
+			}
 			continue
 		} else {
 
@@ -58,11 +157,173 @@ func (m *H) ResolveStream(net, transport gopacket.Flow, buf io.Reader) {
 			msg += req.Form.Encode()
 			msg += "]"
 
-			log.Println(msg)
-
+			io.Copy(io.Discard, req.Body)
 			req.Body.Close()
+
+			e := event.New(Protocol, net, transport, m.port)
+			e.Time      = start
+			e.Operation = req.Method
+			e.Statement = req.Host + req.URL.String()
+			if req.ContentLength > 0 {
+				e.Bytes = int(req.ContentLength)
+			}
+			e.Set("form", req.Form.Encode())
+			e.Text = GetNowStr(e.Time) + msg
+
+			stm.push(&exchange{
+				req:   req,
+				event: e,
+				sent:  event.Seen(buf),
+			})
+		}
+	}
+}
+
+//responses are read against their request, the body
+//of a HEAD or a 304 is not sent whatever the headers say
+func (m *H) resolveResponses(stm *stream, net, transport gopacket.Flow, bio *bufio.Reader, buf io.Reader, emit event.Emitter) {
+
+	for {
+		if _, err := bio.Peek(1); err != nil {
+			return
+		}
+		first := event.Seen(buf)
+
+		//the request was not captured, the response is reported alone
+		x := stm.front(first)
+		matched := x != nil
+		if !matched {
+			e := event.New(Protocol, net, transport, m.port)
+			e.Time      = first
+			e.Operation = "Response"
+			e.Text      = GetNowStr(first) + "[Response]"
+			x = &exchange{event: e}
+		}
+		resp, err := http.ReadResponse(bio, x.req)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return
+		} else if err != nil {
+			continue
+		}
+		size, _ := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		//100 Continue and the like, the final response follows
+		if resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			continue
 		}
+		if matched {
+			stm.pop()
+		}
+		emit.Emit(completeExchange(x, resp, size, first, event.Seen(buf)))
+
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			stm.upgrade()
+			io.Copy(io.Discard, bio)
+			return
+		}
+	}
+}
+
+//attach the response to the request of x
+func completeExchange(x *exchange, resp *http.Response, size int64, first, last time.Time) *event.Event {
+
+	contentType   := resp.Header.Get("Content-Type")
+	contentLength := resp.ContentLength
+	if contentLength < 0 {
+		contentLength = size
+	}
+
+	e := x.event
+	e.Status = strconv.Itoa(resp.StatusCode)
+	if resp.StatusCode >= 400 {
+		e.Error = resp.Status
+	}
+	e.Set("status_code", resp.StatusCode).
+		Set("content_type", contentType).
+		Set("content_length", contentLength)
+
+	//time to first byte from the end of the request,
+	//total time from its start to the end of the response
+	if x.req != nil {
+		ttfb := first.Sub(x.sent)
+		if ttfb < 0 {
+			ttfb = 0
+		}
+		e.Latency = last.Sub(e.Time)
+		e.Set("ttfb_ms", float64(ttfb) / float64(time.Millisecond))
+		e.Text += fmt.Sprintf(" => [%s] [%s] Size:%d TTFB:%.3fms Time:%.3fms", resp.Status, contentType, contentLength,
+			float64(ttfb) / float64(time.Millisecond), float64(e.Latency) / float64(time.Millisecond))
+	} else {
+		e.Text += fmt.Sprintf(" => [%s] [%s] Size:%d", resp.Status, contentType, contentLength)
+	}
+	return e
+}
+
+func (stm *stream) push(x *exchange) {
+	stm.mu.Lock()
+	stm.pending = append(stm.pending, x)
+	stm.mu.Unlock()
+	stm.cond.Broadcast()
+}
+
+//request of a response starting at first, sent before it in
+//capture time. The bytes of the client captured before first are
+//already handed over, it waits for them to be parsed: the side of
+//the client pushes a request, waits for more bytes or is closed.
+//Nil if the request was not captured
+func (stm *stream) front(first time.Time) *exchange {
+
+	stm.mu.Lock()
+	defer stm.mu.Unlock()
+
+	//only the server side of the connection was captured
+	if stm.flows == 1 && !stm.closed {
+		return nil
+	}
+	for len(stm.pending) == 0 && !stm.closed && !stm.idle {
+		stm.cond.Wait()
 	}
+	if len(stm.pending) == 0 || stm.pending[0].event.Time.After(first) {
+		return nil
+	}
+	return stm.pending[0]
+}
+
+//the side of the client is idle while it waits for bytes
+func (stm *stream) wait(idle bool) {
+	stm.mu.Lock()
+	stm.idle = idle
+	stm.mu.Unlock()
+	if idle {
+		stm.cond.Broadcast()
+	}
+}
+
+func (stm *stream) pop() {
+	stm.mu.Lock()
+	stm.pending[0] = nil
+	stm.pending = stm.pending[1:]
+	stm.mu.Unlock()
+}
+
+func (stm *stream) close() {
+	stm.mu.Lock()
+	stm.closed = true
+	stm.mu.Unlock()
+	stm.cond.Broadcast()
+}
+
+func (stm *stream) upgrade() {
+	stm.mu.Lock()
+	stm.upgraded = true
+	stm.mu.Unlock()
+}
+
+func (stm *stream) isUpgraded() bool {
+	stm.mu.Lock()
+	defer stm.mu.Unlock()
+	return stm.upgraded
 }
 
 func (m *H) BPFFilter() string {
@@ -103,4 +364,9 @@ func (m *H) SetFlag(flg []string)  {
 			panic("ERR : mysql's params")
 		}
 	}
-}
\ No newline at end of file
+}
+
+//same layout as the standard logger, but with capture time
+func GetNowStr(t time.Time) string {
+	return t.Format("2006/01/02 15:04:05") + " "
+}
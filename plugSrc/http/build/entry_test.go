@@ -0,0 +1,182 @@
+package build
+
+import (
+	"github.com/40t/go-sniffer/core/event"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+//one direction of a connection, bytes are handed over as the
+//assembler does: a send returns once the reader asks for more
+type flow struct {
+	chunks  chan chunk
+	done    chan bool
+	current []byte
+	started bool
+	ended   bool
+	mu      sync.Mutex
+	seen    time.Time
+}
+
+type chunk struct {
+	b    []byte
+	seen time.Time
+}
+
+func newFlow() *flow {
+	return &flow{chunks: make(chan chunk), done: make(chan bool)}
+}
+
+func (f *flow) Read(p []byte) (int, error) {
+	for len(f.current) == 0 {
+		if f.ended {
+			return 0, io.EOF
+		}
+		if f.started {
+			f.done <- true
+		}
+		f.started = true
+		c, ok := <-f.chunks
+		if !ok {
+			f.ended = true
+			return 0, io.EOF
+		}
+		f.mu.Lock()
+		f.seen = c.seen
+		f.mu.Unlock()
+		f.current = c.b
+	}
+	n := copy(p, f.current)
+	f.current = f.current[n:]
+	return n, nil
+}
+
+func (f *flow) Seen() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.seen
+}
+
+func (f *flow) send(seen time.Time, b string) {
+	f.chunks <- chunk{[]byte(b), seen}
+	<-f.done
+}
+
+//the connection 10.0.0.1:5000 -> 10.0.0.2:80, steps are "C" or "S"
+//followed by the bytes of that direction, a millisecond apart
+func replay(t *testing.T, client bool, steps ...string) []*event.Event {
+	t.Helper()
+
+	var mu sync.Mutex
+	var events []*event.Event
+	emit := event.EmitterFunc(func(e *event.Event) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	})
+
+	h := NewInstance()
+	net := gopacket.NewFlow(layers.EndpointIPv4, []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2})
+	transport := gopacket.NewFlow(layers.EndpointTCPPort, []byte{0x13, 0x88}, []byte{0, 80})
+
+	server := newFlow()
+	flows := map[byte]*flow{'S': server}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h.ResolveStream(net.Reverse(), transport.Reverse(), server, emit)
+	}()
+	if client {
+		c := newFlow()
+		flows['C'] = c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ResolveStream(net, transport, c, emit)
+		}()
+	}
+
+	//both directions are open before the first bytes
+	for deadline := time.Now().Add(time.Second); ; {
+		h.mu.Lock()
+		n := 0
+		for _, stm := range h.source {
+			stm.mu.Lock()
+			n = stm.flows
+			stm.mu.Unlock()
+		}
+		h.mu.Unlock()
+		if n == len(flows) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("streams not started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	seen := time.Date(2026, 10, 18, 15, 4, 5, 0, time.UTC)
+	for i, step := range steps {
+		flows[step[0]].send(seen.Add(time.Duration(i)*time.Millisecond), step[1:])
+	}
+	for _, f := range flows {
+		close(f.chunks)
+	}
+	wg.Wait()
+	return events
+}
+
+func TestExchanges(t *testing.T) {
+
+	get := "GET /a?x=1 HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	ok := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 2\r\n\r\nok"
+	missing := "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"
+
+	type want struct {
+		operation string
+		status    string
+		latency   time.Duration
+	}
+	tests := []struct {
+		name   string
+		client bool
+		steps  []string
+		want   []want
+	}{
+		{"exchange", true, []string{"C" + get, "S" + ok},
+			[]want{{"GET", "200", time.Millisecond}}},
+		{"pipelined", true, []string{"C" + get + get, "S" + ok, "S" + missing},
+			[]want{{"GET", "200", time.Millisecond}, {"GET", "404", 2 * time.Millisecond}}},
+		{"head", true, []string{"CHEAD / HTTP/1.1\r\nHost: example.com\r\n\r\n", "S" + ok[:len(ok)-2], "S" + missing},
+			[]want{{"HEAD", "200", time.Millisecond}, {"Response", "404", 0}}},
+		{"server side only", false, []string{"S" + ok},
+			[]want{{"Response", "200", 0}}},
+		{"request after the response", true, []string{"S" + ok, "C" + get},
+			[]want{{"Response", "200", 0}, {"GET", "", 0}}},
+		{"request without response", true, []string{"C" + get},
+			[]want{{"GET", "", 0}}},
+	}
+
+	for _, tt := range tests {
+		events := replay(t, tt.client, tt.steps...)
+		var got []want
+		for _, e := range events {
+			got = append(got, want{e.Operation, e.Status, e.Latency})
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
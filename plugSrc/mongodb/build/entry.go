@@ -4,25 +4,37 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"github.com/40t/go-sniffer/core/event"
 	"github.com/google/gopacket"
 	"io"
+	"os"
 	"strconv"
+	"sync"
+	"time"
 )
 
 const (
 	Port = 27017
 	Version = "0.1"
 	CmdPort = "-p"
+	Protocol = "mongodb"
 )
 
 type Mongodb struct {
 	port    int
 	version string
 	source  map[string]*stream
+	mu      sync.Mutex
 }
 
 type stream struct {
 	packets chan *packet
+	flows   int
+	done    chan bool
+
+	emit    event.Emitter
+	client  string
+	server  string
 }
 
 type packet struct {
@@ -35,6 +47,7 @@ type packet struct {
 	opCode        int 	 //request type
 
 	payload       io.Reader
+	seen          time.Time
 }
 
 var mongodbInstance *Mongodb
@@ -87,21 +100,28 @@ func (m *Mongodb) Version() string {
 	return m.version
 }
 
-func (m *Mongodb) ResolveStream(net, transport gopacket.Flow, buf io.Reader) {
+func (m *Mongodb) ResolveStream(net, transport gopacket.Flow, buf io.Reader, emit event.Emitter) {
 
 	//uuid
 	uuid := fmt.Sprintf("%v:%v", net.FastHash(), transport.FastHash())
 
 	//resolve packet
-	if _, ok := m.source[uuid]; !ok {
+	m.mu.Lock()
+	stm, ok := m.source[uuid]
+	if !ok {
 
-		var newStream = stream {
+		stm = &stream {
 			packets:make(chan *packet, 100),
+			done:   make(chan bool),
+			emit:   emit,
 		}
+		stm.client, stm.server = event.Endpoints(net, transport, m.port)
 
-		m.source[uuid] = &newStream
-		go newStream.resolve()
+		m.source[uuid] = stm
+		go stm.resolve()
 	}
+	stm.flows++
+	m.mu.Unlock()
 
 	//read bi-directional packet
 	//server -> client || client -> server
@@ -109,11 +129,24 @@ func (m *Mongodb) ResolveStream(net, transport gopacket.Flow, buf io.Reader) {
 
 		newPacket := m.newPacket(net, transport, buf)
 		if newPacket == nil {
-			return
+			break
 		}
 
-		m.source[uuid].packets <- newPacket
+		stm.packets <- newPacket
 	}
+
+	//both directions closed, wait for pending packets
+	m.mu.Lock()
+	stm.flows--
+	if stm.flows > 0 {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.source, uuid)
+	m.mu.Unlock()
+
+	close(stm.packets)
+	<-stm.done
 }
 
 func (m *Mongodb) newPacket(net, transport gopacket.Flow, r io.Reader) *packet {
@@ -125,13 +158,15 @@ func (m *Mongodb) newPacket(net, transport gopacket.Flow, r io.Reader) *packet {
 
 	//stream close
 	if err == io.EOF {
-		fmt.Println(net, transport, " close")
+		fmt.Fprintln(os.Stderr, net, transport, " close")
 		return nil
 	} else if err != nil {
-		fmt.Println("ERR : Unknown stream", net, transport, ":", err)
+		fmt.Fprintln(os.Stderr, "ERR : Unknown stream", net, transport, ":", err)
 		return nil
 	}
 
+	packet.seen = event.Seen(r)
+
 	//set flow direction
 	if transport.Src().String() == strconv.Itoa(m.port) {
 		packet.isClientFlow = false
@@ -143,16 +178,14 @@ func (m *Mongodb) newPacket(net, transport gopacket.Flow, r io.Reader) *packet {
 }
 
 func (stm *stream) resolve() {
-	for {
-		select {
-		case packet := <- stm.packets:
-			if packet.isClientFlow {
-				stm.resolveClientPacket(packet)
-			} else {
-				stm.resolveServerPacket(packet)
-			}
+	for packet := range stm.packets {
+		if packet.isClientFlow {
+			stm.resolveClientPacket(packet)
+		} else {
+			stm.resolveServerPacket(packet)
 		}
 	}
+	close(stm.done)
 }
 
 func (stm *stream) resolveServerPacket(pk *packet) {
@@ -162,6 +195,7 @@ func (stm *stream) resolveServerPacket(pk *packet) {
 func (stm *stream) resolveClientPacket(pk *packet) {
 
 	var msg string
+	e := stm.newEvent(pk)
 	switch pk.opCode {
 
 	case OP_UPDATE:
@@ -178,6 +212,9 @@ func (stm *stream) resolveClientPacket(pk *packet) {
 			selector,
 			update,
 		)
+		e.Operation = "Update"
+		e.Statement = fullCollectionName
+		e.Set("selector", RawJson(selector)).Set("update", RawJson(update))
 
 	case OP_INSERT:
 		flags              := ReadInt32(pk.payload)
@@ -189,6 +226,9 @@ func (stm *stream) resolveClientPacket(pk *packet) {
 			fullCollectionName,
 			command,
 		)
+		e.Operation = "Insert"
+		e.Statement = fullCollectionName
+		e.Set("document", RawJson(command))
 
 	case OP_QUERY:
 		flags              := ReadInt32(pk.payload)
@@ -207,6 +247,9 @@ func (stm *stream) resolveClientPacket(pk *packet) {
 			command,
 			selector,
 		)
+		e.Operation = "Query"
+		e.Statement = fullCollectionName
+		e.Set("query", RawJson(command)).Set("selector", RawJson(selector))
 
 	case OP_COMMAND:
 		database           := ReadString(pk.payload)
@@ -222,6 +265,9 @@ func (stm *stream) resolveClientPacket(pk *packet) {
 			commandArgs,
 			inputDocs,
 		)
+		e.Operation = "Command"
+		e.Statement = database + " " + commandName
+		e.Set("metadata", RawJson(metaData)).Set("args", RawJson(commandArgs)).Set("documents", RawJson(inputDocs))
 
 	case OP_GET_MORE:
 		zero               := ReadInt32(pk.payload)
@@ -235,6 +281,9 @@ func (stm *stream) resolveClientPacket(pk *packet) {
 			numberToReturn,
 			cursorId,
 		)
+		e.Operation = "Query more"
+		e.Statement = fullCollectionName
+		e.Set("number_to_return", numberToReturn).Set("cursor", cursorId)
 
 	case OP_DELETE:
 		zero               := ReadInt32(pk.payload)
@@ -248,6 +297,9 @@ func (stm *stream) resolveClientPacket(pk *packet) {
 			fullCollectionName,
 			selector,
 		)
+		e.Operation = "Delete"
+		e.Statement = fullCollectionName
+		e.Set("selector", RawJson(selector))
 
 	case OP_MSG:
 		return
@@ -255,7 +307,25 @@ func (stm *stream) resolveClientPacket(pk *packet) {
 		return
 	}
 
-	fmt.Println(GetNowStr(true) + msg)
+	e.Text = GetNowStr(true, pk.seen) + msg
+	stm.emit.Emit(e)
+}
+
+func (stm *stream) newEvent(pk *packet) *event.Event {
+
+	e := &event.Event{
+		Time:     pk.seen,
+		Client:   stm.client,
+		Server:   stm.server,
+		Protocol: Protocol,
+		Bytes:    pk.messageLength + 16,
+	}
+	if pk.isClientFlow {
+		e.Direction = event.Request
+	} else {
+		e.Direction = event.Response
+	}
+	return e
 }
 
 func readStream(r io.Reader) (*packet, error) {
@@ -0,0 +1,115 @@
+package build
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/40t/go-sniffer/core/event"
+	"github.com/40t/go-sniffer/plugSrc/mongodb/build/bson"
+	"testing"
+	"time"
+)
+
+//a message of the wire protocol: header, then the fields of opCode
+func message(opCode int32, fields ...interface{}) []byte {
+	var body bytes.Buffer
+	for _, f := range fields {
+		switch f := f.(type) {
+		case int32:
+			binary.Write(&body, binary.LittleEndian, f)
+		case int64:
+			binary.Write(&body, binary.LittleEndian, f)
+		case string:
+			body.WriteString(f)
+			body.WriteByte(0)
+		case bson.M:
+			doc, err := bson.Marshal(f)
+			if err != nil {
+				panic(err)
+			}
+			body.Write(doc)
+		}
+	}
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[0:], uint32(16+body.Len()))
+	binary.LittleEndian.PutUint32(header[4:], 1)
+	binary.LittleEndian.PutUint32(header[12:], uint32(opCode))
+	return append(header, body.Bytes()...)
+}
+
+func TestReadStream(t *testing.T) {
+
+	query := message(OP_QUERY, int32(0), "shop.orders", int32(0), int32(1), bson.M{"id": 1})
+	r := bytes.NewReader(append(append(query, message(OP_MSG)...), query[:20]...))
+
+	p, err := readStream(r)
+	if err != nil || p.opCode != OP_QUERY || p.messageLength != len(query)-16 || p.payload.(*bytes.Reader).Len() != len(query)-16 {
+		t.Fatalf("query: %+v %v", p, err)
+	}
+	p, err = readStream(r)
+	if err != nil || p.opCode != OP_MSG || p.messageLength != 0 {
+		t.Fatalf("empty message: %+v %v", p, err)
+	}
+
+	//a cut message is read as far as it goes
+	p, err = readStream(r)
+	if err != nil || p.payload.(*bytes.Reader).Len() != 4 {
+		t.Errorf("cut message: %+v %v", p, err)
+	}
+}
+
+func TestResolveClientPacket(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		msg       []byte
+		operation string
+		statement string
+		attrs     map[string]string
+	}{
+		{"query", message(OP_QUERY, int32(0), "shop.orders", int32(0), int32(1), bson.M{"status": "new"}),
+			"Query", "shop.orders", map[string]string{"query": `{"status":"new"}`, "selector": ""}},
+		{"query with projection", message(OP_QUERY, int32(0), "shop.orders", int32(0), int32(1), bson.M{"id": 1}, bson.M{"total": 1}),
+			"Query", "shop.orders", map[string]string{"query": `{"id":1}`, "selector": `{"total":1}`}},
+		{"insert", message(OP_INSERT, int32(0), "shop.orders", bson.M{"id": 2}),
+			"Insert", "shop.orders", map[string]string{"document": `{"id":2}`}},
+		{"update", message(OP_UPDATE, int32(0), "shop.orders", int32(0), bson.M{"id": 2}, bson.M{"$set": bson.M{"total": 3}}),
+			"Update", "shop.orders", map[string]string{"selector": `{"id":2}`, "update": `{"$set":{"total":3}}`}},
+		{"delete", message(OP_DELETE, int32(0), "shop.orders", int32(0), bson.M{"id": 2}),
+			"Delete", "shop.orders", map[string]string{"selector": `{"id":2}`}},
+		{"get more", message(OP_GET_MORE, int32(0), "shop.orders", int32(10), int64(77)),
+			"Query more", "shop.orders", nil},
+		{"msg", message(OP_MSG, int32(0)), "", "", nil},
+	}
+
+	for _, tt := range tests {
+		var events []*event.Event
+		stm := &stream{emit: event.EmitterFunc(func(e *event.Event) { events = append(events, e) })}
+		p, err := readStream(bytes.NewReader(tt.msg))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		p.isClientFlow = true
+		p.seen = time.Date(2026, 10, 18, 15, 4, 5, 0, time.UTC)
+		stm.resolveClientPacket(p)
+
+		if tt.operation == "" {
+			if len(events) != 0 {
+				t.Errorf("%s: %d events", tt.name, len(events))
+			}
+			continue
+		}
+		if len(events) != 1 {
+			t.Fatalf("%s: %d events", tt.name, len(events))
+		}
+		e := events[0]
+		if e.Operation != tt.operation || e.Statement != tt.statement || e.Bytes != len(tt.msg) {
+			t.Errorf("%s: %s %s %d bytes", tt.name, e.Operation, e.Statement, e.Bytes)
+		}
+		for k, want := range tt.attrs {
+			if got := fmt.Sprintf("%s", e.Attrs[k]); got != want {
+				t.Errorf("%s: %s = %s, want %s", tt.name, k, got, want)
+			}
+		}
+	}
+}
@@ -9,10 +9,10 @@ import (
 	"github.com/40t/go-sniffer/plugSrc/mongodb/build/bson"
 )
 
-func GetNowStr(isClient bool) string {
+func GetNowStr(isClient bool, t time.Time) string {
 	var msg string
 	layout := "01/02 15:04:05.000000"
-	msg += time.Now().Format(layout)
+	msg += t.Format(layout)
 	if isClient {
 		msg += "| cli -> ser |"
 	}else{
@@ -84,3 +84,10 @@ func ReadBson2Json(r io.Reader) (string) {
 	return string(jsonStr)
 }
 
+//keep documents as objects in json output
+func RawJson(s string) interface{} {
+	if json.Valid([]byte(s)) {
+		return json.RawMessage(s)
+	}
+	return s
+}
@@ -0,0 +1,61 @@
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/40t/go-sniffer/plugSrc/mongodb/build/bson"
+	"testing"
+)
+
+func marshal(doc interface{}) []byte {
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestReadString(t *testing.T) {
+
+	r := bytes.NewReader([]byte("shop.orders\x00\x00rest"))
+	if s := ReadString(r); s != "shop.orders" {
+		t.Errorf("first string %q", s)
+	}
+	if s := ReadString(r); s != "" {
+		t.Errorf("empty string %q", s)
+	}
+	if r.Len() != 4 {
+		t.Errorf("%d bytes left", r.Len())
+	}
+}
+
+func TestReadBson2Json(t *testing.T) {
+
+	tests := []struct {
+		name string
+		doc  []byte
+		want string
+	}{
+		{"document", marshal(bson.D{{Name: "name", Value: "app"}, {Name: "n", Value: 1}}), `{"n":1,"name":"app"}`},
+		{"nested", marshal(bson.M{"a": bson.M{"ok": true}, "list": []int{1, 2}}), `{"a":{"ok":true},"list":[1,2]}`},
+		{"empty", []byte("\x05\x00\x00\x00\x00"), `{}`},
+		{"end of message", nil, ""},
+	}
+
+	for _, tt := range tests {
+		if got := ReadBson2Json(bytes.NewReader(tt.doc)); got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRawJson(t *testing.T) {
+
+	//documents are kept as objects, anything else as a string
+	if v, ok := RawJson(`{"a":1}`).(json.RawMessage); !ok || string(v) != `{"a":1}` {
+		t.Errorf("document %#v", RawJson(`{"a":1}`))
+	}
+	if s, ok := RawJson("").(string); !ok || s != "" {
+		t.Errorf("empty document %#v", RawJson(""))
+	}
+}
@@ -0,0 +1,477 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/40t/go-sniffer/core/event"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-audit, format of the records
+const (
+	AuditPercona    = "percona"
+	AuditEnterprise = "enterprise"
+)
+
+//Audit turns the events of the streams into an audit log: a record
+//when a session connects, one per statement with its result and one
+//when it disconnects, with the duration and totals of the session.
+//Records are JSON lines in the layout of the Percona audit log plugin
+//(audit_log_format=JSON) or of MySQL Enterprise Audit (JSON format)
+type Audit struct {
+	mu       sync.Mutex
+	format   string
+	out      event.Emitter
+
+	//record id, and time of the first record
+	id       int
+	start    time.Time
+	sessions map[string]*auditSession
+}
+
+//a connection, by client address
+type auditSession struct {
+	connected    time.Time
+	statements   int
+	errors       int
+	rowsSent     int64
+	rowsAffected int64
+	attrs        map[string]string
+
+	//last record, the session is closed at its time
+	//if the capture ends before the connection
+	last         *event.Event
+}
+
+func NewAudit(format string) *Audit {
+	return &Audit{
+		format:   format,
+		sessions: make(map[string]*auditSession),
+	}
+}
+
+//write the records to out
+func (a *Audit) SetOutput(out event.Emitter) {
+	a.mu.Lock()
+	a.out = out
+	a.mu.Unlock()
+}
+
+//record the requests of the streams, and their end
+func (a *Audit) Emit(e *event.Event) {
+
+	if e.Direction != event.Request && e.Operation != "Disconnect" {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.sessions[e.Client]
+	if !ok {
+		//joined after the handshake
+		s = &auditSession{connected: e.Time}
+		a.sessions[e.Client] = s
+	}
+
+	s.last = e
+
+	switch e.Operation {
+	case "Login":
+		s.connected = e.Time
+		if attrs, ok := e.Attrs["connect_attrs"].(map[string]string); ok {
+			s.attrs = attrs
+		}
+		a.write(e, s, "Connect")
+	case "Disconnect":
+		delete(a.sessions, e.Client)
+		a.write(e, s, "Quit")
+	case "Quit", "Ping", "Statistics", "Fetch":
+		//not statements, the quit is recorded on disconnect
+	default:
+		s.statements++
+		if e.Status == "ERR" {
+			s.errors++
+		}
+		if rows, ok := e.Attrs["rows"].(int); ok {
+			s.rowsSent += int64(rows)
+		}
+		if rows, ok := e.Attrs["affected_rows"].(int); ok {
+			s.rowsAffected += int64(rows)
+		}
+		a.write(e, s, "")
+	}
+}
+
+//Close writes the Quit of the sessions still open, in the
+//order of their last record, when the capture ends
+func (a *Audit) Close() {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	sessions := make([]*auditSession, 0, len(a.sessions))
+	for _, s := range a.sessions {
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].last.Time.Before(sessions[j].last.Time) })
+
+	for _, s := range sessions {
+		e := &event.Event{
+			Time:      s.last.Time,
+			Client:    s.last.Client,
+			Server:    s.last.Server,
+			Protocol:  Protocol,
+			Direction: event.Response,
+			Operation: "Disconnect",
+			Attrs:     s.last.Attrs,
+		}
+		a.write(e, s, "Quit")
+	}
+	a.sessions = make(map[string]*auditSession)
+}
+
+//write the record of e, name is the record of connections,
+//empty for statements
+func (a *Audit) write(e *event.Event, s *auditSession, name string) {
+
+	if a.out == nil {
+		return
+	}
+	if a.start.IsZero() {
+		a.start = e.Time
+	}
+	a.id++
+
+	var record interface{}
+	if a.format == AuditEnterprise {
+		record = a.enterpriseRecord(e, s, name)
+	} else {
+		record = a.perconaRecord(e, s, name)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Println("ERR : Audit record", err)
+		return
+	}
+
+	r := &event.Event{
+		Time:      e.Time,
+		Client:    e.Client,
+		Server:    e.Server,
+		Protocol:  Protocol,
+		Direction: e.Direction,
+		Operation: "Audit",
+		Statement: name,
+		Status:    e.Status,
+		Latency:   e.Latency,
+		Error:     e.Error,
+		Text:      string(line),
+	}
+	if name == "" {
+		r.Statement = auditStatement(e)
+	}
+	r.Set("record", record)
+	a.out.Emit(r)
+}
+
+//fields of the audit records, from the attributes of the stream events
+func attrString(e *event.Event, key string) string {
+	s, _ := e.Attrs[key].(string)
+	return s
+}
+
+func attrUint32(e *event.Event, key string) uint32 {
+	v, _ := e.Attrs[key].(uint32)
+	return v
+}
+
+//0, or the error code of the server
+func auditStatus(e *event.Event) int {
+	if e.Status != "ERR" {
+		return 0
+	}
+	if code, ok := e.Attrs["error_code"].(int); ok {
+		return code
+	}
+	return 1
+}
+
+//the sql of executes if printed with -stmt sql
+func auditStatement(e *event.Event) string {
+	if sql := attrString(e, "sql"); sql != "" {
+		return sql
+	}
+	return e.Statement
+}
+
+//ip of ip:port, [ipv6]:port
+func clientIP(addr string) string {
+	if i := strings.LastIndexByte(addr, ':'); i >= 0 {
+		addr = addr[:i]
+	}
+	return strings.Trim(addr, "[]")
+}
+
+func (s *auditSession) duration(now time.Time) float64 {
+	return ms(now.Sub(s.connected))
+}
+
+//percona audit_log_format=JSON
+type perconaConnection struct {
+	Name         string  `json:"name"`
+	Record       string  `json:"record"`
+	Timestamp    string  `json:"timestamp"`
+	ConnectionID string  `json:"connection_id"`
+	Status       int     `json:"status"`
+	User         string  `json:"user"`
+	PrivUser     string  `json:"priv_user"`
+	OSLogin      string  `json:"os_login"`
+	ProxyUser    string  `json:"proxy_user"`
+	Host         string  `json:"host"`
+	IP           string  `json:"ip"`
+	DB           string  `json:"db"`
+
+	//not in the plugin's records
+	Program      string  `json:"program,omitempty"`
+	DurationMs   float64 `json:"duration_ms,omitempty"`
+	Statements   *int    `json:"statements,omitempty"`
+	Errors       *int    `json:"errors,omitempty"`
+	RowsSent     *int64  `json:"rows_sent,omitempty"`
+	RowsAffected *int64  `json:"rows_affected,omitempty"`
+}
+
+type perconaQuery struct {
+	Name         string  `json:"name"`
+	Record       string  `json:"record"`
+	Timestamp    string  `json:"timestamp"`
+	CommandClass string  `json:"command_class"`
+	ConnectionID string  `json:"connection_id"`
+	Status       int     `json:"status"`
+	SQLText      string  `json:"sqltext"`
+	User         string  `json:"user"`
+	Host         string  `json:"host"`
+	OSUser       string  `json:"os_user"`
+	IP           string  `json:"ip"`
+	DB           string  `json:"db"`
+}
+
+func (a *Audit) perconaRecord(e *event.Event, s *auditSession, name string) interface{} {
+
+	record    := fmt.Sprintf("%d_%s", a.id, a.start.UTC().Format("2006-01-02T15:04:05"))
+	timestamp := e.Time.UTC().Format("2006-01-02T15:04:05 UTC")
+	id        := fmt.Sprint(attrUint32(e, "connection_id"))
+	user      := attrString(e, "user")
+	ip        := clientIP(e.Client)
+
+	if name == "" {
+		return map[string]interface{}{"audit_record": &perconaQuery{
+			Name:         auditCommand(e),
+			Record:       record,
+			Timestamp:    timestamp,
+			CommandClass: CommandClass(e.Operation, e.Statement),
+			ConnectionID: id,
+			Status:       auditStatus(e),
+			SQLText:      auditStatement(e),
+			User:         fmt.Sprintf("%s[%s] @  [%s]", user, user, ip),
+			IP:           ip,
+			DB:           attrString(e, "schema"),
+		}}
+	}
+
+	c := &perconaConnection{
+		Name:         name,
+		Record:       record,
+		Timestamp:    timestamp,
+		ConnectionID: id,
+		Status:       auditStatus(e),
+		User:         user,
+		PrivUser:     user,
+		IP:           ip,
+		DB:           attrString(e, "schema"),
+		Program:      attrString(e, "program"),
+	}
+	if name == "Quit" {
+		c.DurationMs   = s.duration(e.Time)
+		c.Statements   = &s.statements
+		c.Errors       = &s.errors
+		c.RowsSent     = &s.rowsSent
+		c.RowsAffected = &s.rowsAffected
+	}
+	return map[string]interface{}{"audit_record": c}
+}
+
+//mysql enterprise audit JSON format
+type enterpriseRecord struct {
+	Timestamp      string                `json:"timestamp"`
+	ID             int                   `json:"id"`
+	Class          string                `json:"class"`
+	Event          string                `json:"event"`
+	ConnectionID   uint32                `json:"connection_id"`
+	Account        enterpriseAccount     `json:"account"`
+	Login          enterpriseLogin       `json:"login"`
+	ConnectionData *enterpriseConnection `json:"connection_data,omitempty"`
+	GeneralData    *enterpriseGeneral    `json:"general_data,omitempty"`
+}
+
+type enterpriseAccount struct {
+	User string `json:"user"`
+	Host string `json:"host"`
+}
+
+type enterpriseLogin struct {
+	User  string `json:"user"`
+	OS    string `json:"os"`
+	IP    string `json:"ip"`
+	Proxy string `json:"proxy"`
+}
+
+type enterpriseConnection struct {
+	ConnectionType       string            `json:"connection_type"`
+	Status               int               `json:"status"`
+	DB                   string            `json:"db"`
+	ConnectionAttributes map[string]string `json:"connection_attributes,omitempty"`
+
+	//not in the plugin's records
+	DurationMs           float64           `json:"duration_ms,omitempty"`
+	Statements           *int              `json:"statements,omitempty"`
+	Errors               *int              `json:"errors,omitempty"`
+	RowsSent             *int64            `json:"rows_sent,omitempty"`
+	RowsAffected         *int64            `json:"rows_affected,omitempty"`
+}
+
+type enterpriseGeneral struct {
+	Command    string `json:"command"`
+	SQLCommand string `json:"sql_command"`
+	Query      string `json:"query"`
+	Status     int    `json:"status"`
+}
+
+func (a *Audit) enterpriseRecord(e *event.Event, s *auditSession, name string) interface{} {
+
+	user := attrString(e, "user")
+	r := &enterpriseRecord{
+		Timestamp:    e.Time.UTC().Format("2006-01-02 15:04:05"),
+		ID:           a.id - 1,
+		ConnectionID: attrUint32(e, "connection_id"),
+		Account:      enterpriseAccount{User: user, Host: clientIP(e.Client)},
+		Login:        enterpriseLogin{User: user, IP: clientIP(e.Client)},
+	}
+
+	if name == "" {
+		r.Class = "general"
+		r.Event = "status"
+		r.GeneralData = &enterpriseGeneral{
+			Command:    auditCommand(e),
+			SQLCommand: CommandClass(e.Operation, e.Statement),
+			Query:      auditStatement(e),
+			Status:     auditStatus(e),
+		}
+		return r
+	}
+
+	r.Class = "connection"
+	c := &enterpriseConnection{
+		ConnectionType: "tcp/ip",
+		Status:         auditStatus(e),
+		DB:             attrString(e, "schema"),
+	}
+	if ssl, _ := e.Attrs["ssl"].(bool); ssl {
+		c.ConnectionType = "ssl"
+	}
+	if name == "Connect" {
+		r.Event = "connect"
+		c.ConnectionAttributes = s.attrs
+	} else {
+		r.Event = "disconnect"
+		c.DurationMs   = s.duration(e.Time)
+		c.Statements   = &s.statements
+		c.Errors       = &s.errors
+		c.RowsSent     = &s.rowsSent
+		c.RowsAffected = &s.rowsAffected
+	}
+	r.ConnectionData = c
+	return r
+}
+
+//command name of the server, as in the general log
+func auditCommand(e *event.Event) string {
+	switch e.Operation {
+	case "Change User":
+		return "Change user"
+	case "Close":
+		return "Close stmt"
+	case "Reset":
+		return "Reset stmt"
+	case "Kill":
+		return "Processkill"
+	}
+	return e.Operation
+}
+
+//words that do not tell the object of create, drop and alter
+var classSkipWords = map[string]bool{
+	"temporary": true, "unique": true, "fulltext": true, "spatial": true,
+	"or": true, "replace": true, "online": true, "offline": true,
+	"if": true, "not": true, "exists": true, "definer": true,
+}
+
+//CommandClass is the sql_command of a statement, like select,
+//insert, show_tables, create_table or change_db
+func CommandClass(operation string, statement string) string {
+
+	switch operation {
+	case "Init DB":
+		return "change_db"
+	case "Drop DB":
+		return "drop_db"
+	case "Field List":
+		return "show_fields"
+	case "Kill":
+		return "kill"
+	case "Query", "Execute", "Prepare":
+	default:
+		return strings.Replace(strings.ToLower(operation), " ", "_", -1)
+	}
+
+	//the first words, without comments
+	words := strings.Fields(strings.ToLower(Fingerprint(statement)))
+	if len(words) == 0 {
+		return ""
+	}
+	first := strings.TrimRight(words[0], "(;")
+	switch first {
+	case "use":
+		return "change_db"
+	case "set":
+		return "set_option"
+	case "start", "begin":
+		return "begin"
+	case "show":
+		if len(words) > 1 {
+			if words[1] == "full" && len(words) > 2 {
+				return "show_" + words[2]
+			}
+			return "show_" + words[1]
+		}
+	case "create", "drop", "alter":
+		for _, w := range words[1:] {
+			if classSkipWords[w] || strings.Contains(w, "=") {
+				continue
+			}
+			switch w {
+			case "database", "schema":
+				w = "db"
+			case "algorithm", "sql":
+				//create view options
+				continue
+			}
+			return first + "_" + w
+		}
+	}
+	return first
+}
@@ -0,0 +1,147 @@
+package build
+
+import (
+	"bytes"
+	"github.com/40t/go-sniffer/core/event"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io"
+	"testing"
+	"time"
+)
+
+//one direction of a stream, read once both are resolved
+type flowReader struct {
+	r      io.Reader
+	start  chan struct{}
+	closed bool
+}
+
+func (fr *flowReader) Read(p []byte) (int, error) {
+	<-fr.start
+	return fr.r.Read(p)
+}
+
+func (fr *flowReader) Closed() bool {
+	return fr.closed
+}
+
+//a stream of the connection 10.0.0.1:5000 -> 10.0.0.2:3306 with the
+//queries of the client, closed or flushed idle at its end
+func replayQueries(t *testing.T, m *Mysql, emit event.Emitter, closed bool, queries ...string) {
+	t.Helper()
+
+	var client bytes.Buffer
+	for _, q := range queries {
+		n := len(q) + 1
+		client.Write([]byte{byte(n), byte(n >> 8), byte(n >> 16), 0, COM_QUERY})
+		client.WriteString(q)
+	}
+	start := make(chan struct{})
+	net := gopacket.NewFlow(layers.EndpointIPv4, []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2})
+	transport := gopacket.NewFlow(layers.EndpointTCPPort, []byte{0x13, 0x88}, []byte{0x0c, 0xea})
+
+	done := make(chan bool)
+	go func() {
+		m.ResolveStream(net, transport, &flowReader{&client, start, closed}, emit)
+		done <- true
+	}()
+	go func() {
+		m.ResolveStream(net.Reverse(), transport.Reverse(), &flowReader{&bytes.Buffer{}, start, closed}, emit)
+		done <- true
+	}()
+
+	//both directions are open before either ends
+	for deadline := time.Now().Add(time.Second); ; {
+		m.mu.Lock()
+		flows := 0
+		for _, stm := range m.source {
+			flows = stm.flows
+		}
+		m.mu.Unlock()
+		if flows == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("streams not started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(start)
+	<-done
+	<-done
+}
+
+func TestAuditIdleStream(t *testing.T) {
+
+	m := NewInstance()
+	m.audit = NewAudit(AuditPercona)
+	defer func() { m.audit = nil }()
+
+	var records []*event.Event
+	emit := event.EmitterFunc(func(e *event.Event) { records = append(records, e) })
+
+	//a pooled connection, idle then used again:
+	//one session, its user kept across the streams
+	replayQueries(t, m, emit, false, "select 1")
+	if len(m.idle) != 1 {
+		t.Fatalf("%d idle streams", len(m.idle))
+	}
+	for _, stm := range m.idle {
+		stm.user, stm.schema = "app", "db"
+	}
+	replayQueries(t, m, emit, true, "select 2")
+	m.Flush(emit)
+
+	var names []string
+	for _, r := range records {
+		names = append(names, r.Statement)
+	}
+	if len(records) != 3 || names[0] != "select 1" || names[1] != "select 2" || names[2] != "Quit" {
+		t.Fatalf("records %q", names)
+	}
+	query := records[1].Attrs["record"].(map[string]interface{})["audit_record"].(*perconaQuery)
+	if query.User != "app[app] @  [10.0.0.1]" || query.DB != "db" {
+		t.Errorf("user %q db %q after the idle stream", query.User, query.DB)
+	}
+	quit := records[2].Attrs["record"].(map[string]interface{})["audit_record"].(*perconaConnection)
+	if *quit.Statements != 2 {
+		t.Errorf("quit after %d statements", *quit.Statements)
+	}
+	if len(m.idle) != 0 {
+		t.Errorf("%d idle streams", len(m.idle))
+	}
+}
+
+func TestAuditClose(t *testing.T) {
+
+	var records []*event.Event
+	a := NewAudit(AuditEnterprise)
+	a.SetOutput(event.EmitterFunc(func(e *event.Event) { records = append(records, e) }))
+
+	start := time.Date(2026, 10, 18, 15, 4, 5, 0, time.UTC)
+	for i, client := range []string{"10.0.0.1:5000", "10.0.0.1:5001"} {
+		e := &event.Event{
+			Time:      start.Add(time.Duration(i) * time.Second),
+			Client:    client,
+			Direction: event.Request,
+			Operation: "Query",
+			Statement: "select 1",
+		}
+		e.Set("user", "app").Set("connection_id", uint32(i+1))
+		a.Emit(e)
+	}
+
+	//the capture ends before the connections
+	a.Close()
+	a.Close()
+	if len(records) != 4 {
+		t.Fatalf("%d records", len(records))
+	}
+	for i, r := range records[2:] {
+		quit := r.Attrs["record"].(*enterpriseRecord)
+		if quit.Event != "disconnect" || quit.ConnectionID != uint32(i+1) || *quit.ConnectionData.Statements != 1 {
+			t.Errorf("quit %d: %s %d", i, quit.Event, quit.ConnectionID)
+		}
+	}
+}
@@ -0,0 +1,678 @@
+package build
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//binlog event types
+const (
+	QUERY_EVENT              byte = 2
+	ROTATE_EVENT             byte = 4
+	FORMAT_DESCRIPTION_EVENT byte = 15
+	XID_EVENT                byte = 16
+	TABLE_MAP_EVENT          byte = 19
+	WRITE_ROWS_EVENTv1       byte = 23
+	UPDATE_ROWS_EVENTv1      byte = 24
+	DELETE_ROWS_EVENTv1      byte = 25
+	HEARTBEAT_EVENT          byte = 27
+	WRITE_ROWS_EVENTv2       byte = 30
+	UPDATE_ROWS_EVENTv2      byte = 31
+	DELETE_ROWS_EVENTv2      byte = 32
+	GTID_EVENT               byte = 33
+	ANONYMOUS_GTID_EVENT     byte = 34
+	PREVIOUS_GTIDS_EVENT     byte = 35
+	PARTIAL_UPDATE_ROWS_EVENT byte = 39
+)
+
+const (
+	BinlogPacket         = "【Binlog】"
+	binlogHeaderLength   = 19
+	binlogChecksumLength = 4
+
+	BINLOG_CHECKSUM_ALG_OFF   byte = 0
+	BINLOG_CHECKSUM_ALG_CRC32 byte = 1
+)
+
+//binlog event header v4
+type BinlogHeader struct {
+	Timestamp uint32
+	Type      byte
+	ServerID  uint32
+	Size      uint32
+	LogPos    uint32
+	Flags     uint16
+}
+
+//binlogStream is the state of a COM_BINLOG_DUMP connection
+type binlogStream struct {
+	file     string
+
+	//from the format description event,
+	//checksum is -1 until it is known
+	checksum int
+	postHeaderLengths []byte
+
+	tables   map[uint64]*TableMap
+}
+
+func newBinlogStream(file string) *binlogStream {
+	return &binlogStream{
+		file:     file,
+		checksum: -1,
+		tables:   make(map[uint64]*TableMap),
+	}
+}
+
+//server version 5.6.1 and later
+func checksumAware(version string) bool {
+	var v [3]int
+	for i, s := range strings.SplitN(strings.SplitN(version, "-", 2)[0], ".", 3) {
+		v[i], _ = strconv.Atoi(s)
+	}
+	return v[0] > 5 || (v[0] == 5 && (v[1] > 6 || (v[1] == 6 && v[2] >= 1)))
+}
+
+func ParseBinlogHeader(b []byte) (*BinlogHeader, error) {
+	if len(b) < binlogHeaderLength {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return &BinlogHeader{
+		Timestamp: binary.LittleEndian.Uint32(b[0:4]),
+		Type:      b[4],
+		ServerID:  binary.LittleEndian.Uint32(b[5:9]),
+		Size:      binary.LittleEndian.Uint32(b[9:13]),
+		LogPos:    binary.LittleEndian.Uint32(b[13:17]),
+		Flags:     binary.LittleEndian.Uint16(b[17:19]),
+	}, nil
+}
+
+//post header length of an event type, def if not
+//announced by the format description event
+func (bs *binlogStream) postHeaderLength(typ byte, def int) int {
+	if int(typ) >= 1 && int(typ) <= len(bs.postHeaderLengths) {
+		return int(bs.postHeaderLengths[typ-1])
+	}
+	return def
+}
+
+//strip the crc32 of the event, before the format description
+//event it is only stripped if it matches
+func (bs *binlogStream) stripChecksum(event []byte, typ byte) []byte {
+
+	if len(event) < binlogHeaderLength+binlogChecksumLength {
+		return event
+	}
+	n := len(event) - binlogChecksumLength
+	switch {
+	case typ == FORMAT_DESCRIPTION_EVENT:
+		//since 5.6.1 the checksum algorithm(1) and checksum(4) close
+		//the event, the checksum is there even if the algorithm is off
+		version, _ := ReadStringFromByte(event[binlogHeaderLength+2:])
+		if !checksumAware(version) {
+			bs.checksum = int(BINLOG_CHECKSUM_ALG_OFF)
+			return event
+		}
+		bs.checksum = int(event[n-1])
+		return event[:n]
+	case bs.checksum == int(BINLOG_CHECKSUM_ALG_CRC32):
+		return event[:n]
+	case bs.checksum < 0 && crc32.ChecksumIEEE(event[:n]) == binary.LittleEndian.Uint32(event[n:]):
+		return event[:n]
+	}
+	return event
+}
+
+//resolveBinlogPacket reads one packet of the replication stream:
+//OK header and a binlog event, EOF at the end (non blocking) or ERR
+func (stm *stream) resolveBinlogPacket(payload []byte, seen time.Time) {
+
+	if len(payload) == 0 {
+		return
+	}
+	switch payload[0] {
+	case 0xff:
+		stm.resolveServerPacket(payload, 0, seen)
+		return
+	case 0xfe:
+		if len(payload) < 9 {
+			e := stm.newEvent(false, seen, len(payload))
+			e.Operation = "Binlog End"
+			e.Text = GetNowStr(false, seen) + BinlogPacket + " end of stream"
+			stm.emit.Emit(e)
+			return
+		}
+	case 0x00:
+	default:
+		return
+	}
+
+	data := payload[1:]
+
+	//semi-sync replication adds magic 0xef and an ack flag
+	if len(data) > 2+binlogHeaderLength && data[0] == 0xef &&
+		int(binary.LittleEndian.Uint32(data[9:13])) != len(data) &&
+		int(binary.LittleEndian.Uint32(data[11:15])) == len(data)-2 {
+		data = data[2:]
+	}
+
+	h, err := ParseBinlogHeader(data)
+	if err != nil {
+		return
+	}
+	if stm.binlog == nil {
+		stm.binlog = newBinlogStream("")
+	}
+	bs := stm.binlog
+	data = bs.stripChecksum(data, h.Type)
+	body := data[binlogHeaderLength:]
+
+	e := stm.newEvent(false, seen, len(payload))
+	e.Set("server_id", h.ServerID).Set("log_pos", h.LogPos)
+	e.Set("event_time", time.Unix(int64(h.Timestamp), 0))
+
+	var msg string
+	switch h.Type {
+
+	case FORMAT_DESCRIPTION_EVENT:
+		if len(body) < 2+50+4+1 {
+			return
+		}
+		version, _ := ReadStringFromByte(body[2:52])
+		headerLength := int(body[56])
+		lengths := body[57:]
+		if checksumAware(version) && len(lengths) > 0 {
+			//checksum algorithm(1)
+			lengths = lengths[:len(lengths)-1]
+		}
+		if headerLength == binlogHeaderLength {
+			bs.postHeaderLengths = append([]byte{}, lengths...)
+		}
+		e.Operation = "Binlog Format"
+		e.Statement = version
+		e.Set("binlog_version", binary.LittleEndian.Uint16(body[0:2]))
+		msg = "format server version:" + version
+
+	case ROTATE_EVENT:
+		if len(body) < 8 {
+			return
+		}
+		pos := binary.LittleEndian.Uint64(body[0:8])
+		bs.file = string(body[8:])
+		e.Operation = "Binlog Rotate"
+		e.Statement = fmt.Sprintf("%s:%d", bs.file, pos)
+		msg = "rotate " + e.Statement
+
+	case GTID_EVENT, ANONYMOUS_GTID_EVENT:
+		//flags(1), sid(16), gno(8)
+		if len(body) < 25 {
+			return
+		}
+		gtid := fmt.Sprintf("%s:%d", FormatUUID(body[1:17]), binary.LittleEndian.Uint64(body[17:25]))
+		if h.Type == ANONYMOUS_GTID_EVENT {
+			gtid = "ANONYMOUS"
+		}
+		e.Operation = "Binlog GTID"
+		e.Statement = gtid
+		e.Set("gtid", gtid)
+		msg = "SET @@SESSION.GTID_NEXT= '" + gtid + "'"
+
+	case QUERY_EVENT:
+		q, err := ParseQueryEvent(body, bs.postHeaderLength(QUERY_EVENT, 13))
+		if err != nil {
+			return
+		}
+		e.Operation = "Binlog Query"
+		e.Statement = q.Query
+		e.Set("schema", q.Schema).Set("thread_id", q.ThreadID).Set("exec_time", q.ExecTime)
+		if q.ErrorCode != 0 {
+			e.Set("error_code", q.ErrorCode)
+		}
+		msg = fmt.Sprintf("[%s] %s", q.Schema, q.Query)
+
+	case XID_EVENT:
+		if len(body) < 8 {
+			return
+		}
+		xid := binary.LittleEndian.Uint64(body[0:8])
+		e.Operation = "Binlog XID"
+		e.Statement = "COMMIT"
+		e.Set("xid", xid)
+		msg = fmt.Sprintf("COMMIT /* xid=%d */", xid)
+
+	case TABLE_MAP_EVENT:
+		t, err := ParseTableMap(body, bs.postHeaderLength(TABLE_MAP_EVENT, 8))
+		if err != nil {
+			stm.binlogError(h, err)
+			return
+		}
+		bs.tables[t.ID] = t
+		return
+
+	case WRITE_ROWS_EVENTv1, UPDATE_ROWS_EVENTv1, DELETE_ROWS_EVENTv1,
+		WRITE_ROWS_EVENTv2, UPDATE_ROWS_EVENTv2, DELETE_ROWS_EVENTv2, PARTIAL_UPDATE_ROWS_EVENT:
+		//without the format description event, v1 has no extra data
+		def := 10
+		if h.Type <= DELETE_ROWS_EVENTv1 {
+			def = 8
+		}
+		r, err := ParseRowsEvent(body, h.Type, bs.postHeaderLength(h.Type, def), bs.tables)
+		if err != nil {
+			stm.binlogError(h, err)
+			return
+		}
+		e.Operation = "Binlog " + r.Action
+		e.Statement = r.Table.Schema + "." + r.Table.Name
+		e.Set("table", e.Statement).Set("columns", r.Table.ColumnNames()).Set("rows", r.Values())
+		msg = fmt.Sprintf("%s %s rows:%d", r.Action, e.Statement, len(r.Rows)) + r.WriteToText()
+
+	default:
+		//heartbeats, previous gtids, ...
+		return
+	}
+
+	e.Set("binlog_file", bs.file)
+	e.Text = GetNowStr(false, seen) + BinlogPacket + " " + msg
+	stm.emit.Emit(e)
+}
+
+func (stm *stream) binlogError(h *BinlogHeader, err error) {
+	log.Println("ERR : Binlog event", h.Type, "at", h.LogPos, err)
+}
+
+//QUERY_EVENT
+type QueryEvent struct {
+	ThreadID  uint32
+	ExecTime  uint32
+	ErrorCode uint16
+	Schema    string
+	Query     string
+}
+
+//post header: thread id(4), exec time(4), schema length(1),
+//error code(2), status vars length(2); then status vars, schema, 0, query
+func ParseQueryEvent(b []byte, postHeader int) (*QueryEvent, error) {
+
+	if len(b) < 13 || postHeader < 13 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	q := &QueryEvent{
+		ThreadID:  binary.LittleEndian.Uint32(b[0:4]),
+		ExecTime:  binary.LittleEndian.Uint32(b[4:8]),
+		ErrorCode: binary.LittleEndian.Uint16(b[9:11]),
+	}
+	schemaLength := int(b[8])
+	statusLength := int(binary.LittleEndian.Uint16(b[11:13]))
+
+	pos := postHeader + statusLength
+	if pos+schemaLength+1 > len(b) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	q.Schema = string(b[pos : pos+schemaLength])
+	q.Query  = string(b[pos+schemaLength+1:])
+	return q, nil
+}
+
+//TABLE_MAP_EVENT
+type TableMap struct {
+	ID       uint64
+	Schema   string
+	Name     string
+	Types    []byte
+	Meta     []uint16
+	Nullable []byte
+
+	//optional metadata (binlog_row_metadata=FULL)
+	Columns  []string
+	Unsigned []bool
+}
+
+//table id(6, or 4 with a post header of 6), flags(2); schema, table,
+//column count, types, metadata, null bitmap and optional metadata
+func ParseTableMap(b []byte, postHeader int) (*TableMap, error) {
+
+	if len(b) < postHeader {
+		return nil, io.ErrUnexpectedEOF
+	}
+	t := &TableMap{
+		ID: readTableID(b, postHeader),
+	}
+	pos := postHeader
+
+	var err error
+	if t.Schema, pos, err = readByteString(b, pos); err != nil {
+		return nil, err
+	}
+	if t.Name, pos, err = readByteString(b, pos); err != nil {
+		return nil, err
+	}
+
+	if pos >= len(b) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	count, _, n := LengthEncodedInt(b[pos:])
+	if n == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	pos += n
+	if pos+int(count) > len(b) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	t.Types = append([]byte{}, b[pos:pos+int(count)]...)
+	pos += int(count)
+
+	if pos >= len(b) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	metaLength, _, n := LengthEncodedInt(b[pos:])
+	if n == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	pos += n
+	if pos+int(metaLength) > len(b) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if t.Meta, err = parseColumnMeta(b[pos:pos+int(metaLength)], t.Types); err != nil {
+		return nil, err
+	}
+	pos += int(metaLength)
+
+	step := (int(count) + 7) / 8
+	if pos+step > len(b) {
+		return t, nil
+	}
+	t.Nullable = b[pos : pos+step]
+	pos += step
+
+	t.parseOptionalMeta(b[pos:])
+	return t, nil
+}
+
+func readTableID(b []byte, postHeader int) uint64 {
+	if postHeader == 6 {
+		return uint64(binary.LittleEndian.Uint32(b[0:4]))
+	}
+	var id [8]byte
+	copy(id[:], b[0:6])
+	return binary.LittleEndian.Uint64(id[:])
+}
+
+//length(1), string, 0
+func readByteString(b []byte, pos int) (string, int, error) {
+	if pos >= len(b) || pos+1+int(b[pos])+1 > len(b) {
+		return "", pos, io.ErrUnexpectedEOF
+	}
+	l := int(b[pos])
+	return string(b[pos+1 : pos+1+l]), pos + 1 + l + 1, nil
+}
+
+//metadata of each column type
+func parseColumnMeta(b []byte, types []byte) ([]uint16, error) {
+
+	meta := make([]uint16, len(types))
+	pos := 0
+	for i, typ := range types {
+		var size int
+		switch typ {
+		case MYSQL_TYPE_FLOAT, MYSQL_TYPE_DOUBLE, MYSQL_TYPE_BLOB, MYSQL_TYPE_GEOMETRY, MYSQL_TYPE_JSON,
+			MYSQL_TYPE_TIME2, MYSQL_TYPE_DATETIME2, MYSQL_TYPE_TIMESTAMP2:
+			size = 1
+		case MYSQL_TYPE_VARCHAR, MYSQL_TYPE_VAR_STRING, MYSQL_TYPE_BIT,
+			MYSQL_TYPE_NEWDECIMAL, MYSQL_TYPE_STRING, MYSQL_TYPE_ENUM, MYSQL_TYPE_SET:
+			size = 2
+		}
+		if pos+size > len(b) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		switch {
+		case size == 1:
+			meta[i] = uint16(b[pos])
+		case typ == MYSQL_TYPE_NEWDECIMAL || typ == MYSQL_TYPE_STRING ||
+			typ == MYSQL_TYPE_ENUM || typ == MYSQL_TYPE_SET:
+			//precision and scale, or real type and length
+			meta[i] = uint16(b[pos])<<8 | uint16(b[pos+1])
+		case size == 2:
+			meta[i] = binary.LittleEndian.Uint16(b[pos : pos+2])
+		}
+		pos += size
+	}
+	return meta, nil
+}
+
+//optional metadata fields
+const (
+	tableMapSignedness = 1
+	tableMapColumnName = 4
+)
+
+//type(1), length, value
+func (t *TableMap) parseOptionalMeta(b []byte) {
+
+	for pos := 0; pos < len(b); {
+		typ := b[pos]
+		pos++
+		if pos >= len(b) {
+			return
+		}
+		l, _, n := LengthEncodedInt(b[pos:])
+		if n == 0 {
+			return
+		}
+		pos += n
+		if pos+int(l) > len(b) {
+			return
+		}
+		v := b[pos : pos+int(l)]
+		pos += int(l)
+
+		switch typ {
+		case tableMapSignedness:
+			//one bit per numeric column, most significant first
+			t.Unsigned = make([]bool, len(t.Types))
+			bit := 0
+			for i, typ := range t.Types {
+				if !isNumericType(typ) {
+					continue
+				}
+				if bit/8 < len(v) && v[bit/8]&(0x80>>uint(bit%8)) > 0 {
+					t.Unsigned[i] = true
+				}
+				bit++
+			}
+		case tableMapColumnName:
+			for p := 0; p < len(v); {
+				name, _, n, err := LengthEncodedString(v[p:])
+				if err != nil {
+					break
+				}
+				t.Columns = append(t.Columns, string(name))
+				p += n
+			}
+		}
+	}
+}
+
+func isNumericType(typ byte) bool {
+	switch typ {
+	case MYSQL_TYPE_TINY, MYSQL_TYPE_SHORT, MYSQL_TYPE_INT24, MYSQL_TYPE_LONG, MYSQL_TYPE_LONGLONG,
+		MYSQL_TYPE_NEWDECIMAL, MYSQL_TYPE_FLOAT, MYSQL_TYPE_DOUBLE:
+		return true
+	}
+	return false
+}
+
+//column names, @1 @2 ... without optional metadata
+func (t *TableMap) ColumnNames() []string {
+	names := make([]string, len(t.Types))
+	for i := range names {
+		if i < len(t.Columns) {
+			names[i] = t.Columns[i]
+		} else {
+			names[i] = fmt.Sprintf("@%d", i+1)
+		}
+	}
+	return names
+}
+
+//WRITE_ROWS, UPDATE_ROWS, PARTIAL_UPDATE_ROWS and DELETE_ROWS
+type RowsEvent struct {
+	Action string
+	Table  *TableMap
+
+	//update rows hold the before and the after image
+	Rows   [][]interface{}
+	After  [][]interface{}
+}
+
+//table id(6), flags(2), v2 extra data length(2) and data;
+//column count, present columns (twice for update), rows.
+//The after image of a partial update starts with its value
+//options, JSON columns may hold the changes instead of a value
+func ParseRowsEvent(b []byte, typ byte, postHeader int, tables map[uint64]*TableMap) (*RowsEvent, error) {
+
+	if len(b) < postHeader {
+		return nil, io.ErrUnexpectedEOF
+	}
+	id := readTableID(b, postHeader)
+	t, ok := tables[id]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("ERR : Unknown table id %d", id))
+	}
+
+	r := &RowsEvent{
+		Table: t,
+	}
+	switch typ {
+	case WRITE_ROWS_EVENTv1, WRITE_ROWS_EVENTv2:
+		r.Action = "Write Rows"
+	case UPDATE_ROWS_EVENTv1, UPDATE_ROWS_EVENTv2, PARTIAL_UPDATE_ROWS_EVENT:
+		r.Action = "Update Rows"
+	default:
+		r.Action = "Delete Rows"
+	}
+
+	pos := postHeader
+	if typ >= WRITE_ROWS_EVENTv2 && postHeader == 10 {
+		//the length is in the post header, and counts itself
+		extra := int(binary.LittleEndian.Uint16(b[8:10]))
+		pos += extra - 2
+	}
+
+	if pos >= len(b) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	count, _, n := LengthEncodedInt(b[pos:])
+	if n == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	pos += n
+	step := (int(count) + 7) / 8
+	if pos+step > len(b) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	present := b[pos : pos+step]
+	pos += step
+
+	presentAfter := present
+	update := typ == UPDATE_ROWS_EVENTv1 || typ == UPDATE_ROWS_EVENTv2 || typ == PARTIAL_UPDATE_ROWS_EVENT
+	if update {
+		if pos+step > len(b) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		presentAfter = b[pos : pos+step]
+		pos += step
+	}
+
+	for pos < len(b) {
+		row, n, err := t.readRow(b[pos:], present, nil)
+		if err != nil {
+			return nil, err
+		}
+		pos += n
+		r.Rows = append(r.Rows, row)
+
+		if update {
+			var partial []byte
+			if typ == PARTIAL_UPDATE_ROWS_EVENT {
+				if partial, n, err = t.readValueOptions(b[pos:], presentAfter); err != nil {
+					return nil, err
+				}
+				pos += n
+			}
+			row, n, err := t.readRow(b[pos:], presentAfter, partial)
+			if err != nil {
+				return nil, err
+			}
+			pos += n
+			r.After = append(r.After, row)
+		}
+	}
+	return r, nil
+}
+
+//rows for json output, column name to value,
+//{"before": .., "after": ..} for updates
+func (r *RowsEvent) Values() []interface{} {
+
+	names := r.Table.ColumnNames()
+	image := func(row []interface{}) map[string]interface{} {
+		m := make(map[string]interface{})
+		for i, v := range row {
+			if v == absentColumn {
+				continue
+			}
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			m[names[i]] = v
+		}
+		return m
+	}
+
+	values := make([]interface{}, len(r.Rows))
+	for i, row := range r.Rows {
+		if r.After != nil {
+			values[i] = map[string]interface{}{
+				"before": image(row),
+				"after":  image(r.After[i]),
+			}
+		} else {
+			values[i] = image(row)
+		}
+	}
+	return values
+}
+
+//rows, one line each
+func (r *RowsEvent) WriteToText() string {
+
+	var buf strings.Builder
+	names := r.Table.ColumnNames()
+	for i, row := range r.Rows {
+		buf.WriteString("\n    ")
+		buf.WriteString(formatBinlogRow(names, row, r.Table.Types))
+		if r.After != nil {
+			buf.WriteString(" => ")
+			buf.WriteString(formatBinlogRow(names, r.After[i], r.Table.Types))
+		}
+	}
+	return buf.String()
+}
+
+func formatBinlogRow(names []string, row []interface{}, types []byte) string {
+	var fields []string
+	for i, v := range row {
+		if v == absentColumn {
+			continue
+		}
+		fields = append(fields, names[i]+"="+SQLLiteral(v, types[i]))
+	}
+	return "(" + strings.Join(fields, ", ") + ")"
+}
@@ -0,0 +1,743 @@
+package build
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//value of the columns left out of a row image
+//(binlog_row_image=MINIMAL or NOBLOB)
+type absent struct{}
+
+var absentColumn interface{} = absent{}
+
+//row image: null bitmap of the present columns, then their values.
+//partial has a bit per present JSON column, set if it holds changes
+func (t *TableMap) readRow(b []byte, present []byte, partial []byte) ([]interface{}, int, error) {
+
+	count := 0
+	for i := range t.Types {
+		if isBitSet(present, i) {
+			count++
+		}
+	}
+	pos := (count + 7) / 8
+	if pos > len(b) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	nulls := b[:pos]
+
+	row := make([]interface{}, len(t.Types))
+	idx := 0
+	jsonIdx := 0
+	for i, typ := range t.Types {
+		if !isBitSet(present, i) {
+			row[i] = absentColumn
+			continue
+		}
+		diff := false
+		if typ == MYSQL_TYPE_JSON {
+			diff = isBitSet(partial, jsonIdx)
+			jsonIdx++
+		}
+		if isBitSet(nulls, idx) {
+			row[i] = nil
+		} else {
+			var v interface{}
+			var n int
+			var err error
+			if diff {
+				v, n, err = t.readJSONDiff(b[pos:], i)
+			} else {
+				v, n, err = t.readValue(b[pos:], i)
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+			row[i] = v
+			pos += n
+		}
+		idx++
+	}
+	return row, pos, nil
+}
+
+//value option of a partial update
+const partialJSONUpdates = 1
+
+//value options of a partial update, with PARTIAL_JSON_UPDATES
+//a bitmap of the JSON columns of the after image follows
+func (t *TableMap) readValueOptions(b []byte, present []byte) ([]byte, int, error) {
+
+	if len(b) == 0 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	options, _, pos := LengthEncodedInt(b)
+	if pos == 0 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if options&partialJSONUpdates == 0 {
+		return nil, pos, nil
+	}
+	count := 0
+	for i, typ := range t.Types {
+		if typ == MYSQL_TYPE_JSON && isBitSet(present, i) {
+			count++
+		}
+	}
+	size := (count + 7) / 8
+	if pos+size > len(b) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	return b[pos : pos+size], pos + size, nil
+}
+
+//JSON_REPLACE, JSON_INSERT and JSON_REMOVE by the operation of a diff
+var jsonDiffFunctions = []string{"JSON_REPLACE", "JSON_INSERT", "JSON_REMOVE"}
+
+//JSONDiff is a JSON column of a partial update, the changes to
+//its before image in the way mysqlbinlog prints them
+type JSONDiff string
+
+//length(meta bytes), then diffs of operation(1), path and,
+//unless removed, value in binary json; both length encoded
+func (t *TableMap) readJSONDiff(b []byte, i int) (interface{}, int, error) {
+
+	v, size, err := readVarString(b, int(t.Meta[i]))
+	if err != nil {
+		return nil, 0, err
+	}
+	data := v.([]byte)
+	expr := t.ColumnNames()[i]
+	for pos := 0; pos < len(data); {
+		op := int(data[pos])
+		pos++
+		if op >= len(jsonDiffFunctions) || pos >= len(data) {
+			return nil, 0, errJSONB
+		}
+		path, _, n, err := LengthEncodedString(data[pos:])
+		if err != nil {
+			return nil, 0, err
+		}
+		pos += n
+		expr = fmt.Sprintf("%s(%s, %s", jsonDiffFunctions[op], expr, SQLLiteral(string(path), MYSQL_TYPE_VARCHAR))
+		if op != 2 {
+			if pos >= len(data) {
+				return nil, 0, errJSONB
+			}
+			value, _, n, err := LengthEncodedString(data[pos:])
+			if err != nil {
+				return nil, 0, err
+			}
+			pos += n
+			s, err := DecodeJSONB(value)
+			if err != nil {
+				return nil, 0, err
+			}
+			expr += ", " + s
+		}
+		expr += ")"
+	}
+	return JSONDiff(expr), size, nil
+}
+
+func isBitSet(bitmap []byte, i int) bool {
+	return i/8 < len(bitmap) && bitmap[i/8]&(1<<uint(i%8)) > 0
+}
+
+func (t *TableMap) unsigned(i int) bool {
+	return i < len(t.Unsigned) && t.Unsigned[i]
+}
+
+//decode the value of column i, by the type and metadata of the table map
+func (t *TableMap) readValue(b []byte, i int) (interface{}, int, error) {
+
+	typ  := t.Types[i]
+	meta := t.Meta[i]
+
+	//the real type of ENUM and SET is in the metadata of STRING
+	length := int(meta & 0xff)
+	if typ == MYSQL_TYPE_STRING && meta >= 256 {
+		real := byte(meta >> 8)
+		if real&0x30 != 0x30 {
+			length |= int((real&0x30)^0x30) << 4
+			real |= 0x30
+		}
+		typ = real
+	}
+
+	need := func(n int) error {
+		if n > len(b) {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	}
+
+	switch typ {
+
+	case MYSQL_TYPE_TINY:
+		if err := need(1); err != nil {
+			return nil, 0, err
+		}
+		if t.unsigned(i) {
+			return uint64(b[0]), 1, nil
+		}
+		return int64(int8(b[0])), 1, nil
+
+	case MYSQL_TYPE_SHORT:
+		if err := need(2); err != nil {
+			return nil, 0, err
+		}
+		v := binary.LittleEndian.Uint16(b)
+		if t.unsigned(i) {
+			return uint64(v), 2, nil
+		}
+		return int64(int16(v)), 2, nil
+
+	case MYSQL_TYPE_INT24:
+		if err := need(3); err != nil {
+			return nil, 0, err
+		}
+		v := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+		if t.unsigned(i) {
+			return uint64(v), 3, nil
+		}
+		return int64(int32(v<<8) >> 8), 3, nil
+
+	case MYSQL_TYPE_LONG:
+		if err := need(4); err != nil {
+			return nil, 0, err
+		}
+		v := binary.LittleEndian.Uint32(b)
+		if t.unsigned(i) {
+			return uint64(v), 4, nil
+		}
+		return int64(int32(v)), 4, nil
+
+	case MYSQL_TYPE_LONGLONG:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		v := binary.LittleEndian.Uint64(b)
+		if t.unsigned(i) {
+			return v, 8, nil
+		}
+		return int64(v), 8, nil
+
+	case MYSQL_TYPE_FLOAT:
+		if err := need(4); err != nil {
+			return nil, 0, err
+		}
+		return math.Float32frombits(binary.LittleEndian.Uint32(b)), 4, nil
+
+	case MYSQL_TYPE_DOUBLE:
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), 8, nil
+
+	case MYSQL_TYPE_NEWDECIMAL:
+		return readDecimal(b, int(meta>>8), int(meta&0xff))
+
+	case MYSQL_TYPE_YEAR:
+		if err := need(1); err != nil {
+			return nil, 0, err
+		}
+		if b[0] == 0 {
+			return int64(0), 1, nil
+		}
+		return int64(b[0]) + 1900, 1, nil
+
+	case MYSQL_TYPE_BIT:
+		//bytes(1) and bits(1) of the last byte, big endian value
+		bits := int(meta>>8)*8 + int(meta&0xff)
+		n := (bits + 7) / 8
+		if err := need(n); err != nil {
+			return nil, 0, err
+		}
+		return append([]byte{}, b[:n]...), n, nil
+
+	case MYSQL_TYPE_TIMESTAMP:
+		if err := need(4); err != nil {
+			return nil, 0, err
+		}
+		return formatTimestamp(int64(binary.LittleEndian.Uint32(b)), 0, 0), 4, nil
+
+	case MYSQL_TYPE_TIMESTAMP2:
+		frac, n, err := readFraction(b, 4, int(meta))
+		if err != nil {
+			return nil, 0, err
+		}
+		return formatTimestamp(int64(binary.BigEndian.Uint32(b)), frac, int(meta)), n, nil
+
+	case MYSQL_TYPE_DATETIME:
+		//yyyymmddhhmmss
+		if err := need(8); err != nil {
+			return nil, 0, err
+		}
+		v := binary.LittleEndian.Uint64(b)
+		d, c := v/1000000, v%1000000
+		return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d",
+			d/10000, d%10000/100, d%100, c/10000, c%10000/100, c%100), 8, nil
+
+	case MYSQL_TYPE_DATETIME2:
+		//sign(1), year*13+month(17), day(5), hour(5), minute(6), second(6)
+		frac, n, err := readFraction(b, 5, int(meta))
+		if err != nil {
+			return nil, 0, err
+		}
+		v := int64(readBigEndian(b[:5])) - 0x8000000000
+		ymd, hms := v>>17, v%(1<<17)
+		ym := ymd >> 5
+		s := fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d",
+			ym/13, ym%13, ymd%(1<<5), hms>>12, (hms>>6)%(1<<6), hms%(1<<6))
+		return s + formatFraction(frac, int(meta)), n, nil
+
+	case MYSQL_TYPE_DATE, MYSQL_TYPE_NEWDATE:
+		//day(5), month(4), year(15)
+		if err := need(3); err != nil {
+			return nil, 0, err
+		}
+		v := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+		return fmt.Sprintf("%04d-%02d-%02d", v>>9, (v>>5)&15, v&31), 3, nil
+
+	case MYSQL_TYPE_TIME:
+		//hhmmss
+		if err := need(3); err != nil {
+			return nil, 0, err
+		}
+		v := int32(uint32(b[0])|uint32(b[1])<<8|uint32(b[2])<<16) << 8 >> 8
+		sign := ""
+		if v < 0 {
+			sign, v = "-", -v
+		}
+		return fmt.Sprintf("%s%02d:%02d:%02d", sign, v/10000, v%10000/100, v%100), 3, nil
+
+	case MYSQL_TYPE_TIME2:
+		return readTime2(b, int(meta))
+
+	case MYSQL_TYPE_ENUM:
+		//index of the value, 1 based
+		if err := need(length); err != nil {
+			return nil, 0, err
+		}
+		return readLittleEndian(b[:length]), length, nil
+
+	case MYSQL_TYPE_SET:
+		//bitmap of the values
+		if err := need(length); err != nil {
+			return nil, 0, err
+		}
+		return readLittleEndian(b[:length]), length, nil
+
+	case MYSQL_TYPE_VARCHAR, MYSQL_TYPE_VAR_STRING, MYSQL_TYPE_STRING:
+		size := 1
+		if typ == MYSQL_TYPE_STRING && length > 255 || typ != MYSQL_TYPE_STRING && meta > 255 {
+			size = 2
+		}
+		return readVarString(b, size)
+
+	case MYSQL_TYPE_BLOB, MYSQL_TYPE_GEOMETRY, MYSQL_TYPE_TINY_BLOB,
+		MYSQL_TYPE_MEDIUM_BLOB, MYSQL_TYPE_LONG_BLOB:
+		return readVarString(b, int(meta))
+
+	case MYSQL_TYPE_JSON:
+		v, n, err := readVarString(b, int(meta))
+		if err != nil {
+			return nil, 0, err
+		}
+		s, err := DecodeJSONB(v.([]byte))
+		if err != nil {
+			return nil, 0, err
+		}
+		return s, n, nil
+	}
+
+	return nil, 0, errors.New(fmt.Sprintf("ERR : Unsupported binlog column type %d", typ))
+}
+
+//length(size bytes) and value
+func readVarString(b []byte, size int) (interface{}, int, error) {
+	if size < 1 || size > 4 || size > len(b) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	l := int(readLittleEndian(b[:size]))
+	if size+l > len(b) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	return append([]byte{}, b[size:size+l]...), size + l, nil
+}
+
+func readLittleEndian(b []byte) uint64 {
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v
+}
+
+func readBigEndian(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+//fractional seconds after n bytes, (fsp+1)/2 bytes big endian,
+//returned as microseconds
+func readFraction(b []byte, n int, fsp int) (int64, int, error) {
+	size := (fsp + 1) / 2
+	if n+size > len(b) {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	frac := int64(readBigEndian(b[n : n+size]))
+	switch size {
+	case 1:
+		frac *= 10000
+	case 2:
+		frac *= 100
+	}
+	return frac, n + size, nil
+}
+
+func formatFraction(frac int64, fsp int) string {
+	if fsp <= 0 || fsp > 6 {
+		return ""
+	}
+	return "." + fmt.Sprintf("%06d", frac)[:fsp]
+}
+
+//timestamps are stored in UTC
+func formatTimestamp(sec int64, frac int64, fsp int) string {
+	if sec == 0 {
+		return "0000-00-00 00:00:00" + formatFraction(0, fsp)
+	}
+	return time.Unix(sec, 0).UTC().Format("2006-01-02 15:04:05") + formatFraction(frac, fsp)
+}
+
+//TIME2: sign(1), unused(1), hour(10), minute(6), second(6)
+//and the fraction, all offset to be unsigned
+func readTime2(b []byte, fsp int) (interface{}, int, error) {
+
+	size := 3 + (fsp+1)/2
+	if size > len(b) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	var v int64
+	switch size {
+	case 3:
+		v = (int64(readBigEndian(b[:3])) - 0x800000) << 24
+	case 4:
+		hms := int64(readBigEndian(b[:3])) - 0x800000
+		frac := int64(b[3])
+		if hms < 0 && frac > 0 {
+			hms++
+			frac -= 0x100
+		}
+		v = hms<<24 + frac*10000
+	case 5:
+		hms := int64(readBigEndian(b[:3])) - 0x800000
+		frac := int64(binary.BigEndian.Uint16(b[3:5]))
+		if hms < 0 && frac > 0 {
+			hms++
+			frac -= 0x10000
+		}
+		v = hms<<24 + frac*100
+	default:
+		v = int64(readBigEndian(b[:6])) - 0x800000000000
+	}
+
+	sign := ""
+	if v < 0 {
+		sign, v = "-", -v
+	}
+	hms := v >> 24
+	s := fmt.Sprintf("%s%02d:%02d:%02d", sign, (hms>>12)%(1<<10), (hms>>6)%(1<<6), hms%(1<<6))
+	return s + formatFraction(v%(1<<24), fsp), size, nil
+}
+
+//bytes for 0-9 leftover digits of a decimal
+var decimalBytes = []int{0, 1, 1, 2, 2, 3, 3, 4, 4, 4}
+
+//NEWDECIMAL: integer and fraction digits packed by 9 in 4 bytes,
+//big endian, the first bit is the sign and negatives are inverted.
+//The value is returned as the digits, like the text protocol
+func readDecimal(b []byte, precision int, scale int) (interface{}, int, error) {
+
+	integral := precision - scale
+	intFull, intLeft := integral/9, integral%9
+	fracFull, fracLeft := scale/9, scale%9
+	size := decimalBytes[intLeft] + intFull*4 + fracFull*4 + decimalBytes[fracLeft]
+	if size == 0 || size > len(b) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	buf := append([]byte{}, b[:size]...)
+	negative := buf[0]&0x80 == 0
+	buf[0] ^= 0x80
+	if negative {
+		for i := range buf {
+			buf[i] ^= 0xff
+		}
+	}
+
+	pos := 0
+	group := func(n int, digits int) string {
+		v := readBigEndian(buf[pos : pos+n])
+		pos += n
+		return fmt.Sprintf("%0*d", digits, v)
+	}
+
+	var digits strings.Builder
+	if intLeft > 0 {
+		digits.WriteString(group(decimalBytes[intLeft], intLeft))
+	}
+	for i := 0; i < intFull; i++ {
+		digits.WriteString(group(4, 9))
+	}
+	s := strings.TrimLeft(digits.String(), "0")
+	if s == "" {
+		s = "0"
+	}
+
+	if scale > 0 {
+		s += "."
+		for i := 0; i < fracFull; i++ {
+			s += group(4, 9)
+		}
+		if fracLeft > 0 {
+			s += group(decimalBytes[fracLeft], fracLeft)
+		}
+	}
+	if negative {
+		s = "-" + s
+	}
+	return []byte(s), size, nil
+}
+
+//binary json value types
+const (
+	jsonbSmallObject = 0x00
+	jsonbLargeObject = 0x01
+	jsonbSmallArray  = 0x02
+	jsonbLargeArray  = 0x03
+	jsonbLiteral     = 0x04
+	jsonbInt16       = 0x05
+	jsonbUint16      = 0x06
+	jsonbInt32       = 0x07
+	jsonbUint32      = 0x08
+	jsonbInt64       = 0x09
+	jsonbUint64      = 0x0a
+	jsonbDouble      = 0x0b
+	jsonbString      = 0x0c
+	jsonbOpaque      = 0x0f
+)
+
+var errJSONB = errors.New("ERR : Invalid binary json")
+
+//DecodeJSONB turns a JSON column of the binlog into its text
+func DecodeJSONB(b []byte) (string, error) {
+	if len(b) == 0 {
+		return "null", nil
+	}
+	var buf strings.Builder
+	if err := writeJSONB(&buf, b[0], b[1:]); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func writeJSONB(buf *strings.Builder, typ byte, b []byte) error {
+
+	switch typ {
+
+	case jsonbSmallObject, jsonbSmallArray:
+		return writeJSONBContainer(buf, typ == jsonbSmallObject, false, b)
+	case jsonbLargeObject, jsonbLargeArray:
+		return writeJSONBContainer(buf, typ == jsonbLargeObject, true, b)
+
+	case jsonbLiteral:
+		if len(b) < 1 {
+			return errJSONB
+		}
+		switch b[0] {
+		case 0:
+			buf.WriteString("null")
+		case 1:
+			buf.WriteString("true")
+		case 2:
+			buf.WriteString("false")
+		default:
+			return errJSONB
+		}
+
+	case jsonbInt16, jsonbUint16:
+		if len(b) < 2 {
+			return errJSONB
+		}
+		v := binary.LittleEndian.Uint16(b)
+		if typ == jsonbInt16 {
+			buf.WriteString(strconv.FormatInt(int64(int16(v)), 10))
+		} else {
+			buf.WriteString(strconv.FormatUint(uint64(v), 10))
+		}
+
+	case jsonbInt32, jsonbUint32:
+		if len(b) < 4 {
+			return errJSONB
+		}
+		v := binary.LittleEndian.Uint32(b)
+		if typ == jsonbInt32 {
+			buf.WriteString(strconv.FormatInt(int64(int32(v)), 10))
+		} else {
+			buf.WriteString(strconv.FormatUint(uint64(v), 10))
+		}
+
+	case jsonbInt64, jsonbUint64:
+		if len(b) < 8 {
+			return errJSONB
+		}
+		v := binary.LittleEndian.Uint64(b)
+		if typ == jsonbInt64 {
+			buf.WriteString(strconv.FormatInt(int64(v), 10))
+		} else {
+			buf.WriteString(strconv.FormatUint(v, 10))
+		}
+
+	case jsonbDouble:
+		if len(b) < 8 {
+			return errJSONB
+		}
+		buf.WriteString(strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(b)), 'g', -1, 64))
+
+	case jsonbString:
+		s, err := readJSONBString(b)
+		if err != nil {
+			return err
+		}
+		writeJSONString(buf, string(s))
+
+	case jsonbOpaque:
+		//mysql type(1), length, data; printed like mysqlbinlog does
+		if len(b) < 1 {
+			return errJSONB
+		}
+		data, err := readJSONBString(b[1:])
+		if err != nil {
+			return err
+		}
+		writeJSONString(buf, fmt.Sprintf("base64:type%d:%s", b[0], base64.StdEncoding.EncodeToString(data)))
+
+	default:
+		return errJSONB
+	}
+	return nil
+}
+
+//count, size, key entries for objects (offset, length(2)),
+//value entries (type(1), offset or inlined value); offsets
+//and sizes are 2 bytes, 4 for the large format
+func writeJSONBContainer(buf *strings.Builder, object bool, large bool, b []byte) error {
+
+	width := 2
+	if large {
+		width = 4
+	}
+	read := func(p int) int {
+		if large {
+			return int(binary.LittleEndian.Uint32(b[p:]))
+		}
+		return int(binary.LittleEndian.Uint16(b[p:]))
+	}
+
+	if len(b) < 2*width {
+		return errJSONB
+	}
+	count := read(0)
+	keys := 2 * width
+	values := keys
+	if object {
+		values += count * (width + 2)
+	}
+	if values+count*(1+width) > len(b) {
+		return errJSONB
+	}
+
+	if object {
+		buf.WriteByte('{')
+	} else {
+		buf.WriteByte('[')
+	}
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+
+		if object {
+			p := keys + i*(width+2)
+			offset, length := read(p), int(binary.LittleEndian.Uint16(b[p+width:]))
+			if offset+length > len(b) {
+				return errJSONB
+			}
+			writeJSONString(buf, string(b[offset:offset+length]))
+			buf.WriteString(": ")
+		}
+
+		p := values + i*(1+width)
+		typ := b[p]
+
+		//small values are stored in the entry
+		inline := typ == jsonbLiteral || typ == jsonbInt16 || typ == jsonbUint16 ||
+			large && (typ == jsonbInt32 || typ == jsonbUint32)
+		var err error
+		if inline {
+			err = writeJSONB(buf, typ, b[p+1:p+1+width])
+		} else {
+			offset := read(p + 1)
+			if offset >= len(b) {
+				return errJSONB
+			}
+			err = writeJSONB(buf, typ, b[offset:])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if object {
+		buf.WriteByte('}')
+	} else {
+		buf.WriteByte(']')
+	}
+	return nil
+}
+
+//length with 7 bits per byte, low first, then the data
+func readJSONBString(b []byte) ([]byte, error) {
+	var l, shift uint
+	for i := 0; i < len(b) && i < 5; i++ {
+		l |= uint(b[i]&0x7f) << shift
+		shift += 7
+		if b[i]&0x80 == 0 {
+			if i+1+int(l) > len(b) {
+				return nil, errJSONB
+			}
+			return b[i+1 : i+1+int(l)], nil
+		}
+	}
+	return nil, errJSONB
+}
+
+func writeJSONString(buf *strings.Builder, s string) {
+	q, _ := json.Marshal(s)
+	buf.Write(q)
+}
@@ -0,0 +1,155 @@
+package build
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"strings"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+//values as printed by mysqlbinlog -v
+func TestReadDecimal(t *testing.T) {
+
+	tests := []struct {
+		wire      string
+		precision int
+		scale     int
+		want      string
+	}{
+		//examples of strings/decimal.c
+		{"81 0D FB 38 D2 04 D2", 14, 4, "1234567890.1234"},
+		{"7E F2 04 C7 2D FB 2D", 14, 4, "-1234567890.1234"},
+		{"80 00 00 00 00", 10, 2, "0.00"},
+		{"7F FF FE", 5, 0, "-1"},
+		{"80 00 00 01 00 00 00 00", 18, 9, "1.000000000"},
+		{"80 7B 00 2D", 7, 4, "123.0045"},
+	}
+
+	for _, tt := range tests {
+		b := unhex(t, tt.wire)
+		v, n, err := readDecimal(b, tt.precision, tt.scale)
+		if err != nil || string(v.([]byte)) != tt.want || n != len(b) {
+			t.Errorf("readDecimal(%s, %d, %d) = %s %d %v, want %s", tt.wire, tt.precision, tt.scale, v, n, err, tt.want)
+		}
+	}
+}
+
+func TestReadTime2(t *testing.T) {
+
+	tests := []struct {
+		wire string
+		fsp  int
+		want string
+	}{
+		{"80 C8 B8", 0, "12:34:56"},
+		{"B4 6E FB", 0, "838:59:59"},
+		{"4B 91 05", 0, "-838:59:59"},
+		{"7F FF FE CE", 1, "-00:00:01.5"},
+		{"80 00 00 04 CE", 3, "00:00:00.123"},
+		{"80 C8 B8 01 E2 40", 6, "12:34:56.123456"},
+	}
+
+	for _, tt := range tests {
+		b := unhex(t, tt.wire)
+		v, n, err := readTime2(b, tt.fsp)
+		if err != nil || v != tt.want || n != len(b) {
+			t.Errorf("readTime2(%s, %d) = %v %d %v, want %s", tt.wire, tt.fsp, v, n, err, tt.want)
+		}
+	}
+}
+
+func TestDecodeJSONB(t *testing.T) {
+
+	double := make([]byte, 8)
+	binary.LittleEndian.PutUint64(double, math.Float64bits(1.5))
+
+	tests := []struct {
+		wire string
+		want string
+	}{
+		{"00 01 00 0C 00 0B 00 01 00 05 01 00 61", `{"a": 1}`},
+		{"02 02 00 0C 00 05 01 00 0C 0A 00 01 78", `[1, "x"]`},
+		{"02 03 00 0D 00 04 00 00 04 01 00 04 02 00", `[null, true, false]`},
+		{"0C 03 61 62 63", `"abc"`},
+		{"07 FF FF FF FF", `-1`},
+		{"0A FF FF FF FF FF FF FF FF", `18446744073709551615`},
+		{"0B" + hex.EncodeToString(double), `1.5`},
+		{"0F 0C 01 31", `"base64:type12:MQ=="`},
+		{"", `null`},
+	}
+
+	for _, tt := range tests {
+		got, err := DecodeJSONB(unhex(t, tt.wire))
+		if err != nil || got != tt.want {
+			t.Errorf("DecodeJSONB(%s) = %s %v, want %s", tt.wire, got, err, tt.want)
+		}
+	}
+
+	//offsets past the end
+	if _, err := DecodeJSONB(unhex(t, "00 01 00 0C 00 FF 00 01 00 05 01 00 61")); err == nil {
+		t.Errorf("no error for a bad key offset")
+	}
+}
+
+func TestParseRowsEvent(t *testing.T) {
+
+	tables := map[uint64]*TableMap{
+		1: {ID: 1, Schema: "db", Name: "t", Types: []byte{MYSQL_TYPE_LONG, MYSQL_TYPE_JSON}, Meta: []uint16{0, 4}},
+	}
+	before := "00 07000000 0D000000 00 01 00 0C 00 0B 00 01 00 05 01 00 61"
+
+	tests := []struct {
+		name       string
+		typ        byte
+		postHeader int
+		wire       string
+		want       string
+	}{
+		{
+			"update v1",
+			UPDATE_ROWS_EVENTv1, 8,
+			"010000000000 0100 02 03 03" + before + "00 08000000 0D000000 00 01 00 0C 00 0B 00 01 00 05 02 00 61",
+			`(@1=7, @2='{\"a\": 1}') => (@1=8, @2='{\"a\": 2}')`,
+		},
+		{
+			"partial update",
+			PARTIAL_UPDATE_ROWS_EVENT, 10,
+			"010000000000 0100 0200 02 03 03" + before + "01 01 00 08000000 0E000000 00 03 242E61 03 050200 02 03 242E62",
+			`(@1=7, @2='{\"a\": 1}') => (@1=8, @2=JSON_REMOVE(JSON_REPLACE(@2, '$.a', 2), '$.b'))`,
+		},
+		{
+			"partial update without json changes",
+			PARTIAL_UPDATE_ROWS_EVENT, 10,
+			"010000000000 0100 0200 02 03 03" + before + "00 00 08000000 0D000000 00 01 00 0C 00 0B 00 01 00 05 02 00 61",
+			`(@1=7, @2='{\"a\": 1}') => (@1=8, @2='{\"a\": 2}')`,
+		},
+	}
+
+	for _, tt := range tests {
+		r, err := ParseRowsEvent(unhex(t, tt.wire), tt.typ, tt.postHeader, tables)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := strings.TrimSpace(r.WriteToText()); r.Action != "Update Rows" || got != tt.want {
+			t.Errorf("%s: %s %s, want %s", tt.name, r.Action, got, tt.want)
+		}
+	}
+
+	//json output of the partial column
+	r, _ := ParseRowsEvent(unhex(t, tests[1].wire), tests[1].typ, 10, tables)
+	after := r.Values()[0].(map[string]interface{})["after"].(map[string]interface{})
+	if diff, ok := after["@2"].(JSONDiff); !ok || diff != "JSON_REMOVE(JSON_REPLACE(@2, '$.a', 2), '$.b')" {
+		t.Errorf("after image %#v", after)
+	}
+}
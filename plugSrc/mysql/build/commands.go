@@ -0,0 +1,422 @@
+package build
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/40t/go-sniffer/core/event"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//COM_SET_OPTION
+const (
+	MYSQL_OPTION_MULTI_STATEMENTS_ON  uint16 = 0
+	MYSQL_OPTION_MULTI_STATEMENTS_OFF uint16 = 1
+)
+
+//COM_BINLOG_DUMP_GTID flags
+const (
+	BINLOG_DUMP_NON_BLOCK uint16 = 0x01
+	BINLOG_THROUGH_GTID   uint16 = 0x04
+)
+
+//COM_CHANGE_USER
+type ChangeUser struct {
+	User       string
+	Database   string
+	Charset    uint16
+	AuthPlugin string
+	Attrs      map[string]string
+}
+
+//COM_BINLOG_DUMP and COM_BINLOG_DUMP_GTID
+type BinlogDump struct {
+	ServerID uint32
+	Flags    uint16
+	File     string
+	Position uint64
+	GTIDSet  string
+}
+
+//COM_REGISTER_SLAVE
+type RegisterSlave struct {
+	ServerID uint32
+	Host     string
+	User     string
+	Port     uint16
+}
+
+//resolveCommand decodes the client commands other than
+//queries and prepared statements, ok is false if unknown
+func (stm *stream) resolveCommand(payload []byte, e *event.Event) (msg string, ok bool) {
+
+	args := payload[1:]
+	switch payload[0] {
+
+	case COM_QUIT:
+		e.Operation = "Quit"
+
+	case COM_PING:
+		e.Operation = "Ping"
+
+	case COM_STATISTICS:
+		e.Operation = "Statistics"
+
+	case COM_RESET_CONNECTION:
+		e.Operation = "Reset Connection"
+
+		//the server drops the prepared statements of the session
+		stm.stmtMap = make(map[uint32]*Stmt)
+
+	case COM_FIELD_LIST:
+		table, n := ReadStringFromByte(args)
+		wildcard := ""
+		if n+1 < len(args) {
+			wildcard = string(args[n+1:])
+		}
+		e.Operation = "Field List"
+		e.Statement = table
+		e.Set("table", table)
+		msg = "table:" + table
+		if wildcard != "" {
+			e.Set("wildcard", wildcard)
+			msg += " like:" + wildcard
+		}
+
+	case COM_PROCESS_KILL:
+		if len(args) < 4 {
+			return "", false
+		}
+		id := binary.LittleEndian.Uint32(args[0:4])
+		e.Operation = "Kill"
+		e.Statement = fmt.Sprintf("KILL %d", id)
+		e.Set("kill_id", id)
+		msg = e.Statement
+
+	case COM_SET_OPTION:
+		if len(args) < 2 {
+			return "", false
+		}
+		option := binary.LittleEndian.Uint16(args[0:2])
+		e.Operation = "Set Option"
+		switch option {
+		case MYSQL_OPTION_MULTI_STATEMENTS_ON:
+			e.Statement = "multi_statements_on"
+		case MYSQL_OPTION_MULTI_STATEMENTS_OFF:
+			e.Statement = "multi_statements_off"
+		default:
+			e.Statement = strconv.Itoa(int(option))
+		}
+		msg = e.Statement
+
+	case COM_CHANGE_USER:
+		c, err := ParseChangeUser(args, stm.capability)
+		if err != nil {
+			return "", false
+		}
+		e.Operation = "Change User"
+		e.Statement = c.User
+		e.Set("new_user", c.User).Set("new_schema", c.Database)
+		if c.AuthPlugin != "" {
+			e.Set("auth_plugin", c.AuthPlugin)
+		}
+		if len(c.Attrs) > 0 {
+			e.Set("connect_attrs", c.Attrs)
+		}
+		msg = fmt.Sprintf("user:%s db:%s", c.User, c.Database)
+
+		//the session is the new user's, auth switch may follow
+		stm.user   = c.User
+		stm.schema = c.Database
+		if name, ok := c.Attrs["program_name"]; ok {
+			stm.program = name
+		}
+		stm.phase = phaseHandshake
+
+	case COM_REGISTER_SLAVE:
+		r, err := ParseRegisterSlave(args)
+		if err != nil {
+			return "", false
+		}
+		e.Operation = "Register Slave"
+		e.Statement = fmt.Sprintf("%s:%d", r.Host, r.Port)
+		e.Set("server_id", r.ServerID).Set("replica_host", r.Host).Set("replica_port", r.Port)
+		msg = fmt.Sprintf("server id:%d host:%s:%d user:%s", r.ServerID, r.Host, r.Port, r.User)
+
+	case COM_BINLOG_DUMP, COM_BINLOG_DUMP_GTID:
+		var d *BinlogDump
+		var err error
+		if payload[0] == COM_BINLOG_DUMP {
+			e.Operation = "Binlog Dump"
+			d, err = ParseBinlogDump(args)
+		} else {
+			e.Operation = "Binlog Dump GTID"
+			d, err = ParseBinlogDumpGTID(args)
+		}
+		if err != nil {
+			return "", false
+		}
+		e.Statement = fmt.Sprintf("%s:%d", d.File, d.Position)
+		e.Set("server_id", d.ServerID).Set("binlog_file", d.File).Set("binlog_pos", d.Position)
+		msg = fmt.Sprintf("server id:%d file:%s pos:%d", d.ServerID, d.File, d.Position)
+		if d.GTIDSet != "" {
+			e.Set("gtid_set", d.GTIDSet)
+			msg += " gtid:" + d.GTIDSet
+		}
+
+		//the rest of the connection is the binlog stream
+		stm.phase  = phaseReplication
+		stm.binlog = newBinlogStream(d.File)
+
+	default:
+		return "", false
+	}
+
+	if msg == "" {
+		return "【" + e.Operation + "】", true
+	}
+	return "【" + e.Operation + "】 " + msg, true
+}
+
+//resolveCommandResponse reads the responses which are neither
+//OK, ERR nor a result set, it returns false for the others
+func (stm *stream) resolveCommandResponse(payload []byte, seen time.Time) bool {
+
+	if stm.pending == nil || payload[0] == 0xff {
+		return false
+	}
+
+	e := stm.newEvent(false, seen, stm.packetSize(payload))
+	switch stm.command {
+
+	case COM_STATISTICS:
+		//human readable string
+		e.Operation = "Statistics"
+		e.Status    = "OK"
+		e.Set("statistics", string(payload))
+		stm.resp.replies = append(stm.resp.replies, string(payload))
+
+	case COM_FIELD_LIST:
+		//column definitions, then EOF
+		if payload[0] != 0xfe {
+			if col, err := ParseColumn(payload); err == nil {
+				stm.resp.columns = append(stm.resp.columns, col.Name)
+			}
+			return true
+		}
+		e.Operation = "Result"
+		e.Status    = "OK"
+		stm.resp.replies = append(stm.resp.replies,
+			fmt.Sprintf("%s Columns:%s", ResultSetPacket, strings.Join(stm.resp.columns, ",")))
+		stm.resp.resultSets++
+
+	case COM_STMT_PREPARE:
+		//PREPARE_OK: status, stmt id(4), columns(2), params(2),
+		//filler, warnings(2), then the param and column definitions
+		if payload[0] != 0x00 || len(payload) < 9 {
+			return false
+		}
+		stmt := &Stmt{
+			ID:         binary.LittleEndian.Uint32(payload[1:5]),
+			Query:      stm.pending.Statement,
+			FieldCount: binary.LittleEndian.Uint16(payload[5:7]),
+			ParamCount: binary.LittleEndian.Uint16(payload[7:9]),
+		}
+		stmt.Args = make([]interface{}, stmt.ParamCount)
+		stm.stmtMap[stmt.ID] = stmt
+
+		for _, n := range []uint16{stmt.ParamCount, stmt.FieldCount} {
+			if n > 0 {
+				stm.prepareDefs += int(n)
+				if !stm.deprecateEOF {
+					stm.prepareDefs++
+				}
+			}
+		}
+		e.Operation = "Ok"
+		e.Status    = "OK"
+		e.Set("stmt_id", stmt.ID)
+		stm.resp.replies = append(stm.resp.replies, fmt.Sprintf("%s Stm id:%d Params:%d Columns:%d",
+			OkPacket, stmt.ID, stmt.ParamCount, stmt.FieldCount))
+
+	case COM_SET_OPTION:
+		//EOF on success
+		if payload[0] != 0xfe {
+			return false
+		}
+		e.Operation = "Ok"
+		e.Status    = "OK"
+		stm.resp.replies = append(stm.resp.replies, OkPacket)
+
+	default:
+		return false
+	}
+
+	stm.completePending(e)
+	return true
+}
+
+func ParseChangeUser(b []byte, capability uint32) (*ChangeUser, error) {
+
+	c := &ChangeUser{}
+	user, n := ReadStringFromByte(b)
+	c.User = user
+	pos := n + 1
+
+	//auth response
+	if pos >= len(b) {
+		return c, nil
+	}
+	if capability&CLIENT_SECURE_CONNECTION > 0 {
+		pos += 1 + int(b[pos])
+	} else {
+		_, n := ReadStringFromByte(b[pos:])
+		pos += n + 1
+	}
+
+	if pos >= len(b) {
+		return c, nil
+	}
+	db, n := ReadStringFromByte(b[pos:])
+	c.Database = db
+	pos += n + 1
+
+	if pos+2 > len(b) {
+		return c, nil
+	}
+	c.Charset = binary.LittleEndian.Uint16(b[pos : pos+2])
+	pos += 2
+
+	if capability&CLIENT_PLUGIN_AUTH > 0 && pos < len(b) {
+		plugin, n := ReadStringFromByte(b[pos:])
+		c.AuthPlugin = plugin
+		pos += n + 1
+	}
+	if capability&CLIENT_CONNECT_ATTRS > 0 && pos < len(b) {
+		c.Attrs = parseConnectAttrs(b[pos:])
+	}
+	return c, nil
+}
+
+//binlog pos(4), flags(2), server id(4), binlog filename
+func ParseBinlogDump(b []byte) (*BinlogDump, error) {
+
+	if len(b) < 10 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return &BinlogDump{
+		Position: uint64(binary.LittleEndian.Uint32(b[0:4])),
+		Flags:    binary.LittleEndian.Uint16(b[4:6]),
+		ServerID: binary.LittleEndian.Uint32(b[6:10]),
+		File:     string(b[10:]),
+	}, nil
+}
+
+//flags(2), server id(4), filename length(4), filename,
+//binlog pos(8), then the gtid set if BINLOG_THROUGH_GTID
+func ParseBinlogDumpGTID(b []byte) (*BinlogDump, error) {
+
+	if len(b) < 10 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	d := &BinlogDump{
+		Flags:    binary.LittleEndian.Uint16(b[0:2]),
+		ServerID: binary.LittleEndian.Uint32(b[2:6]),
+	}
+	l := int(binary.LittleEndian.Uint32(b[6:10]))
+	pos := 10
+	if pos+l+8 > len(b) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	d.File = string(b[pos : pos+l])
+	pos += l
+	d.Position = binary.LittleEndian.Uint64(b[pos : pos+8])
+	pos += 8
+
+	if d.Flags&BINLOG_THROUGH_GTID > 0 && pos+4 <= len(b) {
+		size := int(binary.LittleEndian.Uint32(b[pos : pos+4]))
+		pos += 4
+		if pos+size > len(b) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		set, err := ParseGTIDSet(b[pos : pos+size])
+		if err != nil {
+			return nil, err
+		}
+		d.GTIDSet = set
+	}
+	return d, nil
+}
+
+//encoded gtid set: sid count(8), then per sid: uuid(16),
+//interval count(8) and intervals of start(8), end(8) exclusive
+func ParseGTIDSet(b []byte) (string, error) {
+
+	if len(b) < 8 {
+		return "", io.ErrUnexpectedEOF
+	}
+	count := binary.LittleEndian.Uint64(b[0:8])
+	pos := 8
+
+	var sids []string
+	for i := uint64(0); i < count; i++ {
+		if pos+24 > len(b) {
+			return "", io.ErrUnexpectedEOF
+		}
+		sid := FormatUUID(b[pos : pos+16])
+		intervals := binary.LittleEndian.Uint64(b[pos+16 : pos+24])
+		pos += 24
+		if uint64(len(b)-pos) < intervals*16 {
+			return "", io.ErrUnexpectedEOF
+		}
+		for j := uint64(0); j < intervals; j++ {
+			start := binary.LittleEndian.Uint64(b[pos : pos+8])
+			end   := binary.LittleEndian.Uint64(b[pos+8 : pos+16]) - 1
+			pos += 16
+			if start == end {
+				sid += fmt.Sprintf(":%d", start)
+			} else {
+				sid += fmt.Sprintf(":%d-%d", start, end)
+			}
+		}
+		sids = append(sids, sid)
+	}
+	return strings.Join(sids, ","), nil
+}
+
+func FormatUUID(b []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+//server id(4), hostname, user, password (1 byte length each),
+//port(2), replication rank(4), master id(4)
+func ParseRegisterSlave(b []byte) (*RegisterSlave, error) {
+
+	if len(b) < 4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	r := &RegisterSlave{
+		ServerID: binary.LittleEndian.Uint32(b[0:4]),
+	}
+	pos := 4
+
+	var fields [3]string
+	for i := range fields {
+		if pos >= len(b) || pos+1+int(b[pos]) > len(b) {
+			return nil, errors.New("ERR : Register slave")
+		}
+		l := int(b[pos])
+		fields[i] = string(b[pos+1 : pos+1+l])
+		pos += 1 + l
+	}
+	r.Host = fields[0]
+	r.User = fields[1]
+
+	if pos+2 <= len(b) {
+		r.Port = binary.LittleEndian.Uint16(b[pos : pos+2])
+	}
+	return r, nil
+}
@@ -0,0 +1,118 @@
+package build
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestParseChangeUser(t *testing.T) {
+
+	auth := append([]byte{20}, "01234567890123456789"...)
+	full := append(append([]byte("app\x00"), auth...), "shop\x00\x21\x00mysql_native_password\x00"...)
+	full  = append(full, 10, 4, 'k', 'e', 'y', '1', 4, 'v', 'a', 'l', '1')
+
+	tests := []struct {
+		name       string
+		b          []byte
+		capability uint32
+		want       ChangeUser
+	}{
+		{"full", full, CLIENT_PROTOCOL_41 | CLIENT_SECURE_CONNECTION | CLIENT_PLUGIN_AUTH | CLIENT_CONNECT_ATTRS, ChangeUser{
+			User:       "app",
+			Database:   "shop",
+			Charset:    0x21,
+			AuthPlugin: "mysql_native_password",
+			Attrs:      map[string]string{"key1": "val1"},
+		}},
+		{"user only", []byte("app\x00"), CLIENT_SECURE_CONNECTION, ChangeUser{User: "app"}},
+		{"old auth", []byte("app\x00secret\x00shop\x00"), 0, ChangeUser{User: "app", Database: "shop"}},
+	}
+
+	for _, tt := range tests {
+		c, err := ParseChangeUser(tt.b, tt.capability)
+		if err != nil || !reflect.DeepEqual(*c, tt.want) {
+			t.Errorf("%s: %+v %v, want %+v", tt.name, c, err, tt.want)
+		}
+	}
+}
+
+//encoded gtid set of one sid and its intervals
+func gtidSet(sid []byte, intervals ...uint64) []byte {
+	b := binary.LittleEndian.AppendUint64(nil, 1)
+	b = append(b, sid...)
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(intervals)/2))
+	for _, v := range intervals {
+		b = binary.LittleEndian.AppendUint64(b, v)
+	}
+	return b
+}
+
+func TestParseGTIDSet(t *testing.T) {
+
+	sid := []byte{0x3e, 0x11, 0xfa, 0x47, 0x71, 0xca, 0x11, 0xe1, 0x9e, 0x33, 0xc8, 0x0a, 0xa9, 0x42, 0x95, 0x62}
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+		err  bool
+	}{
+		{"intervals", gtidSet(sid, 1, 6, 8, 9), "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5:8", false},
+		{"empty", binary.LittleEndian.AppendUint64(nil, 0), "", false},
+		{"truncated", gtidSet(sid, 1, 6)[:40], "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseGTIDSet(tt.b)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("%s: %q %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseBinlogDump(t *testing.T) {
+
+	b := binary.LittleEndian.AppendUint32(nil, 4)
+	b = binary.LittleEndian.AppendUint16(b, BINLOG_DUMP_NON_BLOCK)
+	b = binary.LittleEndian.AppendUint32(b, 2)
+	b = append(b, "binlog.000001"...)
+	d, err := ParseBinlogDump(b)
+	want := BinlogDump{ServerID: 2, Flags: BINLOG_DUMP_NON_BLOCK, File: "binlog.000001", Position: 4}
+	if err != nil || *d != want {
+		t.Errorf("binlog dump %+v %v", d, err)
+	}
+
+	//gtid set after the position
+	set := gtidSet(make([]byte, 16), 1, 11)
+	b = binary.LittleEndian.AppendUint16(nil, BINLOG_THROUGH_GTID)
+	b = binary.LittleEndian.AppendUint32(b, 3)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint64(b, 4)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(set)))
+	d, err = ParseBinlogDumpGTID(append(b, set...))
+	want = BinlogDump{ServerID: 3, Flags: BINLOG_THROUGH_GTID, Position: 4, GTIDSet: "00000000-0000-0000-0000-000000000000:1-10"}
+	if err != nil || *d != want {
+		t.Errorf("binlog dump gtid %+v %v", d, err)
+	}
+
+	if _, err := ParseBinlogDumpGTID(b[:12]); err == nil {
+		t.Errorf("truncated binlog dump gtid: no error")
+	}
+}
+
+func TestParseRegisterSlave(t *testing.T) {
+
+	b := binary.LittleEndian.AppendUint32(nil, 3)
+	b = append(b, 7, 'r', 'e', 'p', 'l', 'i', 'c', 'a', 4, 'r', 'e', 'p', 'l', 0)
+	b = binary.LittleEndian.AppendUint16(b, 3306)
+	b = append(b, make([]byte, 8)...)
+
+	r, err := ParseRegisterSlave(b)
+	want := RegisterSlave{ServerID: 3, Host: "replica", User: "repl", Port: 3306}
+	if err != nil || *r != want {
+		t.Errorf("register slave %+v %v", r, err)
+	}
+	if _, err := ParseRegisterSlave(b[:8]); err == nil {
+		t.Errorf("truncated register slave: no error")
+	}
+}
@@ -0,0 +1,168 @@
+package build
+
+import (
+	"bytes"
+	"compress/zlib"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"sync"
+)
+
+//compression algorithm of a connection
+const (
+	compressNone = iota
+	compressZlib
+	compressZstd
+)
+
+var compressNames = map[int]string{
+	compressZlib: "zlib",
+	compressZstd: "zstd",
+}
+
+//compression requested by the client capability flags,
+//zlib wins when both flags are set (as in libmysqlclient)
+func CompressionOf(capability uint32) int {
+	switch {
+	case capability&CLIENT_COMPRESS > 0:
+		return compressZlib
+	case capability&CLIENT_ZSTD_COMPRESSION_ALGORITHM > 0:
+		return compressZstd
+	}
+	return compressNone
+}
+
+//framing is the frame layout of a connection, shared by the
+//reader goroutines of both directions. Frames are plain until
+//the server accepts the auth, then compressed if negotiated
+type framing struct {
+	mu        sync.Mutex
+	handshake bool
+	algorithm int
+	active    bool
+}
+
+//the frames of a connection whose stream was flushed idle
+func (f *framing) resume(idle *framing) {
+	idle.mu.Lock()
+	defer idle.mu.Unlock()
+	f.handshake = idle.handshake
+	f.algorithm = idle.algorithm
+	f.active    = idle.active
+}
+
+//follow the handshake from the plain frames of either direction
+func (f *framing) observe(isClient bool, seq uint8, payload []byte) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case !isClient && IsServerGreeting(payload, int(seq)):
+		f.handshake = true
+		f.algorithm = compressNone
+		f.active    = false
+	case !f.handshake || len(payload) == 0:
+	case isClient && (seq == 1 || seq == 2):
+		//after a SSLRequest the response follows over TLS
+		r, err := ParseHandshakeResponse(payload)
+		if err != nil {
+			f.handshake = false
+			return
+		}
+		if !r.SSLRequest {
+			f.algorithm = CompressionOf(r.Capability)
+		}
+	case !isClient && (payload[0] == 0x00 || payload[0] == 0xff):
+		f.handshake = false
+		f.active    = payload[0] == 0x00 && f.algorithm != compressNone
+	}
+}
+
+func (f *framing) compression() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.active {
+		return compressNone
+	}
+	return f.algorithm
+}
+
+//a compressed frame may hold several packets,
+//and a packet may span several frames
+func (pr *packetReader) nextInflated(w *bytes.Buffer) (uint8, int, error) {
+
+	for {
+		if b := pr.inflated.Bytes(); len(b) >= 4 {
+			length := int(uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16)
+			if len(b) >= 4+length {
+				seq := b[3]
+				w.Write(b[4 : 4+pr.room(w, length)])
+				pr.inflated.Next(4 + length)
+				return seq, length, nil
+			}
+		}
+
+		header := make([]byte, 4)
+		if err := pr.readHeader(header); err != nil {
+			return 0, 0, err
+		}
+		if err := pr.readFrame(header); err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+//read the rest of a compressed frame and inflate it:
+//compressed length(3), compressed sequence(1), uncompressed length(3).
+//An uncompressed length of 0 means the payload is stored as is
+func (pr *packetReader) readFrame(header []byte) error {
+
+	rest := make([]byte, 3)
+	if _, err := io.ReadFull(pr.r, rest); err != nil {
+		return errUnknownStream
+	}
+	length := int64(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+	size   := int64(uint32(rest[0]) | uint32(rest[1])<<8 | uint32(rest[2])<<16)
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(pr.r, payload); err != nil {
+		return errUnknownStream
+	}
+	if size == 0 {
+		pr.inflated.Write(payload)
+		return nil
+	}
+
+	if pr.compress == compressZstd {
+		if pr.zstd == nil {
+			d, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return err
+			}
+			pr.zstd = d
+		}
+		out, err := pr.zstd.DecodeAll(payload, make([]byte, 0, size))
+		if err != nil {
+			return err
+		}
+		pr.inflated.Write(out)
+		return nil
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	if _, err := io.CopyN(&pr.inflated, zr, size); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (pr *packetReader) close() {
+	if pr.zstd != nil {
+		pr.zstd.Close()
+	}
+}
@@ -4,7 +4,10 @@ const (
 	ComQueryRequestPacket string     = "【Query】"
 	OkPacket string                  = "【Ok】"
 	ErrorPacket string               = "【Err】"
+	ResultSetPacket string           = "【Result】"
+	TruncatedPacket string           = "【Truncated】"
 	PreparePacket string             = "【Pretreatment】"
+	ExecutePacket string             = "【Execute】"
 	SendClientHandshakePacket string = "【User Auth】"
 	SendServerHandshakePacket string = "【Login】"
 )
@@ -62,6 +65,9 @@ const (
 	MYSQL_TYPE_NEWDATE      = 14
 	MYSQL_TYPE_VARCHAR      = 15
 	MYSQL_TYPE_BIT          = 16
+	MYSQL_TYPE_TIMESTAMP2   = 17
+	MYSQL_TYPE_DATETIME2    = 18
+	MYSQL_TYPE_TIME2        = 19
 )
 
 const (
@@ -77,3 +83,34 @@ const (
 	MYSQL_TYPE_STRING
 	MYSQL_TYPE_GEOMETRY
 )
+
+const (
+	CLIENT_LONG_PASSWORD uint32 = 1 << iota
+	CLIENT_FOUND_ROWS
+	CLIENT_LONG_FLAG
+	CLIENT_CONNECT_WITH_DB
+	CLIENT_NO_SCHEMA
+	CLIENT_COMPRESS
+	CLIENT_ODBC
+	CLIENT_LOCAL_FILES
+	CLIENT_IGNORE_SPACE
+	CLIENT_PROTOCOL_41
+	CLIENT_INTERACTIVE
+	CLIENT_SSL
+	CLIENT_IGNORE_SIGPIPE
+	CLIENT_TRANSACTIONS
+	CLIENT_RESERVED
+	CLIENT_SECURE_CONNECTION
+	CLIENT_MULTI_STATEMENTS
+	CLIENT_MULTI_RESULTS
+	CLIENT_PS_MULTI_RESULTS
+	CLIENT_PLUGIN_AUTH
+	CLIENT_CONNECT_ATTRS
+	CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA
+	CLIENT_CAN_HANDLE_EXPIRED_PASSWORDS
+	CLIENT_SESSION_TRACK
+	CLIENT_DEPRECATE_EOF
+	CLIENT_OPTIONAL_RESULTSET_METADATA
+	CLIENT_ZSTD_COMPRESSION_ALGORITHM
+	CLIENT_QUERY_ATTRIBUTES
+)
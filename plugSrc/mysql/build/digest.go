@@ -0,0 +1,357 @@
+package build
+
+import (
+	"fmt"
+	"github.com/40t/go-sniffer/core/event"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDigestTop = 20
+
+	//latencies kept per fingerprint for the p95
+	digestSamples = 1024
+)
+
+//Digest groups queries by fingerprint instead of printing them,
+//and reports the top ones by total time, like pt-query-digest.
+//It is the emitter of the streams in digest mode
+type Digest struct {
+	mu       sync.Mutex
+	interval event.Interval
+	top      int
+	out      event.Emitter
+	queries  map[string]*queryStats
+}
+
+type queryStats struct {
+	fingerprint string
+	sample      string
+	count       int
+	errors      int
+	rows        int64
+	affected    int64
+	total       time.Duration
+	max         time.Duration
+	latencies   []time.Duration
+}
+
+func NewDigest(interval time.Duration, top int) *Digest {
+	return &Digest{
+		interval: event.Interval{Every: interval},
+		top:      top,
+		queries:  make(map[string]*queryStats),
+	}
+}
+
+//report to out
+func (d *Digest) SetOutput(out event.Emitter) {
+	d.mu.Lock()
+	d.out = out
+	d.mu.Unlock()
+}
+
+//add a query event, other events are dropped
+func (d *Digest) Emit(e *event.Event) {
+
+	if e.Direction != event.Request || (e.Operation != "Query" && e.Operation != "Execute") {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	due := d.interval.Add(e.Time)
+	fp := Fingerprint(e.Statement)
+	q, ok := d.queries[fp]
+	if !ok {
+		q = &queryStats{
+			fingerprint: fp,
+			sample:      e.Statement,
+		}
+		d.queries[fp] = q
+	}
+	q.add(e)
+	if due {
+		d.report()
+	}
+}
+
+//report on the wall clock, for a quiet live capture
+func (d *Digest) Tick(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.interval.Due(now) {
+		d.report()
+	}
+}
+
+//report what is left, when the capture ends
+func (d *Digest) Flush() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.report()
+}
+
+func (q *queryStats) add(e *event.Event) {
+
+	q.count++
+	if e.Status == "ERR" {
+		q.errors++
+	}
+	if rows, ok := e.Attrs["rows"].(int); ok {
+		q.rows += int64(rows)
+	}
+	if rows, ok := e.Attrs["affected_rows"].(int); ok {
+		q.affected += int64(rows)
+	}
+
+	q.total += e.Latency
+	if e.Latency > q.max {
+		q.max = e.Latency
+	}
+
+	//reservoir sampling keeps the p95 in bounded memory
+	if len(q.latencies) < digestSamples {
+		q.latencies = append(q.latencies, e.Latency)
+	} else if i := rand.Intn(q.count); i < digestSamples {
+		q.latencies[i] = e.Latency
+	}
+}
+
+func (q *queryStats) p95() time.Duration {
+	if len(q.latencies) == 0 {
+		return 0
+	}
+	l := make([]time.Duration, len(q.latencies))
+	copy(l, q.latencies)
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	return l[(len(l)*95+99)/100-1]
+}
+
+//emit one event per fingerprint, by total time,
+//the first one also carries the header of the table
+func (d *Digest) report() {
+
+	if d.interval.Count == 0 || d.out == nil {
+		return
+	}
+
+	list := make([]*queryStats, 0, len(d.queries))
+	for _, q := range d.queries {
+		list = append(list, q)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].total != list[j].total {
+			return list[i].total > list[j].total
+		}
+		return list[i].count > list[j].count
+	})
+	if d.top > 0 && len(list) > d.top {
+		list = list[:d.top]
+	}
+
+	header := fmt.Sprintf("# Digest %s - %s, %d queries, %d fingerprints\n",
+		d.interval.Start.Format("2006-01-02 15:04:05"), d.interval.Last.Format("2006-01-02 15:04:05"), d.interval.Count, len(d.queries)) +
+		fmt.Sprintf("# %4s %8s %11s %9s %9s %9s %9s %9s %6s  %s\n",
+			"Rank", "Count", "Total(ms)", "Avg(ms)", "P95(ms)", "Max(ms)", "Rows", "Affected", "Errors", "Fingerprint")
+
+	for i, q := range list {
+
+		avg := q.total / time.Duration(q.count)
+		e := &event.Event{
+			Time:      d.interval.Last,
+			Protocol:  Protocol,
+			Operation: "Digest",
+			Statement: q.fingerprint,
+			Latency:   q.total,
+		}
+		e.Set("rank", i+1).
+			Set("count", q.count).
+			Set("total_ms", ms(q.total)).
+			Set("avg_ms", ms(avg)).
+			Set("p95_ms", ms(q.p95())).
+			Set("max_ms", ms(q.max)).
+			Set("rows", q.rows).
+			Set("affected_rows", q.affected).
+			Set("errors", q.errors).
+			Set("sample", q.sample).
+			Set("from", d.interval.Start).
+			Set("to", d.interval.Last)
+
+		e.Text = fmt.Sprintf("  %4d %8d %11.3f %9.3f %9.3f %9.3f %9d %9d %6d  %s",
+			i+1, q.count, ms(q.total), ms(avg), ms(q.p95()), ms(q.max), q.rows, q.affected, q.errors, q.fingerprint)
+		if i == 0 {
+			e.Text = header + e.Text
+		}
+		d.out.Emit(e)
+	}
+
+	d.interval.Reset()
+	d.queries = make(map[string]*queryStats)
+}
+
+func ms(t time.Duration) float64 {
+	return float64(t) / float64(time.Millisecond)
+}
+
+var (
+	inListRe  = regexp.MustCompile(`\bin ?\( ?\?(?: ?, ?\?)* ?\)`)
+	valuesRe  = regexp.MustCompile(`\bvalues ?\( ?\?(?: ?, ?\?)* ?\)(?: ?, ?\( ?\?(?: ?, ?\?)* ?\))*`)
+	limitRe   = regexp.MustCompile(`\blimit \?(?: ?, ?\?| offset \?)?`)
+)
+
+//Fingerprint normalises a query: comments and extra whitespace
+//are stripped, literals become ?, IN lists, multi-row VALUES and
+//LIMIT offsets are collapsed, and the rest is lower case.
+//The statements of executable comments /*!40101 ... */ are kept
+func Fingerprint(query string) string {
+
+	var b strings.Builder
+	space := false
+	write := func(s string) {
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteString(s)
+	}
+
+	q := query
+	executable := false
+	for i := 0; i < len(q); {
+
+		c := q[i]
+		switch {
+
+		//whitespace
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = true
+			i++
+
+		//comments
+		case c == '#' || (c == '-' && strings.HasPrefix(q[i:], "-- ")):
+			end := strings.IndexByte(q[i:], '\n')
+			if end < 0 {
+				end = len(q) - i
+			}
+			space = true
+			i += end
+		case c == '/' && strings.HasPrefix(q[i:], "/*!"):
+			i += 3
+			for i < len(q) && isDigit(q[i]) {
+				i++
+			}
+			space = true
+			executable = true
+		case c == '*' && executable && strings.HasPrefix(q[i:], "*/"):
+			i += 2
+			space = true
+			executable = false
+		case c == '/' && strings.HasPrefix(q[i:], "/*"):
+			end := strings.Index(q[i+2:], "*/")
+			if end < 0 {
+				end = len(q) - i - 4
+			}
+			space = true
+			i += end + 4
+
+		//string literals
+		case c == '\'' || c == '"':
+			i += quotedLength(q[i:])
+			write("?")
+
+		//quoted identifiers are kept
+		case c == '`':
+			n := quotedLength(q[i:])
+			write(q[i : i+n])
+			i += n
+
+		//numbers, but not inside identifiers like t1
+		case isDigit(c) || (c == '.' && i+1 < len(q) && isDigit(q[i+1])):
+			n := numberLength(q[i:])
+			write("?")
+			i += n
+
+		case isIdentChar(c):
+			n := 1
+			for i+n < len(q) && isIdentChar(q[i+n]) {
+				n++
+			}
+			write(strings.ToLower(q[i : i+n]))
+			i += n
+
+		default:
+			write(string(c))
+			i++
+		}
+	}
+
+	fp := strings.TrimRight(b.String(), "; ")
+	fp = inListRe.ReplaceAllString(fp, "in(?+)")
+	fp = valuesRe.ReplaceAllString(fp, "values(?+)")
+	fp = limitRe.ReplaceAllString(fp, "limit ?")
+	return fp
+}
+
+//length of a quoted string, with backslash
+//escapes and doubled quotes
+func quotedLength(s string) int {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+		case quote:
+			if i+1 < len(s) && s[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+//decimal, float with exponent, 0x hex and 0b bit literals
+func numberLength(s string) int {
+	if len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X' || s[1] == 'b' || s[1] == 'B') {
+		n := 2
+		for n < len(s) && isIdentChar(s[n]) {
+			n++
+		}
+		return n
+	}
+	n := 0
+	for n < len(s) && (isDigit(s[n]) || s[n] == '.') {
+		n++
+	}
+	if n < len(s) && (s[n] == 'e' || s[n] == 'E') {
+		m := n + 1
+		if m < len(s) && (s[m] == '+' || s[m] == '-') {
+			m++
+		}
+		if m < len(s) && isDigit(s[m]) {
+			n = m
+			for n < len(s) && isDigit(s[n]) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
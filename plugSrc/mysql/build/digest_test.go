@@ -0,0 +1,80 @@
+package build
+
+import (
+	"github.com/40t/go-sniffer/core/event"
+	"testing"
+	"time"
+)
+
+func TestFingerprint(t *testing.T) {
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		//IN lists
+		{"SELECT * FROM t WHERE id IN (1, 2, 3)", "select * from t where id in(?+)"},
+		{"select * from t where id in ('a','b') and x in (1)", "select * from t where id in(?+) and x in(?+)"},
+
+		//multi-row VALUES
+		{"INSERT INTO t (a,b) VALUES (1,'x'),(2,'y'),(3, 'z')", "insert into t (a,b) values(?+)"},
+		{"insert into t values(1,2)", "insert into t values(?+)"},
+		{"REPLACE INTO t VALUES (1), (2)", "replace into t values(?+)"},
+
+		//comments
+		{"SELECT /* comment */ a FROM t -- trailing\nWHERE b = 1", "select a from t where b = ?"},
+		{"select a from t # hash comment\n where b=1", "select a from t where b=?"},
+		{"/*!40101 SET NAMES utf8 */", "set names utf8"},
+		{"SELECT /*!STRAIGHT_JOIN */ a FROM t", "select straight_join a from t"},
+
+		//quoted escapes
+		{"SELECT a FROM t WHERE b = 'it''s' AND c = \"q\\\"x\"", "select a from t where b = ? and c = ?"},
+		{"select `col 1` from `db`.`t` where x = 'a\\'b';", "select `col 1` from `db`.`t` where x = ?"},
+		{"SELECT 'a\\\\' , 'b'", "select ? , ?"},
+
+		//numbers, not in identifiers
+		{"SELECT a FROM t1 WHERE c2 = 0x1F AND c3 = 1.5e10 AND c4=.5", "select a from t1 where c2 = ? and c3 = ? and c4=?"},
+		{"SELECT * FROM t LIMIT 10, 20", "select * from t limit ?"},
+		{"SELECT * FROM t LIMIT 10 OFFSET 20", "select * from t limit ?"},
+
+		//whitespace and trailing ;
+		{"SELECT   a\n\tFROM   t  WHERE  b  =  1 ;  ", "select a from t where b = ?"},
+	}
+
+	for _, tt := range tests {
+		if got := Fingerprint(tt.query); got != tt.want {
+			t.Errorf("Fingerprint(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestDigestTick(t *testing.T) {
+
+	var reports []*event.Event
+	d := NewDigest(10*time.Second, 0)
+	d.SetOutput(event.EmitterFunc(func(e *event.Event) { reports = append(reports, e) }))
+
+	start := time.Date(2026, 10, 18, 15, 4, 5, 0, time.UTC)
+	d.Emit(&event.Event{
+		Time:      start,
+		Direction: event.Request,
+		Operation: "Query",
+		Statement: "select 1",
+	})
+
+	//a quiet live capture is reported on the wall clock
+	d.Tick(start.Add(5 * time.Second))
+	if len(reports) != 0 {
+		t.Fatalf("reported before the interval: %d", len(reports))
+	}
+	d.Tick(start.Add(10 * time.Second))
+	if len(reports) != 1 || reports[0].Statement != "select ?" {
+		t.Fatalf("reports after the interval: %v", reports)
+	}
+
+	//nothing left for the next one
+	d.Tick(start.Add(30 * time.Second))
+	if len(reports) != 1 {
+		t.Errorf("empty report: %d", len(reports))
+	}
+}
@@ -1,10 +1,10 @@
 package build
 
 import (
+	"github.com/40t/go-sniffer/core/event"
 	"github.com/google/gopacket"
 	"io"
 	"bytes"
-	"errors"
 	"log"
 	"strconv"
 	"sync"
@@ -19,17 +19,120 @@ const (
 	Port              = 3306
 	Version           = "0.1"
 	CmdPort           = "-p"
+	CmdRows           = "-rows"
+	CmdRowsSize       = "-rows-size"
+	CmdMaxPacket      = "-max-packet"
+	CmdDigest         = "-digest"
+	CmdDigestTop      = "-digest-top"
+	CmdStmt           = "-stmt"
+	CmdAudit          = "-audit"
+	Protocol          = "mysql"
+)
+
+const (
+	DefaultRowsSize   = 1024
+	DefaultMaxPacket  = 64
+)
+
+//-stmt, how executed prepared statements are printed
+const (
+	StmtScript        = "script"
+	StmtSQL           = "sql"
 )
 
 type Mysql struct {
 	port       int
 	version    string
 	source     map[string]*stream
+	mu         sync.Mutex
+
+	//streams flushed while idle, as the connections of a pool,
+	//their session goes on in the next stream of the connection
+	idle       map[string]*stream
+
+	//rows of result set to print, and their size cap in bytes
+	sampleRows int
+	sampleSize int
+
+	//size cap of a packet in bytes, larger ones are truncated
+	maxPacket  int
+
+	//digest mode, queries are aggregated instead of printed
+	digest     *Digest
+	digestTop  int
+
+	//-stmt
+	stmtFormat string
+
+	//audit mode, sessions are written as audit records
+	audit      *Audit
 }
 
 type stream struct {
 	packets chan *packet
 	stmtMap map[uint32]*Stmt
+	flows   int
+	done    chan bool
+
+	emit    event.Emitter
+	client  string
+	server  string
+
+	//original size of the packet being resolved, if truncated
+	truncated int
+
+	//capture time of the last packet
+	last    time.Time
+
+	//closed by the client or the server, not flushed idle
+	closed  bool
+
+	//login of a TLS session, until it is read decrypted
+	sslLogin *event.Event
+
+	//request waiting for its response
+	pending *event.Event
+	resp    response
+	command byte
+
+	//result set being read
+	result  *ResultSet
+
+	//packets left of the definitions after a PREPARE_OK
+	prepareDefs int
+
+	//statement of the last execute or fetch
+	stmt    *Stmt
+	deprecateEOF bool
+
+	//replication stream after COM_BINLOG_DUMP
+	binlog  *binlogStream
+
+	//frame layout, shared by both readers
+	framing       framing
+
+	//session, from the handshake
+	phase         int
+	ssl           bool
+	capability    uint32
+	connectionID  uint32
+	serverVersion string
+	user          string
+	schema        string
+	program       string
+}
+
+//response of the pending request, it may span
+//several result sets with SERVER_MORE_RESULTS_EXISTS
+type response struct {
+	replies    []string
+	bytes      int
+	truncated  bool
+	resultSets int
+	rows       int
+	columns    []string
+	sample     [][]interface{}
+	sampleText string
 }
 
 type packet struct {
@@ -37,6 +140,8 @@ type packet struct {
 	seq        int
 	length     int
 	payload   []byte
+	seen       time.Time
+	truncated  bool
 }
 
 var mysql *Mysql
@@ -48,41 +153,93 @@ func NewInstance() *Mysql {
 			port   :Port,
 			version:Version,
 			source: make(map[string]*stream),
+			idle:   make(map[string]*stream),
+			sampleSize:DefaultRowsSize,
+			maxPacket:DefaultMaxPacket << 20,
+			digestTop:DefaultDigestTop,
+			stmtFormat:StmtScript,
 		}
 	})
 
 	return mysql
 }
 
-func (m *Mysql) ResolveStream(net, transport gopacket.Flow, buf io.Reader) {
+func (m *Mysql) ResolveStream(net, transport gopacket.Flow, buf io.Reader, emit event.Emitter) {
 
 	//uuid
 	uuid := fmt.Sprintf("%v:%v", net.FastHash(), transport.FastHash())
 
+	//digest mode
+	if m.digest != nil {
+		m.digest.SetOutput(emit)
+		emit = m.digest
+	}
+
+	//audit mode
+	if m.audit != nil {
+		m.audit.SetOutput(emit)
+		emit = m.audit
+	}
+
 	//generate resolve's stream
-	if _, ok := m.source[uuid]; !ok {
+	m.mu.Lock()
+	stm, ok := m.source[uuid]
+	if !ok {
 
-		var newStream = stream{
+		stm = &stream{
 			packets:make(chan *packet, 100),
 			stmtMap:make(map[uint32]*Stmt),
+			done:   make(chan bool),
+			emit:   emit,
+		}
+		stm.client, stm.server = event.Endpoints(net, transport, m.port)
+
+		//the readers of the idle stream are done, its frames are known
+		idle := m.idle[uuid]
+		if idle != nil {
+			delete(m.idle, uuid)
+			stm.framing.resume(&idle.framing)
 		}
 
-		m.source[uuid] = &newStream
-		go newStream.resolve()
+		m.source[uuid] = stm
+		go stm.resolve(idle)
 	}
+	stm.flows++
+	m.mu.Unlock()
 
 	//read bi-directional packet
 	//server -> client || client -> server
+	pr := newPacketReader(buf, transport.Src().String() != strconv.Itoa(m.port), &stm.framing, m.maxPacket)
+	defer pr.close()
 	for {
 
-		newPacket := m.newPacket(net, transport, buf)
+		newPacket := m.newPacket(net, transport, pr)
 
 		if newPacket == nil {
-			return
+			break
 		}
 
-		m.source[uuid].packets <- newPacket
+		stm.packets <- newPacket
+	}
+
+	//both directions closed, wait for pending packets
+	m.mu.Lock()
+	if event.Closed(buf) {
+		stm.closed = true
+	}
+	stm.flows--
+	if stm.flows > 0 {
+		m.mu.Unlock()
+		return
 	}
+	delete(m.source, uuid)
+	if !stm.closed {
+		m.idle[uuid] = stm
+	}
+	m.mu.Unlock()
+
+	close(stm.packets)
+	<-stm.done
 }
 
 func (m *Mysql) BPFFilter() string {
@@ -119,238 +276,605 @@ func (m *Mysql) SetFlag(flg []string)  {
 				panic("ERR : port(0-65535)")
 			}
 			break
+		case CmdRows:
+			rows, err := strconv.Atoi(val)
+			if err != nil || rows < 0 {
+				panic("ERR : rows")
+			}
+			m.sampleRows = rows
+		case CmdRowsSize:
+			size, err := strconv.Atoi(val)
+			if err != nil || size < 0 {
+				panic("ERR : rows-size")
+			}
+			m.sampleSize = size
+		case CmdMaxPacket:
+			size, err := strconv.Atoi(val)
+			if err != nil || size < 0 {
+				panic("ERR : max-packet")
+			}
+			m.maxPacket = size << 20
+		case CmdDigest:
+			interval, err := strconv.Atoi(val)
+			if err != nil || interval < 0 {
+				panic("ERR : digest")
+			}
+			m.digest = NewDigest(time.Duration(interval) * time.Second, m.digestTop)
+		case CmdDigestTop:
+			top, err := strconv.Atoi(val)
+			if err != nil || top < 0 {
+				panic("ERR : digest-top")
+			}
+			m.digestTop = top
+		case CmdStmt:
+			if val != StmtScript && val != StmtSQL {
+				panic("ERR : stmt (script, sql)")
+			}
+			m.stmtFormat = val
+		case CmdAudit:
+			if val != AuditPercona && val != AuditEnterprise {
+				panic("ERR : audit (percona, enterprise)")
+			}
+			m.audit = NewAudit(val)
 		default:
 			panic("ERR : mysql's params")
 		}
 	}
+	if m.digest != nil {
+		m.digest.top = m.digestTop
+	}
+	if m.digest != nil && m.audit != nil {
+		panic("ERR : digest and audit can not be used together")
+	}
 }
 
-func (m *Mysql) newPacket(net, transport gopacket.Flow, r io.Reader) *packet {
+//report the digest, and close the audit sessions
+//still open when the capture ends
+func (m *Mysql) Flush(emit event.Emitter) {
+	if m.digest != nil {
+		m.digest.SetOutput(emit)
+		m.digest.Flush()
+	}
+	if m.audit != nil {
+		m.audit.SetOutput(emit)
+		m.audit.Close()
+	}
+	m.mu.Lock()
+	m.idle = make(map[string]*stream)
+	m.mu.Unlock()
+}
+
+//report the digest every interval of a live capture
+func (m *Mysql) Tick(now time.Time, emit event.Emitter) {
+	if m.digest != nil {
+		m.digest.SetOutput(emit)
+		m.digest.Tick(now)
+	}
+}
+
+func (m *Mysql) newPacket(net, transport gopacket.Flow, pr *packetReader) *packet {
 
 	//read packet
 	var payload bytes.Buffer
 	var seq uint8
+	var length int
 	var err error
-	if seq, err = m.resolvePacketTo(r, &payload); err != nil {
+	if seq, length, err = pr.next(&payload); err != nil {
 		return nil
 	}
 
 	//close stream
 	if err == io.EOF {
-		fmt.Println(net, transport, " close")
+		fmt.Fprintln(os.Stderr, net, transport, " close")
 		return nil
 	} else if err != nil {
-		fmt.Println("ERR : Unknown stream", net, transport, ":", err)
+		fmt.Fprintln(os.Stderr, "ERR : Unknown stream", net, transport, ":", err)
 	}
 
 	//generate new packet
 	var pk = packet{
 		seq: int(seq),
-		length:payload.Len(),
+		length:length,
+		truncated:length > payload.Len(),
 		payload:payload.Bytes(),
-	}
-	if transport.Src().String() == strconv.Itoa(m.port) {
-		pk.isClientFlow = false
-	}else{
-		pk.isClientFlow = true
+		seen:event.Seen(pr.r),
+		isClientFlow:pr.isClient,
 	}
 
 	return &pk
 }
 
-func (m *Mysql) resolvePacketTo(r io.Reader, w io.Writer) (uint8, error) {
-
-	header := make([]byte, 4)
-	if n, err := io.ReadFull(r, header); err != nil {
-		if n == 0 && err == io.EOF {
-			return 0, io.EOF
+func (stm *stream) resolve(idle *stream) {
+	if idle != nil {
+		<-idle.done
+		stm.resume(idle)
+	}
+	for packet := range stm.packets {
+		if packet.length != 0 {
+			stm.resolvePacket(packet)
 		}
-		return 0, errors.New("ERR : Unknown stream")
 	}
 
-	length := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
-
-	var seq uint8
-	seq = header[3]
-
-	if n, err := io.CopyN(w, r, int64(length)); err != nil {
-		return 0, errors.New("ERR : Unknown stream")
-	} else if n != int64(length) {
-		return 0, errors.New("ERR : Unknown stream")
-	} else {
-		return seq, nil
+	//the session went on encrypted, without the key log
+	if stm.sslLogin != nil {
+		stm.emit.Emit(stm.sslLogin)
+		stm.sslLogin = nil
 	}
+	stm.flushPending()
+
+	//audit mode records the end of the session, an idle
+	//stream goes on when the connection is used again
+	if mysql.audit != nil && stm.closed && !stm.last.IsZero() {
+		e := stm.newEvent(false, stm.last, 0)
+		e.Operation = "Disconnect"
+		stm.emit.Emit(e)
+	}
+	close(stm.done)
+}
 
-	return seq, nil
+//the session of a stream flushed idle
+func (stm *stream) resume(idle *stream) {
+	stm.last          = idle.last
+	stm.stmtMap       = idle.stmtMap
+	stm.deprecateEOF  = idle.deprecateEOF
+	stm.binlog        = idle.binlog
+	stm.phase         = idle.phase
+	stm.ssl           = idle.ssl
+	stm.capability    = idle.capability
+	stm.connectionID  = idle.connectionID
+	stm.serverVersion = idle.serverVersion
+	stm.user          = idle.user
+	stm.schema        = idle.schema
+	stm.program       = idle.program
 }
 
-func (stm *stream) resolve() {
-	for {
-		select {
-		case packet := <- stm.packets:
-			if packet.length != 0 {
-				if packet.isClientFlow {
-					stm.resolveClientPacket(packet.payload, packet.seq)
-				} else {
-					stm.resolveServerPacket(packet.payload, packet.seq)
-				}
-			}
+//a malformed packet must not stop the stream
+func (stm *stream) resolvePacket(packet *packet) {
+
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println("ERR : Resolve packet", err)
+			stm.result = nil
 		}
+	}()
+
+	stm.last      = packet.seen
+	stm.truncated = 0
+	if packet.truncated {
+		stm.truncated = packet.length
 	}
-}
 
-func (stm *stream) findStmtPacket (srv chan *packet, seq int) *packet {
-	for {
-		select {
-		case packet, ok := <- stm.packets:
-			if !ok {
-				return nil
-			}
-			if packet.seq == seq {
-				return packet
-			}
-		case <-time.After(5 * time.Second):
-			return nil
+	switch {
+	case IsServerGreeting(packet.payload, packet.seq) && !packet.isClientFlow:
+		stm.resolveServerGreeting(packet.payload, packet.seen)
+	case stm.phase == phaseReplication:
+		if !packet.isClientFlow {
+			stm.resolveBinlogPacket(packet.payload, packet.seen)
 		}
+	case stm.phase == phaseHandshake && packet.isClientFlow:
+		stm.resolveClientHandshake(packet.payload, packet.seen)
+	case stm.phase == phaseHandshake:
+		stm.resolveServerAuth(packet.payload, packet.seq, packet.seen)
+	case packet.isClientFlow:
+		stm.resolveClientPacket(packet.payload, packet.seq, packet.seen)
+	default:
+		stm.resolveServerPacket(packet.payload, packet.seq, packet.seen)
 	}
 }
 
-func (stm *stream) resolveServerPacket(payload []byte, seq int) {
+func (stm *stream) resolveServerPacket(payload []byte, seq int, seen time.Time) {
 
-	var msg = ""
+	var reply = ""
 	if len(payload) == 0 {
 		return
 	}
+
+	//definitions of the params and columns of a prepare
+	if stm.prepareDefs > 0 {
+		stm.prepareDefs--
+		return
+	}
+	size := stm.packetSize(payload)
+	if stm.pending != nil {
+		stm.resp.bytes += size
+		stm.resp.truncated = stm.resp.truncated || stm.truncated > 0
+	}
+
+	//packets of the result set being read
+	if stm.result != nil {
+		if payload[0] != 0xff {
+			stm.resolveResultSet(payload, seen)
+			return
+		}
+		stm.result = nil
+	}
+	if stm.resolveCommandResponse(payload, seen) {
+		return
+	}
+
+	var status uint16
+	e := stm.newEvent(false, seen, size)
 	switch payload[0] {
 
 		case 0xff:
+			if len(payload) < 3 {
+				return
+			}
 			errorCode  := int(binary.LittleEndian.Uint16(payload[1:3]))
-			errorMsg,_ := ReadStringFromByte(payload[4:])
+			sqlState   := ""
+			errorMsg   := ""
+			if len(payload) >= 9 && payload[3] == '#' {
+				sqlState    = string(payload[4:9])
+				errorMsg, _ = ReadStringFromByte(payload[9:])
+			} else {
+				errorMsg, _ = ReadStringFromByte(payload[3:])
+			}
 
-			msg = GetNowStr(false)+"%s Err code:%s,Err msg:%s"
-			msg  = fmt.Sprintf(msg, ErrorPacket, strconv.Itoa(errorCode), strings.TrimSpace(errorMsg))
+			reply = fmt.Sprintf("%s Err code:%s,Err msg:%s",
+				ErrorPacket, strconv.Itoa(errorCode), strings.TrimSpace(errorMsg))
+
+			e.Operation = "Err"
+			e.Status    = "ERR"
+			e.Error     = strings.TrimSpace(errorMsg)
+			e.Set("error_code", errorCode)
+			if sqlState != "" {
+				e.Set("sql_state", sqlState)
+			}
 
 		case 0x00:
 			var pos = 1
-			l,_,_ := LengthEncodedInt(payload[pos:])
+			l,_,n := LengthEncodedInt(payload[pos:])
 			affectedRows := int(l)
+			pos += n
+			insertId := uint64(0)
+			if pos < len(payload) {
+				insertId, _, _ = LengthEncodedInt(payload[pos:])
+			}
 
-			msg += GetNowStr(false)+"%s Effect Row:%s"
-			msg = fmt.Sprintf(msg, OkPacket, strconv.Itoa(affectedRows))
+			reply = fmt.Sprintf("%s Effect Row:%s", OkPacket, strconv.Itoa(affectedRows))
+			status = terminatorStatus(payload)
+
+			e.Operation = "Ok"
+			e.Status    = "OK"
+			e.Set("affected_rows", affectedRows)
+			if insertId > 0 {
+				e.Set("insert_id", insertId)
+			}
 
 		default:
+			//result set, starts with the column count
+			if stm.pending == nil {
+				return
+			}
+			columns,_,_ := LengthEncodedInt(payload)
+			stm.result = NewResultSet(int(columns), stm.command == COM_STMT_EXECUTE,
+				mysql.sampleRows, mysql.sampleSize)
 			return
 	}
 
-	fmt.Println(msg)
+	//response of the pending request
+	if stm.pending != nil {
+		stm.resp.replies = append(stm.resp.replies, reply)
+		if status&SERVER_MORE_RESULTS_EXISTS == 0 {
+			stm.completePending(e)
+		}
+		return
+	}
+
+	e.Text = GetNowStr(false, seen) + stm.session() + reply
+	stm.flagTruncated(e)
+	stm.emit.Emit(e)
 }
 
-func (stm *stream) resolveClientPacket(payload []byte, seq int) {
+func (stm *stream) resolveResultSet(payload []byte, seen time.Time) {
+
+	done, status, err := stm.result.Resolve(payload, stm.packetSize(payload), stm.deprecateEOF)
+	if err != nil {
+		log.Println("ERR : Result set", err)
+		stm.result = nil
+		return
+	}
+	if !done {
+		return
+	}
+
+	rs := stm.result
+	stm.result = nil
+
+	//columns of a cursor, for the fetches
+	if stm.command == COM_STMT_EXECUTE && stm.stmt != nil {
+		stm.stmt.Columns = rs.Columns
+	}
+	if stm.pending == nil {
+		return
+	}
+
+	reply := fmt.Sprintf("%s Columns:%s Rows:%d",
+		ResultSetPacket, strings.Join(rs.ColumnNames(), ","), rs.Rows)
+
+	stm.resp.replies = append(stm.resp.replies, reply)
+	stm.resp.resultSets++
+	stm.resp.rows += rs.Rows
+	if stm.resp.columns == nil {
+		stm.resp.columns = rs.ColumnNames()
+		stm.resp.sample  = rs.SampleValues()
+	}
+	stm.resp.sampleText += rs.WriteSampleToText()
+
+	if status&SERVER_MORE_RESULTS_EXISTS > 0 {
+		return
+	}
+
+	e := stm.newEvent(false, seen, stm.packetSize(payload))
+	e.Operation = "Result"
+	e.Status    = "OK"
+	if status&SERVER_STATUS_CURSOR_EXISTS > 0 {
+		e.Set("cursor_exists", true)
+	}
+	if status&SERVER_STATUS_LAST_ROW_SENT > 0 {
+		e.Set("last_row_sent", true)
+	}
+	stm.completePending(e)
+}
+
+//attach server response to the pending request,
+//latency is measured between capture timestamps
+func (stm *stream) completePending(resp *event.Event) {
+
+	req := stm.pending
+	stm.pending = nil
+
+	req.Latency = resp.Time.Sub(req.Time)
+	req.Status  = resp.Status
+	req.Error   = resp.Error
+	for k, v := range resp.Attrs {
+		req.Set(k, v)
+	}
+	req.Set("response_bytes", stm.resp.bytes)
+	if stm.resp.resultSets > 0 {
+		req.Set("columns", stm.resp.columns)
+		req.Set("rows", stm.resp.rows)
+		if len(stm.resp.sample) > 0 {
+			req.Set("sample", stm.resp.sample)
+		}
+	}
+
+	req.Text = strings.TrimRight(req.Text, "\n") + " " + strings.Join(stm.resp.replies, " ") +
+		fmt.Sprintf(" Time:%.3fms", float64(req.Latency) / float64(time.Millisecond))
+
+	//server packets over -max-packet
+	if stm.resp.truncated {
+		req.Set("response_truncated", true)
+		req.Text += " " + TruncatedPacket
+	}
+	req.Text += stm.resp.sampleText
+	stm.resp = response{}
+	stm.emit.Emit(req)
+}
+
+//emit request without response
+func (stm *stream) flushPending() {
+	if stm.pending != nil {
+		stm.emit.Emit(stm.pending)
+		stm.pending = nil
+	}
+	stm.resp   = response{}
+	stm.result = nil
+}
+
+func (stm *stream) resolveClientPacket(payload []byte, seq int, seen time.Time) {
 
 	var msg string
+	var fetch *ResultSet
+	stm.command = payload[0]
+	e := stm.newEvent(true, seen, len(payload))
+	session := stm.session()
 	switch payload[0] {
 
 	case COM_INIT_DB:
 
 		msg = fmt.Sprintf("USE %s;\n", payload[1:])
+		e.Operation = "Init DB"
+		e.Statement = string(payload[1:])
+		stm.schema  = string(payload[1:])
 	case COM_DROP_DB:
 
 		msg = fmt.Sprintf("Drop DB %s;\n", payload[1:])
+		e.Operation = "Drop DB"
+		e.Statement = string(payload[1:])
 	case COM_CREATE_DB, COM_QUERY:
 
-		statement := string(payload[1:])
-		msg = fmt.Sprintf("%s %s", ComQueryRequestPacket, statement)
-	case COM_STMT_PREPARE:
-
-		serverPacket := stm.findStmtPacket(stm.packets, seq+1)
-		if serverPacket == nil {
-			log.Println("ERR : Not found stm packet")
-			return
+		//query attributes (MySQL 8.0.23) in front of the text
+		text := payload[1:]
+		if payload[0] == COM_QUERY && stm.capability&CLIENT_QUERY_ATTRIBUTES > 0 {
+			attrs, n, err := ParseQueryAttributes(text)
+			if err != nil {
+				log.Println("ERR : Query attributes", err)
+				return
+			}
+			if len(attrs) > 0 {
+				e.Set("query_attributes", attrs)
+			}
+			text = text[n:]
 		}
 
-		//fetch stm id
-		stmtID := binary.LittleEndian.Uint32(serverPacket.payload[1:5])
-		stmt := &Stmt{
-			ID:    stmtID,
-			Query: string(payload[1:]),
+		statement := string(text)
+		msg = fmt.Sprintf("%s %s", ComQueryRequestPacket, statement)
+		e.Operation = "Query"
+		e.Statement = statement
+		if schema, ok := ParseUseStatement(statement); ok {
+			stm.schema = schema
 		}
+	case COM_STMT_PREPARE:
 
-		//record stm sql
-		stm.stmtMap[stmtID] = stmt
-		stmt.FieldCount = binary.LittleEndian.Uint16(serverPacket.payload[5:7])
-		stmt.ParamCount = binary.LittleEndian.Uint16(serverPacket.payload[7:9])
-		stmt.Args       = make([]interface{}, stmt.ParamCount)
-
-		msg = PreparePacket+stmt.Query
+		//the statement is registered by its PREPARE_OK
+		msg = PreparePacket + string(payload[1:])
+		e.Operation = "Prepare"
+		e.Statement = string(payload[1:])
 	case COM_STMT_SEND_LONG_DATA:
 
 		stmtID   := binary.LittleEndian.Uint32(payload[1:5])
 		paramId  := binary.LittleEndian.Uint16(payload[5:7])
-		stmt, _  := stm.stmtMap[stmtID]
-
-		if stmt.Args[paramId] == nil {
-			stmt.Args[paramId] = payload[7:]
-		} else {
-			if b, ok := stmt.Args[paramId].([]byte); ok {
-				b = append(b, payload[7:]...)
-				stmt.Args[paramId] = b
-			}
+		stmt, ok := stm.stmtMap[stmtID]
+		if !ok {
+			log.Println("ERR : Not found stm id", stmtID)
+			return
+		}
+		if err := stmt.SendLongData(paramId, payload[7:]); err != nil {
+			log.Println(err)
 		}
 		return
 	case COM_STMT_RESET:
 
 		stmtID := binary.LittleEndian.Uint32(payload[1:5])
-		stmt, _:= stm.stmtMap[stmtID]
-		stmt.Args = make([]interface{}, stmt.ParamCount)
-		return
+		msg = fmt.Sprintf("Reset stm id[%d];", stmtID)
+		e.Operation = "Reset"
+		e.Set("stmt_id", stmtID)
+		if stmt, ok := stm.stmtMap[stmtID]; ok {
+			stmt.Reset()
+			e.Statement = stmt.Query
+		} else {
+			e.Error = fmt.Sprintf("unknown stmt id %d", stmtID)
+		}
+	case COM_STMT_CLOSE:
+
+		stmtID := binary.LittleEndian.Uint32(payload[1:5])
+		msg = fmt.Sprintf("Drop stm id[%d];", stmtID)
+		e.Operation = "Close"
+		e.Set("stmt_id", stmtID)
+		if stmt, ok := stm.stmtMap[stmtID]; ok {
+			delete(stm.stmtMap, stmtID)
+			e.Statement = stmt.Query
+		} else {
+			e.Error = fmt.Sprintf("unknown stmt id %d", stmtID)
+		}
+	case COM_STMT_FETCH:
+
+		//stmt id(4), number of rows(4)
+		stmtID := binary.LittleEndian.Uint32(payload[1:5])
+		rows   := binary.LittleEndian.Uint32(payload[5:9])
+		msg = fmt.Sprintf("Fetch %d rows of stm id[%d];", rows, stmtID)
+		e.Operation = "Fetch"
+		e.Set("stmt_id", stmtID).Set("fetch_rows", rows)
+		if stmt, ok := stm.stmtMap[stmtID]; ok {
+			e.Statement = stmt.Query
+			stm.stmt    = stmt
+			if len(stmt.Columns) > 0 {
+				fetch = NewFetchResultSet(stmt.Columns, mysql.sampleRows, mysql.sampleSize)
+			}
+		} else {
+			e.Error = fmt.Sprintf("unknown stmt id %d", stmtID)
+		}
 	case COM_STMT_EXECUTE:
 
-		var pos = 1
-		stmtID := binary.LittleEndian.Uint32(payload[pos : pos+4])
-		pos += 4
-		var stmt *Stmt
-		var ok bool
-		if stmt, ok = stm.stmtMap[stmtID]; ok == false {
-			log.Println("ERR : Not found stm id", stmtID)
-			return
+		//stmt id(4), flags(1), iteration count(4)
+		stmtID := binary.LittleEndian.Uint32(payload[1:5])
+		flags  := payload[5]
+		e.Operation = "Execute"
+		e.Set("stmt_id", stmtID)
+		if cursor := CursorType(flags); cursor != "" {
+			e.Set("cursor", cursor)
+		}
+
+		stmt, ok := stm.stmtMap[stmtID]
+		if !ok {
+			msg = fmt.Sprintf("%s unknown stm id[%d]", ExecutePacket, stmtID)
+			e.Error = fmt.Sprintf("unknown stmt id %d", stmtID)
+			break
 		}
+		stm.stmt = stmt
 
 		//params
-		pos += 5
-		if stmt.ParamCount > 0 {
+		attrs, err := stmt.BindExecute(payload[10:], flags, stm.capability&CLIENT_QUERY_ATTRIBUTES > 0)
+		if err != nil {
+			log.Println("ERR : Could not bind params", err)
+		}
+		if len(attrs) > 0 {
+			e.Set("query_attributes", attrs)
+		}
 
-			//（Null-Bitmap，len = (paramsCount + 7) / 8 byte）
-			step := int((stmt.ParamCount + 7) / 8)
-			nullBitmap := payload[pos : pos+step]
-			pos += step
+		sql := stmt.WriteToSQL()
+		if mysql.stmtFormat == StmtSQL {
+			msg = fmt.Sprintf("%s %s", ExecutePacket, sql)
+		} else {
+			msg = string(stmt.WriteToText())
+		}
+		e.Statement = stmt.Query
+		e.Set("sql", sql)
+	default:
+		var ok bool
+		if msg, ok = stm.resolveCommand(payload, e); !ok {
+			return
+		}
+	}
 
-			//Parameter separator
-			flag := payload[pos]
+	e.Text = GetNowStr(true, seen) + session + msg
+	stm.flagTruncated(e)
 
-			pos++
+	//wait for server response
+	switch payload[0] {
+	case COM_INIT_DB, COM_DROP_DB, COM_CREATE_DB, COM_QUERY,
+		COM_STMT_PREPARE, COM_STMT_EXECUTE, COM_STMT_FETCH, COM_STMT_RESET,
+		COM_PING, COM_STATISTICS, COM_FIELD_LIST, COM_PROCESS_KILL, COM_CHANGE_USER,
+		COM_SET_OPTION, COM_RESET_CONNECTION, COM_REGISTER_SLAVE:
+		stm.flushPending()
+		stm.pending = e
+		stm.result  = fetch
+	default:
+		stm.emit.Emit(e)
+	}
+}
 
-			var pTypes  []byte
-			var pValues []byte
+//size of the packet being resolved, its
+//payload is cut when it is over -max-packet
+func (stm *stream) packetSize(payload []byte) int {
+	if stm.truncated > 0 {
+		return stm.truncated
+	}
+	return len(payload)
+}
 
-			//if flag == 1
-			//n （len = paramsCount * 2 byte）
-			if flag == 1 {
-				pTypes = payload[pos : pos+int(stmt.ParamCount)*2]
-				pos += int(stmt.ParamCount) * 2
-				pValues = payload[pos:]
-			}
+//packet over -max-packet
+func (stm *stream) flagTruncated(e *event.Event) {
+	if stm.truncated > 0 {
+		e.Bytes = stm.truncated
+		e.Set("truncated", true)
+		e.Text += fmt.Sprintf(" %s(%d bytes)", TruncatedPacket, stm.truncated)
+	}
+}
 
-			//bind params
-			err := stmt.BindArgs(nullBitmap, pTypes, pValues)
-			if err != nil {
-				log.Println("ERR : Could not bind params", err)
-			}
-		}
-		msg = string(stmt.WriteToText())
-	default:
-		return
+func (stm *stream) newEvent(isClient bool, seen time.Time, size int) *event.Event {
+
+	e := &event.Event{
+		Time:     seen,
+		Client:   stm.client,
+		Server:   stm.server,
+		Protocol: Protocol,
+		Bytes:    size,
+	}
+	if isClient {
+		e.Direction = event.Request
+	} else {
+		e.Direction = event.Response
+	}
+	if stm.user != "" {
+		e.Set("user", stm.user).Set("schema", stm.schema)
+	}
+	if stm.program != "" {
+		e.Set("program", stm.program)
 	}
+	if stm.connectionID > 0 {
+		e.Set("connection_id", stm.connectionID)
+	}
+	return e
+}
 
-	fmt.Println(GetNowStr(true) + msg)
+//[user@schema] of the connection, empty when
+//the handshake was not captured
+func (stm *stream) session() string {
+	if stm.user == "" {
+		return ""
+	}
+	return "[" + stm.user + "@" + stm.schema + "]"
 }
 
@@ -0,0 +1,319 @@
+package build
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+//connection phases, a stream joined after
+//the handshake starts in phaseCommand
+const (
+	phaseCommand = iota
+	phaseHandshake
+	phaseReplication
+)
+
+//Protocol::HandshakeV10
+type ServerGreeting struct {
+	ProtocolVersion byte
+	ServerVersion   string
+	ConnectionID    uint32
+	Capability      uint32
+	Charset         byte
+	Status          uint16
+	AuthPlugin      string
+}
+
+//Protocol::HandshakeResponse41 (or 320),
+//SSLRequest is a truncated response before TLS
+type HandshakeResponse struct {
+	Capability uint32
+	MaxPacket  uint32
+	Charset    byte
+	User       string
+	Database   string
+	AuthPlugin string
+	Attrs      map[string]string
+	SSLRequest bool
+}
+
+func IsServerGreeting(payload []byte, seq int) bool {
+	return seq == 0 && len(payload) > 1 && payload[0] == 0x0a
+}
+
+func ParseServerGreeting(b []byte) (*ServerGreeting, error) {
+
+	if len(b) < 1 || b[0] != 0x0a {
+		return nil, errors.New("ERR : Unknown handshake protocol")
+	}
+	g := &ServerGreeting{
+		ProtocolVersion: b[0],
+	}
+
+	pos := 1
+	version, n := ReadStringFromByte(b[pos:])
+	g.ServerVersion = version
+	pos += n + 1
+
+	//connection id(4), auth data part 1(8), filler(1), capability lower(2)
+	if pos+4+8+1+2 > len(b) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	g.ConnectionID = binary.LittleEndian.Uint32(b[pos : pos+4])
+	pos += 4 + 8 + 1
+	g.Capability = uint32(binary.LittleEndian.Uint16(b[pos : pos+2]))
+	pos += 2
+
+	//charset(1), status(2), capability upper(2), auth data length(1), reserved(10)
+	if pos+1+2+2+1+10 > len(b) {
+		return g, nil
+	}
+	g.Charset = b[pos]
+	g.Status = binary.LittleEndian.Uint16(b[pos+1 : pos+3])
+	g.Capability |= uint32(binary.LittleEndian.Uint16(b[pos+3:pos+5])) << 16
+	authDataLen := int(b[pos+5])
+	pos += 1 + 2 + 2 + 1 + 10
+
+	//auth data part 2
+	if g.Capability&CLIENT_SECURE_CONNECTION > 0 {
+		part2 := authDataLen - 8
+		if part2 < 13 {
+			part2 = 13
+		}
+		pos += part2
+	}
+
+	if g.Capability&CLIENT_PLUGIN_AUTH > 0 && pos < len(b) {
+		g.AuthPlugin, _ = ReadStringFromByte(b[pos:])
+	}
+	return g, nil
+}
+
+func ParseHandshakeResponse(b []byte) (*HandshakeResponse, error) {
+
+	if len(b) < 2 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	r := &HandshakeResponse{}
+
+	//Protocol::HandshakeResponse320
+	if uint32(binary.LittleEndian.Uint16(b[0:2]))&CLIENT_PROTOCOL_41 == 0 {
+		if len(b) < 5 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		r.Capability = uint32(binary.LittleEndian.Uint16(b[0:2]))
+		r.MaxPacket = uint32(b[2]) | uint32(b[3])<<8 | uint32(b[4])<<16
+		r.User, _ = ReadStringFromByte(b[5:])
+		r.SSLRequest = r.Capability&CLIENT_SSL > 0 && len(b) == 5
+		return r, nil
+	}
+
+	//capability(4), max packet(4), charset(1), filler(23)
+	if len(b) < 32 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	r.Capability = binary.LittleEndian.Uint32(b[0:4])
+	r.MaxPacket = binary.LittleEndian.Uint32(b[4:8])
+	r.Charset = b[8]
+	if len(b) == 32 {
+		r.SSLRequest = r.Capability&CLIENT_SSL > 0
+		return r, nil
+	}
+	pos := 32
+
+	user, n := ReadStringFromByte(b[pos:])
+	r.User = user
+	pos += n + 1
+
+	//auth response
+	if pos >= len(b) {
+		return r, nil
+	}
+	switch {
+	case r.Capability&CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA > 0:
+		l, _, n := LengthEncodedInt(b[pos:])
+		if n == 0 {
+			return r, nil
+		}
+		pos += n + int(l)
+	case r.Capability&CLIENT_SECURE_CONNECTION > 0:
+		pos += 1 + int(b[pos])
+	default:
+		_, n := ReadStringFromByte(b[pos:])
+		pos += n + 1
+	}
+
+	if r.Capability&CLIENT_CONNECT_WITH_DB > 0 && pos < len(b) {
+		db, n := ReadStringFromByte(b[pos:])
+		r.Database = db
+		pos += n + 1
+	}
+
+	if r.Capability&CLIENT_PLUGIN_AUTH > 0 && pos < len(b) {
+		plugin, n := ReadStringFromByte(b[pos:])
+		r.AuthPlugin = plugin
+		pos += n + 1
+	}
+
+	if r.Capability&CLIENT_CONNECT_ATTRS > 0 && pos < len(b) {
+		r.Attrs = parseConnectAttrs(b[pos:])
+	}
+	return r, nil
+}
+
+//lenenc length, then key/value lenenc strings
+func parseConnectAttrs(b []byte) map[string]string {
+
+	attrs := make(map[string]string)
+	l, _, n := LengthEncodedInt(b)
+	if n == 0 {
+		return attrs
+	}
+	end := n + int(l)
+	if end > len(b) {
+		end = len(b)
+	}
+
+	pos := n
+	for pos < end {
+		key, _, n, err := LengthEncodedString(b[pos:end])
+		if err != nil {
+			break
+		}
+		pos += n
+		if pos >= end {
+			break
+		}
+		val, _, n, err := LengthEncodedString(b[pos:end])
+		if err != nil {
+			break
+		}
+		pos += n
+		attrs[string(key)] = string(val)
+	}
+	return attrs
+}
+
+//USE db, as sent by COM_QUERY
+func ParseUseStatement(query string) (string, bool) {
+	fields := strings.Fields(strings.TrimRight(strings.TrimSpace(query), ";"))
+	if len(fields) != 2 || !strings.EqualFold(fields[0], "use") {
+		return "", false
+	}
+	return strings.Trim(fields[1], "`"), true
+}
+
+func (stm *stream) resolveServerGreeting(payload []byte, seen time.Time) {
+
+	g, err := ParseServerGreeting(payload)
+	if err != nil {
+		log.Println("ERR : Server greeting", err)
+		return
+	}
+
+	stm.flushPending()
+	stm.phase         = phaseHandshake
+	stm.connectionID  = g.ConnectionID
+	stm.serverVersion = g.ServerVersion
+
+	e := stm.newEvent(false, seen, len(payload))
+	e.Operation = "Greeting"
+	e.Statement = g.ServerVersion
+	e.Set("server_version", g.ServerVersion)
+	e.Set("capability", g.Capability)
+	e.Set("auth_plugin", g.AuthPlugin)
+	e.Text = GetNowStr(false, seen) + fmt.Sprintf("%s version:%s connection id:%d auth:%s",
+		SendServerHandshakePacket, g.ServerVersion, g.ConnectionID, g.AuthPlugin)
+	stm.emit.Emit(e)
+}
+
+func (stm *stream) resolveClientHandshake(payload []byte, seen time.Time) {
+
+	//auth switch response, more auth data
+	if stm.pending != nil {
+		return
+	}
+
+	r, err := ParseHandshakeResponse(payload)
+	if err != nil {
+		log.Println("ERR : Handshake response", err)
+		stm.phase = phaseCommand
+		return
+	}
+	stm.capability   = r.Capability
+	stm.deprecateEOF = r.Capability&CLIENT_DEPRECATE_EOF > 0
+
+	e := stm.newEvent(true, seen, len(payload))
+	e.Operation = "Login"
+	e.Set("capability", r.Capability)
+
+	//the response is sent again over TLS, the core hands it
+	//over decrypted with --keylog, else the stream ends and
+	//the login is all there is of the session
+	if r.SSLRequest {
+		stm.ssl = true
+		e.Set("ssl", true)
+		e.Text = GetNowStr(true, seen) + SendClientHandshakePacket + " ssl"
+		stm.sslLogin = e
+		return
+	}
+	stm.sslLogin = nil
+	if stm.ssl {
+		e.Set("ssl", true)
+	}
+
+	stm.user   = r.User
+	stm.schema = r.Database
+	if name, ok := r.Attrs["program_name"]; ok {
+		stm.program = name
+	} else if name, ok := r.Attrs["_client_name"]; ok {
+		stm.program = name
+	}
+
+	e.Statement = r.User
+	e.Set("user", stm.user).Set("schema", stm.schema)
+	if stm.program != "" {
+		e.Set("program", stm.program)
+	}
+	if r.AuthPlugin != "" {
+		e.Set("auth_plugin", r.AuthPlugin)
+	}
+	if c, ok := compressNames[CompressionOf(r.Capability)]; ok {
+		e.Set("compress", c)
+	}
+	if len(r.Attrs) > 0 {
+		e.Set("connect_attrs", r.Attrs)
+	}
+	e.Text = GetNowStr(true, seen) + fmt.Sprintf("%s user:%s db:%s program:%s",
+		SendClientHandshakePacket, r.User, r.Database, stm.program)
+	if stm.ssl {
+		e.Text += " ssl"
+	}
+
+	//wait for auth result
+	stm.pending = e
+}
+
+func (stm *stream) resolveServerAuth(payload []byte, seq int, seen time.Time) {
+
+	if len(payload) == 0 {
+		return
+	}
+	switch payload[0] {
+	case 0x00, 0xff:
+		//auth result, commands follow
+		stm.phase = phaseCommand
+		stm.resolveServerPacket(payload, seq, seen)
+	case 0xfe:
+		//auth switch request
+		if stm.pending != nil && len(payload) > 1 {
+			plugin, _ := ReadStringFromByte(payload[1:])
+			stm.pending.Set("auth_plugin", plugin)
+		}
+	}
+}
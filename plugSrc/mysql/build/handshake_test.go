@@ -0,0 +1,226 @@
+package build
+
+import (
+	"encoding/binary"
+	"github.com/40t/go-sniffer/core/event"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//Protocol::HandshakeV10 of a server with TLS
+func serverGreeting(version string, id uint32) []byte {
+	b := append([]byte{0x0a}, version...)
+	b = append(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, id)
+	b = append(b, "01234567"...)
+	b = append(b, 0)
+	capability := uint32(CLIENT_PROTOCOL_41 | CLIENT_SSL | CLIENT_SECURE_CONNECTION | CLIENT_PLUGIN_AUTH)
+	b = binary.LittleEndian.AppendUint16(b, uint16(capability))
+	b = append(b, 0x21, 2, 0)
+	b = binary.LittleEndian.AppendUint16(b, uint16(capability>>16))
+	b = append(b, 21)
+	b = append(b, make([]byte, 10)...)
+	b = append(b, "89abcdefghij\x00"...)
+	return append(b, "caching_sha2_password\x00"...)
+}
+
+func TestSSLLogin(t *testing.T) {
+
+	var events []*event.Event
+	stm := &stream{
+		packets: make(chan *packet, 2),
+		done:    make(chan bool),
+		emit:    event.EmitterFunc(func(e *event.Event) { events = append(events, e) }),
+	}
+
+	//the SSLRequest, then the session goes on encrypted
+	seen := time.Date(2026, 10, 18, 15, 4, 5, 0, time.UTC)
+	greeting := serverGreeting("8.0.36", 7)
+	request := binary.LittleEndian.AppendUint32(nil, CLIENT_PROTOCOL_41|CLIENT_SSL|CLIENT_SECURE_CONNECTION)
+	request = append(request, make([]byte, 28)...)
+	stm.packets <- &packet{seq: 0, length: len(greeting), payload: greeting, seen: seen}
+	stm.packets <- &packet{seq: 1, length: len(request), payload: request, seen: seen, isClientFlow: true}
+	close(stm.packets)
+	stm.resolve(nil)
+
+	if len(events) != 2 || events[0].Operation != "Greeting" || events[1].Operation != "Login" {
+		t.Fatalf("events %v", events)
+	}
+	if events[1].Attrs["ssl"] != true || !events[1].Time.Equal(seen) {
+		t.Errorf("login %v", events[1].Attrs)
+	}
+}
+
+func TestParseServerGreeting(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		payload []byte
+		want    ServerGreeting
+		err     bool
+	}{
+		{"v10", serverGreeting("8.0.36", 7), ServerGreeting{
+			ProtocolVersion: 0x0a,
+			ServerVersion:   "8.0.36",
+			ConnectionID:    7,
+			Capability:      CLIENT_PROTOCOL_41 | CLIENT_SSL | CLIENT_SECURE_CONNECTION | CLIENT_PLUGIN_AUTH,
+			Charset:         0x21,
+			Status:          2,
+			AuthPlugin:      "caching_sha2_password",
+		}, false},
+		//pre-4.1 servers stop after the lower capability flags
+		{"short", serverGreeting("3.23.58", 1)[:27], ServerGreeting{
+			ProtocolVersion: 0x0a,
+			ServerVersion:   "3.23.58",
+			ConnectionID:    1,
+			Capability:      (CLIENT_PROTOCOL_41 | CLIENT_SSL | CLIENT_SECURE_CONNECTION) & 0xffff,
+		}, false},
+		{"truncated", serverGreeting("8.0.36", 7)[:12], ServerGreeting{}, true},
+		{"protocol 9", []byte{0x09, '5', 0}, ServerGreeting{}, true},
+	}
+
+	for _, tt := range tests {
+		g, err := ParseServerGreeting(tt.payload)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(*g, tt.want) {
+			t.Errorf("%s: %+v %v, want %+v", tt.name, g, err, tt.want)
+		}
+	}
+}
+
+//Protocol::HandshakeResponse41 of user, with the auth
+//response, database, auth plugin and attributes if set
+func handshakeResponse(capability uint32, user, db string) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, capability)
+	b = binary.LittleEndian.AppendUint32(b, 1<<24)
+	b = append(b, 0x21)
+	b = append(b, make([]byte, 23)...)
+	b = append(append(b, user...), 0)
+	b = append(b, 20)
+	b = append(b, "01234567890123456789"...)
+	if capability&CLIENT_CONNECT_WITH_DB > 0 {
+		b = append(append(b, db...), 0)
+	}
+	if capability&CLIENT_PLUGIN_AUTH > 0 {
+		b = append(b, "mysql_native_password\x00"...)
+	}
+	if capability&CLIENT_CONNECT_ATTRS > 0 {
+		b = append(b, 22, 12)
+		b = append(b, "_client_name"...)
+		b = append(b, 8)
+		b = append(b, "libmysql"...)
+	}
+	return b
+}
+
+func TestParseHandshakeResponse(t *testing.T) {
+
+	full := uint32(CLIENT_PROTOCOL_41 | CLIENT_SECURE_CONNECTION | CLIENT_CONNECT_WITH_DB | CLIENT_PLUGIN_AUTH | CLIENT_CONNECT_ATTRS)
+	lenenc := uint32(CLIENT_PROTOCOL_41 | CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA)
+	tests := []struct {
+		name    string
+		payload []byte
+		want    HandshakeResponse
+		err     bool
+	}{
+		{"41", handshakeResponse(full, "app", "shop"), HandshakeResponse{
+			Capability: full,
+			MaxPacket:  1 << 24,
+			Charset:    0x21,
+			User:       "app",
+			Database:   "shop",
+			AuthPlugin: "mysql_native_password",
+			Attrs:      map[string]string{"_client_name": "libmysql"},
+		}, false},
+		{"41 without database", handshakeResponse(CLIENT_PROTOCOL_41|CLIENT_SECURE_CONNECTION, "root", ""), HandshakeResponse{
+			Capability: CLIENT_PROTOCOL_41 | CLIENT_SECURE_CONNECTION,
+			MaxPacket:  1 << 24,
+			Charset:    0x21,
+			User:       "root",
+		}, false},
+		{"41 ssl request", handshakeResponse(CLIENT_PROTOCOL_41|CLIENT_SSL, "", "")[:32], HandshakeResponse{
+			Capability: CLIENT_PROTOCOL_41 | CLIENT_SSL,
+			MaxPacket:  1 << 24,
+			Charset:    0x21,
+			SSLRequest: true,
+		}, false},
+		{"320", []byte{0x03, 0x00, 0x00, 0x00, 0x01, 'o', 'l', 'd', 0, 'x', 0}, HandshakeResponse{
+			Capability: CLIENT_LONG_PASSWORD | CLIENT_FOUND_ROWS,
+			MaxPacket:  1 << 16,
+			User:       "old",
+		}, false},
+		{"320 ssl request", []byte{0x00, 0x08, 0x00, 0x00, 0x01}, HandshakeResponse{
+			Capability: CLIENT_SSL,
+			MaxPacket:  1 << 16,
+			SSLRequest: true,
+		}, false},
+		{"truncated", handshakeResponse(full, "app", "shop")[:20], HandshakeResponse{}, true},
+		//cut by -max-packet or a capture started mid-connection
+		{"truncated attrs", append(handshakeResponse(full, "app", "shop")[:84], 0xfc, 0x16), HandshakeResponse{
+			Capability: full,
+			MaxPacket:  1 << 24,
+			Charset:    0x21,
+			User:       "app",
+			Database:   "shop",
+			AuthPlugin: "mysql_native_password",
+			Attrs:      map[string]string{},
+		}, false},
+		{"truncated attr value", handshakeResponse(full, "app", "shop")[:103], HandshakeResponse{
+			Capability: full,
+			MaxPacket:  1 << 24,
+			Charset:    0x21,
+			User:       "app",
+			Database:   "shop",
+			AuthPlugin: "mysql_native_password",
+			Attrs:      map[string]string{},
+		}, false},
+		{"truncated auth response", append(handshakeResponse(lenenc, "app", "")[:36], 0xfd, 0x14), HandshakeResponse{
+			Capability: lenenc,
+			MaxPacket:  1 << 24,
+			Charset:    0x21,
+			User:       "app",
+		}, false},
+	}
+
+	for _, tt := range tests {
+		r, err := ParseHandshakeResponse(tt.payload)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(*r, tt.want) {
+			t.Errorf("%s: %+v %v, want %+v", tt.name, r, err, tt.want)
+		}
+	}
+}
+
+func TestParseUseStatement(t *testing.T) {
+
+	tests := []struct {
+		query string
+		db    string
+		ok    bool
+	}{
+		{"use shop", "shop", true},
+		{"  USE `my_db`;", "my_db", true},
+		{"use `shop` ;", "shop", true},
+		{"use", "", false},
+		{"select * from user", "", false},
+		{"use a b", "", false},
+	}
+
+	for _, tt := range tests {
+		db, ok := ParseUseStatement(tt.query)
+		if db != tt.db || ok != tt.ok {
+			t.Errorf("ParseUseStatement(%q) = %q %v, want %q %v", tt.query, db, ok, tt.db, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package build
+
+import (
+	"bytes"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"io"
+)
+
+//payloads of 16MB and more are split into frames of
+//maxFrameLength, the last one is shorter (maybe empty)
+const maxFrameLength = 0xffffff
+
+var errUnknownStream = errors.New("ERR : Unknown stream")
+
+//packetReader reads the logical packets of one direction,
+//unwrapping compressed frames once compression is on
+type packetReader struct {
+	r        io.Reader
+	isClient bool
+	framing  *framing
+
+	//bytes kept per packet, 0 is no limit
+	maxSize  int
+
+	compress int
+	inflated bytes.Buffer
+	zstd     *zstd.Decoder
+}
+
+func newPacketReader(r io.Reader, isClient bool, f *framing, maxSize int) *packetReader {
+	return &packetReader{
+		r:        r,
+		isClient: isClient,
+		framing:  f,
+		maxSize:  maxSize,
+	}
+}
+
+//read the next packet payload to w, joining the frames of a large
+//packet. Returns its sequence id and length, bytes over maxSize
+//are dropped (length is larger than what was written to w)
+func (pr *packetReader) next(w *bytes.Buffer) (seq uint8, total int, err error) {
+
+	for first := true; ; first = false {
+		s, length, err := pr.nextFrame(w)
+		if err != nil {
+			return 0, 0, err
+		}
+		if first {
+			seq = s
+		}
+		total += length
+		if length < maxFrameLength {
+			break
+		}
+	}
+
+	if pr.compress == compressNone {
+		pr.framing.observe(pr.isClient, seq, w.Bytes())
+	}
+	return seq, total, nil
+}
+
+//read one frame, returns its sequence id and payload length
+func (pr *packetReader) nextFrame(w *bytes.Buffer) (uint8, int, error) {
+
+	if pr.compress != compressNone {
+		return pr.nextInflated(w)
+	}
+
+	header := make([]byte, 4)
+	if err := pr.readHeader(header); err != nil {
+		return 0, 0, err
+	}
+
+	//the auth OK may have been read by the other
+	//direction while this one was waiting for data
+	if algorithm := pr.framing.compression(); algorithm != compressNone {
+		pr.compress = algorithm
+		if err := pr.readFrame(header); err != nil {
+			return 0, 0, err
+		}
+		return pr.nextInflated(w)
+	}
+
+	length := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+	keep := pr.room(w, length)
+	if n, err := io.CopyN(w, pr.r, int64(keep)); err != nil || n != int64(keep) {
+		return 0, 0, errUnknownStream
+	}
+	if n, err := io.CopyN(io.Discard, pr.r, int64(length-keep)); err != nil || n != int64(length-keep) {
+		return 0, 0, errUnknownStream
+	}
+	return header[3], length, nil
+}
+
+func (pr *packetReader) readHeader(header []byte) error {
+	if n, err := io.ReadFull(pr.r, header); err != nil {
+		if n == 0 && err == io.EOF {
+			return io.EOF
+		}
+		return errUnknownStream
+	}
+	return nil
+}
+
+//bytes of a frame of length that fit in w
+func (pr *packetReader) room(w *bytes.Buffer, length int) int {
+	switch {
+	case pr.maxSize <= 0 || w.Len()+length <= pr.maxSize:
+		return length
+	case w.Len() >= pr.maxSize:
+		return 0
+	}
+	return pr.maxSize - w.Len()
+}
@@ -0,0 +1,134 @@
+package build
+
+import (
+	"bytes"
+	"compress/zlib"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"strings"
+	"testing"
+)
+
+//plain frame: length(3), sequence(1), payload
+func frame(seq uint8, payload string) string {
+	n := len(payload)
+	return string([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq}) + payload
+}
+
+//compressed frame of packets, stored as is with compressNone
+func compressedFrame(algorithm int, seq uint8, packets string) string {
+	var body bytes.Buffer
+	switch algorithm {
+	case compressZlib:
+		w := zlib.NewWriter(&body)
+		w.Write([]byte(packets))
+		w.Close()
+	case compressZstd:
+		w, _ := zstd.NewWriter(nil)
+		body.Write(w.EncodeAll([]byte(packets), nil))
+		w.Close()
+	default:
+		body.WriteString(packets)
+	}
+	size := len(packets)
+	if algorithm == compressNone {
+		size = 0
+	}
+	n := body.Len()
+	header := []byte{byte(n), byte(n >> 8), byte(n >> 16), seq, byte(size), byte(size >> 8), byte(size >> 16)}
+	return string(header) + body.String()
+}
+
+func TestPacketReader(t *testing.T) {
+
+	type packet struct {
+		seq     uint8
+		length  int
+		payload string
+	}
+	large := strings.Repeat("x", maxFrameLength)
+	tests := []struct {
+		name     string
+		wire     string
+		compress int
+		active   bool
+		maxSize  int
+		want     []packet
+		err      bool
+	}{
+		{"frames", frame(0, "abc") + frame(1, "d") + frame(2, ""), compressNone, false, 0,
+			[]packet{{0, 3, "abc"}, {1, 1, "d"}, {2, 0, ""}}, false},
+		{"over max size", frame(0, "abcdef") + frame(1, "g"), compressNone, false, 2,
+			[]packet{{0, 6, "ab"}, {1, 1, "g"}}, false},
+		{"large packet", frame(0, large) + frame(1, "yz"), compressNone, false, 4,
+			[]packet{{0, maxFrameLength + 2, "xxxx"}}, false},
+		{"truncated", frame(0, "abc")[:5], compressNone, false, 0, nil, true},
+		{"zlib", compressedFrame(compressZlib, 0, frame(0, "select 1")+frame(1, "x")), compressZlib, true, 0,
+			[]packet{{0, 8, "select 1"}, {1, 1, "x"}}, false},
+		{"packet over two frames", compressedFrame(compressZlib, 0, frame(3, "sel")[:5]) + compressedFrame(compressZlib, 1, "el"),
+			compressZlib, true, 0, []packet{{3, 3, "sel"}}, false},
+		{"stored", compressedFrame(compressNone, 0, frame(0, "ping")), compressZlib, true, 0,
+			[]packet{{0, 4, "ping"}}, false},
+		{"zstd", compressedFrame(compressZstd, 0, frame(0, "select 1")), compressZstd, true, 0,
+			[]packet{{0, 8, "select 1"}}, false},
+	}
+
+	for _, tt := range tests {
+		f := &framing{algorithm: tt.compress, active: tt.active}
+		pr := newPacketReader(strings.NewReader(tt.wire), true, f, tt.maxSize)
+		var got []packet
+		var err error
+		for {
+			var payload bytes.Buffer
+			var seq uint8
+			var length int
+			if seq, length, err = pr.next(&payload); err != nil {
+				break
+			}
+			got = append(got, packet{seq, length, payload.String()})
+		}
+		pr.close()
+
+		if tt.err != (err != io.EOF) {
+			t.Errorf("%s: error %v", tt.name, err)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: %d packets, want %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: packet %d = %d %d %q, want %v", tt.name, i, got[i].seq, got[i].length, got[i].payload, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestFramingObserve(t *testing.T) {
+
+	greeting := serverGreeting("8.0.36", 7)
+	tests := []struct {
+		name     string
+		response []byte
+		auth     byte
+		want     int
+	}{
+		{"zlib", handshakeResponse(CLIENT_PROTOCOL_41|CLIENT_SECURE_CONNECTION|CLIENT_COMPRESS, "app", ""), 0x00, compressZlib},
+		{"zstd", handshakeResponse(CLIENT_PROTOCOL_41|CLIENT_SECURE_CONNECTION|CLIENT_ZSTD_COMPRESSION_ALGORITHM, "app", ""), 0x00, compressZstd},
+		{"auth failed", handshakeResponse(CLIENT_PROTOCOL_41|CLIENT_SECURE_CONNECTION|CLIENT_COMPRESS, "app", ""), 0xff, compressNone},
+		{"not requested", handshakeResponse(CLIENT_PROTOCOL_41|CLIENT_SECURE_CONNECTION, "app", ""), 0x00, compressNone},
+	}
+
+	for _, tt := range tests {
+		f := &framing{}
+		f.observe(false, 0, greeting)
+		f.observe(true, 1, tt.response)
+		if f.compression() != compressNone {
+			t.Errorf("%s: compressed before the auth", tt.name)
+		}
+		f.observe(false, 2, []byte{tt.auth, 0, 0, 2, 0, 0, 0})
+		if got := f.compression(); got != tt.want {
+			t.Errorf("%s: compression %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
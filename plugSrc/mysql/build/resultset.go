@@ -0,0 +1,468 @@
+package build
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+const (
+	SERVER_MORE_RESULTS_EXISTS  uint16 = 0x0008
+	SERVER_STATUS_CURSOR_EXISTS uint16 = 0x0040
+	SERVER_STATUS_LAST_ROW_SENT uint16 = 0x0080
+	UNSIGNED_FLAG               uint16 = 0x0020
+)
+
+//result set states
+const (
+	rsColumns = iota
+	rsColumnsEOF
+	rsRows
+)
+
+type Column struct {
+	Schema   string
+	Table    string
+	Name     string
+	Type     byte
+	Flags    uint16
+	Decimals byte
+}
+
+//ResultSet is a text (COM_QUERY) or
+//binary (COM_STMT_EXECUTE) result set being read
+type ResultSet struct {
+	binary      bool
+	state       int
+	columnCount int
+	Columns     []*Column
+	Rows        int
+
+	//first rows, capped by sampleRows and sampleSize
+	Sample          [][]interface{}
+	SampleTruncated bool
+	sampleRows      int
+	sampleSize      int
+}
+
+func NewResultSet(columnCount int, binary bool, sampleRows, sampleSize int) *ResultSet {
+	return &ResultSet{
+		binary:      binary,
+		columnCount: columnCount,
+		sampleRows:  sampleRows,
+		sampleSize:  sampleSize,
+	}
+}
+
+//rows of COM_STMT_FETCH, the columns were
+//sent with the response of COM_STMT_EXECUTE
+func NewFetchResultSet(columns []*Column, sampleRows, sampleSize int) *ResultSet {
+	rs := NewResultSet(len(columns), true, sampleRows, sampleSize)
+	rs.Columns = columns
+	rs.state   = rsRows
+	return rs
+}
+
+//Resolve reads the next server packet of the result set, size is its
+//length on the wire, the payload may have been cut over -max-packet.
+//Done is set on the terminating EOF/OK packet with its status flags
+func (rs *ResultSet) Resolve(payload []byte, size int, deprecateEOF bool) (done bool, status uint16, err error) {
+
+	switch rs.state {
+
+	case rsColumns:
+		col, err := ParseColumn(payload)
+		if err != nil {
+			return false, 0, err
+		}
+		rs.Columns = append(rs.Columns, col)
+		if len(rs.Columns) == rs.columnCount {
+			if deprecateEOF {
+				rs.state = rsRows
+			} else {
+				rs.state = rsColumnsEOF
+			}
+		}
+		return false, 0, nil
+
+	case rsColumnsEOF:
+		rs.state = rsRows
+		if IsEOFPacket(payload) {
+			//a cursor was opened, rows come with COM_STMT_FETCH
+			if status := terminatorStatus(payload); status&SERVER_STATUS_CURSOR_EXISTS > 0 {
+				return true, status, nil
+			}
+			return false, 0, nil
+		}
+		//no EOF after columns, this is the first row
+		return rs.Resolve(payload, size, deprecateEOF)
+
+	default:
+		//EOF, or OK with 0xfe header when CLIENT_DEPRECATE_EOF
+		if payload[0] == 0xfe && size < 0xffffff {
+			return true, terminatorStatus(payload), nil
+		}
+		rs.Rows++
+
+		//row cut over -max-packet, counted but not sampled
+		if size > len(payload) {
+			rs.SampleTruncated = true
+			return false, 0, nil
+		}
+		if len(rs.Sample) < rs.sampleRows && !rs.SampleTruncated {
+			var row []interface{}
+			if rs.binary {
+				row, err = rs.parseBinaryRow(payload)
+			} else {
+				row, err = rs.parseTextRow(payload)
+			}
+			if err != nil {
+				return false, 0, err
+			}
+			rs.addSample(row)
+		}
+		return false, 0, nil
+	}
+}
+
+//status flags of EOF or OK packet
+func terminatorStatus(payload []byte) uint16 {
+
+	//EOF : header, warnings(2), status(2)
+	if len(payload) == 5 {
+		return binary.LittleEndian.Uint16(payload[3:5])
+	}
+
+	//OK : header, affected rows, last insert id, status(2)
+	pos := 1
+	for i := 0; i < 2 && pos < len(payload); i++ {
+		_, _, n := LengthEncodedInt(payload[pos:])
+		if n == 0 {
+			return 0
+		}
+		pos += n
+	}
+	if pos+2 <= len(payload) {
+		return binary.LittleEndian.Uint16(payload[pos : pos+2])
+	}
+	return 0
+}
+
+//EOF packet is 1 or 5 bytes, an OK packet with
+//0xfe header (CLIENT_DEPRECATE_EOF) has at least 7
+func IsEOFPacket(payload []byte) bool {
+	return len(payload) > 0 && len(payload) < 7 && payload[0] == 0xfe
+}
+
+//ColumnDefinition41
+func ParseColumn(b []byte) (*Column, error) {
+
+	var fields [6]string
+	pos := 0
+	for i := range fields {
+		if pos >= len(b) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		v, _, n, err := LengthEncodedString(b[pos:])
+		if err != nil {
+			return nil, err
+		}
+		fields[i] = string(v)
+		pos += n
+	}
+
+	//length of fixed fields, charset(2), column length(4)
+	if pos+1+2+4+1+2+1 > len(b) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	pos += 1 + 2 + 4
+
+	return &Column{
+		Schema:   fields[1],
+		Table:    fields[2],
+		Name:     fields[4],
+		Type:     b[pos],
+		Flags:    binary.LittleEndian.Uint16(b[pos+1 : pos+3]),
+		Decimals: b[pos+3],
+	}, nil
+}
+
+func (rs *ResultSet) parseTextRow(b []byte) ([]interface{}, error) {
+
+	row := make([]interface{}, 0, rs.columnCount)
+	pos := 0
+	for i := 0; i < rs.columnCount; i++ {
+		if pos >= len(b) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if b[pos] == 0xfb {
+			row = append(row, nil)
+			pos++
+			continue
+		}
+		v, _, n, err := LengthEncodedString(b[pos:])
+		if err != nil {
+			return nil, err
+		}
+		row = append(row, v)
+		pos += n
+	}
+	return row, nil
+}
+
+func (rs *ResultSet) parseBinaryRow(b []byte) ([]interface{}, error) {
+
+	//header 0x00, null bitmap with offset 2
+	step := (rs.columnCount + 7 + 2) / 8
+	if len(b) < 1+step || b[0] != 0x00 {
+		return nil, errors.New("ERR : Binary row")
+	}
+	nullBitmap := b[1 : 1+step]
+	pos := 1 + step
+
+	row := make([]interface{}, 0, rs.columnCount)
+	for i, col := range rs.Columns {
+		bit := i + 2
+		if nullBitmap[bit>>3]&(1<<(uint(bit)%8)) > 0 {
+			row = append(row, nil)
+			continue
+		}
+		v, n, err := ReadBinaryValue(b[pos:], col.Type, col.Flags&UNSIGNED_FLAG > 0)
+		if err != nil {
+			return nil, err
+		}
+		row = append(row, v)
+		pos += n
+	}
+	return row, nil
+}
+
+//keep sampled row, values are cut when the size cap is reached
+func (rs *ResultSet) addSample(row []interface{}) {
+
+	for i, v := range row {
+		b, ok := v.([]byte)
+		if !ok {
+			continue
+		}
+		if len(b) > rs.sampleSize {
+			row[i] = append([]byte{}, b[:rs.sampleSize]...)
+			rs.SampleTruncated = true
+		} else {
+			row[i] = append([]byte{}, b...)
+		}
+		rs.sampleSize -= len(row[i].([]byte))
+	}
+	rs.Sample = append(rs.Sample, row)
+}
+
+func (rs *ResultSet) ColumnNames() []string {
+	names := make([]string, len(rs.Columns))
+	for i, col := range rs.Columns {
+		names[i] = col.Name
+	}
+	return names
+}
+
+//sampled rows for json output
+func (rs *ResultSet) SampleValues() [][]interface{} {
+	rows := make([][]interface{}, len(rs.Sample))
+	for i, row := range rs.Sample {
+		rows[i] = make([]interface{}, len(row))
+		for j, v := range row {
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			rows[i][j] = v
+		}
+	}
+	return rows
+}
+
+//sampled rows, one line each
+func (rs *ResultSet) WriteSampleToText() string {
+
+	var buf bytes.Buffer
+	for _, row := range rs.Sample {
+		buf.WriteString("\n    (")
+		for i, v := range row {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			switch v := v.(type) {
+			case nil:
+				buf.WriteString("NULL")
+			case []byte:
+				buf.WriteString("'" + strings.Replace(string(v), "'", "''", -1) + "'")
+			case string:
+				buf.WriteString("'" + v + "'")
+			default:
+				buf.WriteString(fmt.Sprint(v))
+			}
+		}
+		buf.WriteString(")")
+	}
+	if rs.SampleTruncated {
+		buf.WriteString("\n    ...")
+	}
+	return buf.String()
+}
+
+//size of fixed length types in the binary protocol
+var binaryFixedSize = map[byte]int{
+	MYSQL_TYPE_TINY:     1,
+	MYSQL_TYPE_SHORT:    2,
+	MYSQL_TYPE_YEAR:     2,
+	MYSQL_TYPE_INT24:    4,
+	MYSQL_TYPE_LONG:     4,
+	MYSQL_TYPE_FLOAT:    4,
+	MYSQL_TYPE_LONGLONG: 8,
+	MYSQL_TYPE_DOUBLE:   8,
+}
+
+//ReadBinaryValue reads one value of the binary protocol,
+//returns the value and the number of bytes used
+func ReadBinaryValue(b []byte, typ byte, unsigned bool) (interface{}, int, error) {
+
+	if n, ok := binaryFixedSize[typ]; ok && len(b) < n {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	switch typ {
+	case MYSQL_TYPE_NULL:
+		return nil, 0, nil
+
+	case MYSQL_TYPE_TINY:
+		if unsigned {
+			return uint8(b[0]), 1, nil
+		}
+		return int8(b[0]), 1, nil
+
+	case MYSQL_TYPE_SHORT, MYSQL_TYPE_YEAR:
+		v := binary.LittleEndian.Uint16(b[:2])
+		if unsigned {
+			return v, 2, nil
+		}
+		return int16(v), 2, nil
+
+	case MYSQL_TYPE_INT24, MYSQL_TYPE_LONG:
+		v := binary.LittleEndian.Uint32(b[:4])
+		if unsigned {
+			return v, 4, nil
+		}
+		return int32(v), 4, nil
+
+	case MYSQL_TYPE_LONGLONG:
+		v := binary.LittleEndian.Uint64(b[:8])
+		if unsigned {
+			return v, 8, nil
+		}
+		return int64(v), 8, nil
+
+	case MYSQL_TYPE_FLOAT:
+		return math.Float32frombits(binary.LittleEndian.Uint32(b[:4])), 4, nil
+
+	case MYSQL_TYPE_DOUBLE:
+		return math.Float64frombits(binary.LittleEndian.Uint64(b[:8])), 8, nil
+
+	case MYSQL_TYPE_DATE, MYSQL_TYPE_NEWDATE, MYSQL_TYPE_DATETIME, MYSQL_TYPE_TIMESTAMP:
+		return BinaryDateTime(b, typ)
+
+	case MYSQL_TYPE_TIME:
+		return BinaryTime(b)
+
+	case MYSQL_TYPE_DECIMAL, MYSQL_TYPE_NEWDECIMAL,
+		MYSQL_TYPE_VARCHAR, MYSQL_TYPE_BIT, MYSQL_TYPE_JSON,
+		MYSQL_TYPE_ENUM, MYSQL_TYPE_SET,
+		MYSQL_TYPE_TINY_BLOB, MYSQL_TYPE_MEDIUM_BLOB, MYSQL_TYPE_LONG_BLOB, MYSQL_TYPE_BLOB,
+		MYSQL_TYPE_VAR_STRING, MYSQL_TYPE_STRING,
+		MYSQL_TYPE_GEOMETRY:
+		if len(b) == 0 {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		v, isNull, n, err := LengthEncodedString(b)
+		if err != nil {
+			return nil, n, err
+		}
+		if isNull {
+			return nil, n, nil
+		}
+		if v == nil {
+			v = []byte{}
+		}
+		return v, n, nil
+	}
+	return nil, 0, errors.New(fmt.Sprintf("ERR : Unknown type %d", typ))
+}
+
+//binary DATE, DATETIME and TIMESTAMP:
+//length(1), year(2), month, day, hour, minute, second, microsecond(4)
+func BinaryDateTime(b []byte, typ byte) (string, int, error) {
+
+	if len(b) == 0 || len(b) < 1+int(b[0]) {
+		return "", 0, io.ErrUnexpectedEOF
+	}
+	l := int(b[0])
+	v := b[1 : 1+l]
+
+	var year, month, day, hour, minute, second, micro int
+	if l >= 4 {
+		year  = int(binary.LittleEndian.Uint16(v[0:2]))
+		month = int(v[2])
+		day   = int(v[3])
+	}
+	if l >= 7 {
+		hour   = int(v[4])
+		minute = int(v[5])
+		second = int(v[6])
+	}
+	if l >= 11 {
+		micro = int(binary.LittleEndian.Uint32(v[7:11]))
+	}
+
+	str := fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+	if typ == MYSQL_TYPE_DATE || typ == MYSQL_TYPE_NEWDATE {
+		return str, 1 + l, nil
+	}
+	str += fmt.Sprintf(" %02d:%02d:%02d", hour, minute, second)
+	if micro > 0 {
+		str += fmt.Sprintf(".%06d", micro)
+	}
+	return str, 1 + l, nil
+}
+
+//binary TIME:
+//length(1), is negative, days(4), hour, minute, second, microsecond(4)
+func BinaryTime(b []byte) (string, int, error) {
+
+	if len(b) == 0 || len(b) < 1+int(b[0]) {
+		return "", 0, io.ErrUnexpectedEOF
+	}
+	l := int(b[0])
+	v := b[1 : 1+l]
+
+	var negative bool
+	var hours, minute, second, micro int
+	if l >= 8 {
+		negative = v[0] == 1
+		hours    = int(binary.LittleEndian.Uint32(v[1:5]))*24 + int(v[5])
+		minute   = int(v[6])
+		second   = int(v[7])
+	}
+	if l >= 12 {
+		micro = int(binary.LittleEndian.Uint32(v[8:12]))
+	}
+
+	str := fmt.Sprintf("%02d:%02d:%02d", hours, minute, second)
+	if negative {
+		str = "-" + str
+	}
+	if micro > 0 {
+		str += fmt.Sprintf(".%06d", micro)
+	}
+	return str, 1 + l, nil
+}
@@ -0,0 +1,99 @@
+package build
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestAddSample(t *testing.T) {
+
+	tests := []struct {
+		size      int
+		values    []string
+		want      []string
+		truncated bool
+	}{
+		{8, []string{"abcd"}, []string{"abcd"}, false},
+		{4, []string{"abcd"}, []string{"abcd"}, false},
+		{4, []string{"abcde"}, []string{"abcd"}, true},
+		{4, []string{"ab", "cd"}, []string{"ab", "cd"}, false},
+		{4, []string{"ab", "cde"}, []string{"ab", "cd"}, true},
+		{4, []string{"abcd", ""}, []string{"abcd", ""}, false},
+	}
+
+	for _, tt := range tests {
+		rs := NewResultSet(len(tt.values), false, 10, tt.size)
+		row := make([]interface{}, len(tt.values))
+		for i, v := range tt.values {
+			row[i] = []byte(v)
+		}
+		rs.addSample(row)
+
+		for i, v := range rs.Sample[0] {
+			if string(v.([]byte)) != tt.want[i] {
+				t.Errorf("size %d %q: value %d = %q, want %q", tt.size, tt.values, i, v, tt.want[i])
+			}
+		}
+		if rs.SampleTruncated != tt.truncated {
+			t.Errorf("size %d %q: truncated = %v, want %v", tt.size, tt.values, rs.SampleTruncated, tt.truncated)
+		}
+	}
+}
+
+func TestResolveTruncatedRow(t *testing.T) {
+
+	rs := NewResultSet(1, false, 10, 1024)
+	rs.state = rsRows
+
+	//text row of a 16MB value, cut over -max-packet: its first
+	//byte is the 0xfe of a length-encoded string, not an EOF
+	row := []byte{0xfe, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 'a', 'b'}
+	done, _, err := rs.Resolve(row, 0x1000009, true)
+	if done || err != nil {
+		t.Fatalf("truncated row: done %v, err %v", done, err)
+	}
+	if rs.Rows != 1 || !rs.SampleTruncated || len(rs.Sample) != 0 {
+		t.Errorf("truncated row: rows %d, sample %v, truncated %v", rs.Rows, rs.Sample, rs.SampleTruncated)
+	}
+
+	eof := []byte{0xfe, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}
+	if done, _, _ = rs.Resolve(eof, len(eof), true); !done {
+		t.Errorf("terminator not done")
+	}
+}
+
+func TestReadBinaryValue(t *testing.T) {
+
+	tests := []struct {
+		b        []byte
+		typ      byte
+		unsigned bool
+		want     interface{}
+		n        int
+		err      error
+	}{
+		{[]byte{0xff}, MYSQL_TYPE_TINY, false, int8(-1), 1, nil},
+		{[]byte{0xff}, MYSQL_TYPE_TINY, true, uint8(255), 1, nil},
+		{[]byte{0xea, 0x07}, MYSQL_TYPE_YEAR, true, uint16(2026), 2, nil},
+		{[]byte{0xfe, 0xff, 0xff, 0xff}, MYSQL_TYPE_LONG, false, int32(-2), 4, nil},
+		{[]byte{1, 0, 0, 0, 0, 0, 0, 0}, MYSQL_TYPE_LONGLONG, false, int64(1), 8, nil},
+		{[]byte{0, 0, 0xc0, 0x3f}, MYSQL_TYPE_FLOAT, false, float32(1.5), 4, nil},
+		{[]byte{0x04, 0xea, 0x07, 10, 18}, MYSQL_TYPE_DATE, false, "2026-10-18", 5, nil},
+		{[]byte{0x07, 0xea, 0x07, 10, 18, 15, 4, 5}, MYSQL_TYPE_DATETIME, false, "2026-10-18 15:04:05", 8, nil},
+		{[]byte{0x0b, 0xea, 0x07, 10, 18, 15, 4, 5, 0x40, 0xe2, 0x01, 0}, MYSQL_TYPE_TIMESTAMP, false, "2026-10-18 15:04:05.123456", 12, nil},
+		{[]byte{0x00}, MYSQL_TYPE_DATETIME, false, "0000-00-00 00:00:00", 1, nil},
+		{[]byte{0x08, 1, 1, 0, 0, 0, 2, 3, 4}, MYSQL_TYPE_TIME, false, "-26:03:04", 9, nil},
+		{[]byte{0x03, 'a', 'b', 'c'}, MYSQL_TYPE_VAR_STRING, false, []byte("abc"), 4, nil},
+		{[]byte{0x00}, MYSQL_TYPE_BLOB, false, []byte{}, 1, nil},
+		{[]byte{0x01, 0x02}, MYSQL_TYPE_LONG, false, nil, 0, io.ErrUnexpectedEOF},
+		{[]byte{0x05, 0xea}, MYSQL_TYPE_DATE, false, "", 0, io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		v, n, err := ReadBinaryValue(tt.b, tt.typ, tt.unsigned)
+		if !reflect.DeepEqual(v, tt.want) || n != tt.n || err != tt.err {
+			t.Errorf("ReadBinaryValue(% x, %d) = %#v %d %v, want %#v %d %v", tt.b, tt.typ, v, n, err, tt.want, tt.n, tt.err)
+		}
+	}
+}
@@ -2,11 +2,13 @@ package build
 
 import (
 	"bytes"
-	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"math"
+	"io"
+	"strconv"
 	"strings"
-	"errors"
+	"unicode/utf8"
 )
 
 type Stmt struct {
@@ -16,6 +18,15 @@ type Stmt struct {
 	FieldCount uint16
 
 	Args []interface{}
+
+	//type(1) and flag(1) of each param, as last bound
+	Types []byte
+
+	//columns of the result set, for COM_STMT_FETCH
+	Columns []*Column
+
+	//params sent with COM_STMT_SEND_LONG_DATA
+	longData map[int]bool
 }
 
 func (stmt *Stmt) WriteToText() []byte {
@@ -26,16 +37,7 @@ func (stmt *Stmt) WriteToText() []byte {
 	buf.WriteString(str)
 
 	for i := 0; i < int(stmt.ParamCount); i++ {
-		var str string
-		switch stmt.Args[i].(type) {
-		case nil:
-			str = fmt.Sprintf("set @p%v = NULL;\n", i)
-		case []byte:
-			param := string(stmt.Args[i].([]byte))
-			str = fmt.Sprintf("set @p%v = '%s';\n", i, strings.TrimSpace(param))
-		default:
-			str = fmt.Sprintf("set @p%v = %v;\n", i, stmt.Args[i])
-		}
+		str := fmt.Sprintf("set @p%v = %s;\n", i, stmt.ArgLiteral(i))
 		buf.WriteString(str)
 	}
 
@@ -59,114 +61,332 @@ func (stmt *Stmt) WriteToText() []byte {
 	return buf.Bytes()
 }
 
-func (stmt *Stmt) BindArgs(nullBitmap, paramTypes, paramValues []byte) error {
+//WriteToSQL returns the query with the ? placeholders
+//replaced by the bound args, as one runnable statement
+func (stmt *Stmt) WriteToSQL() string {
+
+	var buf strings.Builder
+	q := stmt.Query
+	arg := 0
+
+	//the query ends in a -- comment
+	open := false
+	for i := 0; i < len(q); {
+
+		c := q[i]
+		n := 1
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			n = quotedLength(q[i:])
+		case c == '#' || (c == '-' && strings.HasPrefix(q[i:], "-- ")):
+			if n = strings.IndexByte(q[i:], '\n'); n < 0 {
+				n = len(q) - i
+				open = true
+			}
+		case c == '/' && strings.HasPrefix(q[i:], "/*"):
+			if n = strings.Index(q[i+2:], "*/") + 4; n < 4 {
+				n = len(q) - i
+			}
+		case c == '?' && arg < int(stmt.ParamCount):
+			buf.WriteString(stmt.ArgLiteral(arg))
+			arg++
+			i++
+			continue
+		}
+		buf.WriteString(q[i : i+n])
+		i += n
+	}
 
-	args := stmt.Args
-	pos := 0
+	sql := strings.TrimSpace(buf.String())
+	if open {
+		return sql + "\n;"
+	}
+	return strings.TrimRight(sql, ";") + ";"
+}
 
-	var v []byte
-	var n = 0
-	var isNull bool
-	var err error
+//ArgLiteral returns arg i as an sql literal
+func (stmt *Stmt) ArgLiteral(i int) string {
+	typ := byte(0xff)
+	if i<<1 < len(stmt.Types) {
+		typ = stmt.Types[i<<1]
+	}
+	return SQLLiteral(stmt.Args[i], typ)
+}
 
-	for i := 0; i < int(stmt.ParamCount); i++ {
+//SQLLiteral renders a bound value of type typ: strings are quoted
+//and escaped, blobs and binary strings are written in hex
+func SQLLiteral(v interface{}, typ byte) string {
+
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		//DATE, DATETIME, TIMESTAMP, TIME
+		return "'" + EscapeString(v) + "'"
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case []byte:
+		switch typ {
+		case MYSQL_TYPE_DECIMAL, MYSQL_TYPE_NEWDECIMAL:
+			if _, err := strconv.ParseFloat(string(v), 64); err == nil {
+				return string(v)
+			}
+		case MYSQL_TYPE_TINY_BLOB, MYSQL_TYPE_MEDIUM_BLOB, MYSQL_TYPE_LONG_BLOB, MYSQL_TYPE_BLOB,
+			MYSQL_TYPE_BIT, MYSQL_TYPE_GEOMETRY:
+			return hexLiteral(v)
+		}
+		if !utf8.Valid(v) {
+			return hexLiteral(v)
+		}
+		return "'" + EscapeString(string(v)) + "'"
+	}
+	return fmt.Sprintf("%v", v)
+}
 
-		if nullBitmap[i>>3]&(1<<(uint(i)%8)) > 0 {
-			args[i] = nil
-			continue
+func hexLiteral(b []byte) string {
+	if len(b) == 0 {
+		return "''"
+	}
+	return "0x" + hex.EncodeToString(b)
+}
+
+//EscapeString escapes s for a quoted literal,
+//like mysql_real_escape_string
+func EscapeString(s string) string {
+
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case 0:
+			buf.WriteString(`\0`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\\', '\'', '"':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case 0x1a:
+			buf.WriteString(`\Z`)
+		default:
+			buf.WriteByte(c)
 		}
+	}
+	return buf.String()
+}
 
-		typ := paramTypes[i<<1]
-		unsigned := (paramTypes[(i<<1)+1] & 0x80) > 0
+//COM_STMT_EXECUTE flags
+const (
+	CURSOR_TYPE_READ_ONLY     byte = 0x01
+	CURSOR_TYPE_FOR_UPDATE    byte = 0x02
+	CURSOR_TYPE_SCROLLABLE    byte = 0x04
+	PARAMETER_COUNT_AVAILABLE byte = 0x08
+)
 
-		switch typ {
-		case MYSQL_TYPE_NULL:
-			args[i] = nil
-			continue
+//cursor type of the execute flags, empty if none
+func CursorType(flags byte) string {
+	var types []string
+	if flags&CURSOR_TYPE_READ_ONLY > 0 {
+		types = append(types, "read_only")
+	}
+	if flags&CURSOR_TYPE_FOR_UPDATE > 0 {
+		types = append(types, "for_update")
+	}
+	if flags&CURSOR_TYPE_SCROLLABLE > 0 {
+		types = append(types, "scrollable")
+	}
+	return strings.Join(types, ",")
+}
 
-		case MYSQL_TYPE_TINY:
+//SendLongData appends a chunk of COM_STMT_SEND_LONG_DATA,
+//the param is then left out of the next execute
+func (stmt *Stmt) SendLongData(param uint16, data []byte) error {
 
-			value := paramValues[pos]
-			if unsigned {
-				args[i] = uint8(value)
-			} else {
-				args[i] = int8(value)
-			}
+	if int(param) >= len(stmt.Args) {
+		return errors.New(fmt.Sprintf("ERR : Unknown param %d of stm id %d", param, stmt.ID))
+	}
+	if stmt.longData == nil {
+		stmt.longData = make(map[int]bool)
+	}
+	if !stmt.longData[int(param)] {
+		stmt.longData[int(param)] = true
+		stmt.Args[param] = []byte{}
+	}
+	if b, ok := stmt.Args[param].([]byte); ok {
+		stmt.Args[param] = append(b, data...)
+	}
+	return nil
+}
 
-			pos++
-			continue
+//Reset drops the long data, as COM_STMT_RESET
+func (stmt *Stmt) Reset() {
+	stmt.Args     = make([]interface{}, stmt.ParamCount)
+	stmt.longData = nil
+}
+
+//BindExecute binds the params of COM_STMT_EXECUTE, b follows the
+//iteration count. With CLIENT_QUERY_ATTRIBUTES the params are followed
+//by named query attributes, which are returned
+func (stmt *Stmt) BindExecute(b []byte, flags byte, queryAttrs bool) (map[string]interface{}, error) {
 
-		case MYSQL_TYPE_SHORT, MYSQL_TYPE_YEAR:
+	//long data is sent once per execute
+	defer func() {
+		stmt.longData = nil
+	}()
 
-			value := binary.LittleEndian.Uint16(paramValues[pos : pos+2])
-			if unsigned {
-				args[i] = uint16(value)
-			} else {
-				args[i] = int16(value)
+	count := int(stmt.ParamCount)
+	pos := 0
+	if count > 0 || (queryAttrs && flags&PARAMETER_COUNT_AVAILABLE > 0) {
+		if queryAttrs {
+			c, _, n := LengthEncodedInt(b)
+			if n == 0 {
+				return nil, io.ErrUnexpectedEOF
 			}
-			pos += 2
-			continue
+			count = int(c)
+			pos += n
+		}
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	if count < int(stmt.ParamCount) {
+		return nil, errors.New(fmt.Sprintf("ERR : %d params of stm id %d, expected %d", count, stmt.ID, stmt.ParamCount))
+	}
 
-		case MYSQL_TYPE_INT24, MYSQL_TYPE_LONG:
+	p, err := readParams(b[pos:], count, queryAttrs, stmt.Types, func(i int) bool {
+		return stmt.longData[i]
+	})
+	if err != nil {
+		return nil, err
+	}
 
-			value := binary.LittleEndian.Uint32(paramValues[pos : pos+4])
-			if unsigned {
-				args[i] = uint32(value)
-			} else {
-				args[i] = int32(value)
-			}
-			pos += 4
-			continue
+	//types are kept when the next execute does not send them
+	stmt.Types = p.types
+	for i := 0; i < int(stmt.ParamCount); i++ {
+		if !stmt.longData[i] {
+			stmt.Args[i] = p.values[i]
+		}
+	}
+	return p.attrs(int(stmt.ParamCount)), nil
+}
 
-		case MYSQL_TYPE_LONGLONG:
+//ParseQueryAttributes reads the attributes in front of the
+//COM_QUERY text when CLIENT_QUERY_ATTRIBUTES is set,
+//returns them and the length to skip
+func ParseQueryAttributes(b []byte) (map[string]interface{}, int, error) {
 
-			value := binary.LittleEndian.Uint64(paramValues[pos : pos+8])
-			if unsigned {
-				args[i] = value
-			} else {
-				args[i] = int64(value)
-			}
-			pos += 8
-			continue
+	//parameter count, parameter set count (always 1)
+	count, _, n := LengthEncodedInt(b)
+	if n == 0 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	pos := n
+	_, _, n = LengthEncodedInt(b[pos:])
+	if n == 0 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	pos += n
+	if count == 0 {
+		return nil, pos, nil
+	}
 
-		case MYSQL_TYPE_FLOAT:
+	p, err := readParams(b[pos:], int(count), true, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return p.attrs(0), pos + p.length, nil
+}
 
-			value := math.Float32frombits(binary.LittleEndian.Uint32(paramValues[pos : pos+4]))
-			args[i] = float32(value)
-			pos += 4
-			continue
+//bound params of COM_STMT_EXECUTE or COM_QUERY
+type params struct {
+	values []interface{}
+	types  []byte
+	names  []string
+	length int
+}
 
-		case MYSQL_TYPE_DOUBLE:
+//attributes are the params from index first on
+func (p *params) attrs(first int) map[string]interface{} {
+	if len(p.values) <= first {
+		return nil
+	}
+	attrs := make(map[string]interface{})
+	for i := first; i < len(p.values); i++ {
+		name := fmt.Sprintf("attr%d", i-first)
+		if i < len(p.names) && p.names[i] != "" {
+			name = p.names[i]
+		}
+		if v, ok := p.values[i].([]byte); ok {
+			attrs[name] = string(v)
+		} else {
+			attrs[name] = p.values[i]
+		}
+	}
+	return attrs
+}
 
-			value := math.Float64frombits(binary.LittleEndian.Uint64(paramValues[pos : pos+8]))
-			args[i] = value
-			pos += 8
-			continue
+//null bitmap, new params bound flag, type(2) (and name) of
+//each param if bound, then the values. Bound types replace
+//types, values of params where skip is true are not sent
+func readParams(b []byte, count int, named bool, types []byte, skip func(i int) bool) (*params, error) {
 
-		case MYSQL_TYPE_DECIMAL, MYSQL_TYPE_NEWDECIMAL,
-			MYSQL_TYPE_VARCHAR, MYSQL_TYPE_BIT,
-			MYSQL_TYPE_ENUM, MYSQL_TYPE_SET,
-			MYSQL_TYPE_TINY_BLOB, MYSQL_TYPE_MEDIUM_BLOB, MYSQL_TYPE_LONG_BLOB, MYSQL_TYPE_BLOB,
-			MYSQL_TYPE_VAR_STRING, MYSQL_TYPE_STRING,
-			MYSQL_TYPE_GEOMETRY,
-			MYSQL_TYPE_DATE, MYSQL_TYPE_NEWDATE, MYSQL_TYPE_TIMESTAMP, MYSQL_TYPE_DATETIME, MYSQL_TYPE_TIME:
+	//（Null-Bitmap，len = (paramsCount + 7) / 8 byte）
+	step := (count + 7) / 8
+	if len(b) < step+1 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	nullBitmap := b[:step]
+	pos := step
 
-			v, isNull, n, err = LengthEncodedString(paramValues[pos:])
-			pos += n
-			if err != nil {
-				return err
-			}
+	p := &params{
+		values: make([]interface{}, count),
+		types:  types,
+	}
 
-			if !isNull {
-				args[i] = v
-				continue
-			} else {
-				args[i] = nil
-				continue
+	//Parameter separator
+	bound := b[pos]
+	pos++
+	if bound == 1 {
+		p.types = make([]byte, 0, count*2)
+		for i := 0; i < count; i++ {
+			if pos+2 > len(b) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			p.types = append(p.types, b[pos], b[pos+1])
+			pos += 2
+			if named {
+				name, _, n, err := LengthEncodedString(b[pos:])
+				if err != nil {
+					return nil, err
+				}
+				p.names = append(p.names, string(name))
+				pos += n
 			}
-		default:
-			return errors.New(fmt.Sprintf("ERR : Unknown stm type %d", typ))
 		}
 	}
-	return nil
+	if len(p.types) < count*2 {
+		return nil, errors.New("ERR : Params without bound types")
+	}
+
+	for i := 0; i < count; i++ {
+
+		if nullBitmap[i>>3]&(1<<(uint(i)%8)) > 0 || (skip != nil && skip(i)) {
+			continue
+		}
+
+		typ := p.types[i<<1]
+		unsigned := (p.types[(i<<1)+1] & 0x80) > 0
+
+		//binary protocol value, DATE/DATETIME/TIME as strings
+		v, n, err := ReadBinaryValue(b[pos:], typ, unsigned)
+		if err != nil {
+			return nil, err
+		}
+		p.values[i] = v
+		pos += n
+	}
+	p.length = pos
+	return p, nil
 }
@@ -0,0 +1,164 @@
+package build
+
+import (
+	"encoding/binary"
+	"github.com/40t/go-sniffer/core/event"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSQLLiteral(t *testing.T) {
+
+	tests := []struct {
+		v    interface{}
+		typ  byte
+		want string
+	}{
+		{nil, MYSQL_TYPE_NULL, "NULL"},
+		{int32(-5), MYSQL_TYPE_LONG, "-5"},
+		{uint64(18446744073709551615), MYSQL_TYPE_LONGLONG, "18446744073709551615"},
+		{float32(1.5), MYSQL_TYPE_FLOAT, "1.5"},
+		{float64(0.1), MYSQL_TYPE_DOUBLE, "0.1"},
+		{"2026-10-18 15:04:05", MYSQL_TYPE_DATETIME, "'2026-10-18 15:04:05'"},
+		{[]byte("it's"), MYSQL_TYPE_VAR_STRING, `'it\'s'`},
+		{[]byte("12.50"), MYSQL_TYPE_NEWDECIMAL, "12.50"},
+		{[]byte("abc"), MYSQL_TYPE_BLOB, "0x616263"},
+		{[]byte{}, MYSQL_TYPE_BLOB, "''"},
+		{[]byte{0xff, 0x00}, MYSQL_TYPE_STRING, "0xff00"},
+	}
+
+	for _, tt := range tests {
+		if got := SQLLiteral(tt.v, tt.typ); got != tt.want {
+			t.Errorf("SQLLiteral(%#v, %d) = %s, want %s", tt.v, tt.typ, got, tt.want)
+		}
+	}
+}
+
+func TestEscapeString(t *testing.T) {
+
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"plain", "plain"},
+		{"a'b\"c\\d", `a\'b\"c\\d`},
+		{"\x00\n\r\x1a", `\0\n\r\Z`},
+	}
+
+	for _, tt := range tests {
+		if got := EscapeString(tt.s); got != tt.want {
+			t.Errorf("EscapeString(%q) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestBindExecute(t *testing.T) {
+
+	stmt := &Stmt{ID: 1, ParamCount: 2}
+	stmt.Reset()
+	value := binary.LittleEndian.AppendUint32(nil, 42)
+
+	tests := []struct {
+		name     string
+		longData string
+		params   []byte
+		want     []interface{}
+	}{
+		//null bitmap, new params bound, types, values
+		{"bound", "", append(append([]byte{0x00, 1, MYSQL_TYPE_LONG, 0, MYSQL_TYPE_VAR_STRING, 0}, value...), 2, 'a', 'b'),
+			[]interface{}{int32(42), []byte("ab")}},
+		{"types of the previous execute", "", append([]byte{0x02, 0}, value...),
+			[]interface{}{int32(42), nil}},
+		{"long data", "xy", append([]byte{0x00, 0}, value...),
+			[]interface{}{int32(42), []byte("xy")}},
+	}
+
+	for _, tt := range tests {
+		if tt.longData != "" {
+			stmt.SendLongData(1, []byte(tt.longData))
+		}
+		if _, err := stmt.BindExecute(tt.params, 0, false); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(stmt.Args, tt.want) {
+			t.Errorf("%s: args %#v, want %#v", tt.name, stmt.Args, tt.want)
+		}
+	}
+
+	//params are required once bound
+	if _, err := stmt.BindExecute([]byte{0x00}, 0, false); err == nil {
+		t.Errorf("truncated execute: no error")
+	}
+}
+
+func TestParseQueryAttributes(t *testing.T) {
+
+	//count, set count, null bitmap, bound, type and name, value
+	b := []byte{1, 1, 0x00, 1, MYSQL_TYPE_VAR_STRING, 0, 5, 't', 'r', 'a', 'c', 'e', 3, 'a', 'b', 'c'}
+	attrs, n, err := ParseQueryAttributes(append(b, "select 1"...))
+	if err != nil || n != len(b) || !reflect.DeepEqual(attrs, map[string]interface{}{"trace": "abc"}) {
+		t.Errorf("attributes %v, length %d, %v", attrs, n, err)
+	}
+
+	attrs, n, err = ParseQueryAttributes([]byte{0, 1, 's'})
+	if err != nil || n != 2 || attrs != nil {
+		t.Errorf("no attributes: %v, length %d, %v", attrs, n, err)
+	}
+}
+
+func TestPrepare(t *testing.T) {
+
+	prepareOK := []byte{0x00, 1, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0}
+	definition := []byte("\x03def")
+	eof := []byte{0xfe, 0, 0, 2, 0}
+	tests := []struct {
+		name    string
+		replies [][]byte
+		status  string
+		stmt    bool
+	}{
+		//one param and one column, each followed by an EOF
+		{"ok", [][]byte{prepareOK, definition, eof, definition, eof}, "OK", true},
+		//the SQLSTATE is not read as counts
+		{"err", [][]byte{[]byte("\xff\x28\x04#42000You have an error in your SQL syntax")}, "ERR", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []*event.Event
+			stm := &stream{
+				packets: make(chan *packet, 16),
+				done:    make(chan bool),
+				emit:    event.EmitterFunc(func(e *event.Event) { events = append(events, e) }),
+				stmtMap: make(map[uint32]*Stmt),
+			}
+			seen := time.Date(2026, 10, 18, 15, 4, 5, 0, time.UTC)
+			send := func(client bool, seq int, payload []byte) {
+				stm.packets <- &packet{seq: seq, length: len(payload), payload: payload, seen: seen, isClientFlow: client}
+				seen = seen.Add(time.Millisecond)
+			}
+			send(true, 0, []byte("\x16select name from users where id = ?"))
+			for i, r := range tt.replies {
+				send(false, i+1, r)
+			}
+			send(true, 0, []byte{COM_PING})
+			send(false, 1, []byte{0x00, 0, 0, 2, 0, 0, 0})
+			close(stm.packets)
+			stm.resolve(nil)
+
+			if len(events) != 2 || events[0].Operation != "Prepare" || events[1].Status != "OK" {
+				t.Fatalf("events %v", events)
+			}
+			if events[0].Status != tt.status || events[0].Latency != time.Millisecond {
+				t.Errorf("prepare %s %v", events[0].Status, events[0].Latency)
+			}
+			stmt, ok := stm.stmtMap[1]
+			if ok != tt.stmt {
+				t.Fatalf("stmt %v", stm.stmtMap)
+			}
+			if ok && (stmt.Query != "select name from users where id = ?" || stmt.ParamCount != 1 || stmt.FieldCount != 1) {
+				t.Errorf("stmt %+v", stmt)
+			}
+		})
+	}
+}
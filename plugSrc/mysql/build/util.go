@@ -7,9 +7,9 @@ import (
 	"time"
 )
 
-func GetNowStr(isClient bool) string {
+func GetNowStr(isClient bool, t time.Time) string {
 	var msg string
-	msg += time.Now().Format("2006-01-02 15:04:05")
+	msg += t.Format("2006-01-02 15:04:05")
 	if isClient {
 		msg += "| cli -> ser |"
 	}else{
@@ -49,8 +49,12 @@ func LengthBinary(b []byte) (uint32, int) {
 	return 0,0
 }
 
+//LengthEncodedInt returns n == 0 when input is too short
 func LengthEncodedInt(input []byte) (num uint64, isNull bool, n int) {
 
+	if len(input) == 0 {
+		return
+	}
 	switch input[0] {
 
 	case 0xfb:
@@ -58,14 +62,23 @@ func LengthEncodedInt(input []byte) (num uint64, isNull bool, n int) {
 		isNull = true
 		return
 	case 0xfc:
+		if len(input) < 3 {
+			return
+		}
 		num = uint64(input[1]) | uint64(input[2])<<8
 		n = 3
 		return
 	case 0xfd:
+		if len(input) < 4 {
+			return
+		}
 		num = uint64(input[1]) | uint64(input[2])<<8 | uint64(input[3])<<16
 		n = 4
 		return
 	case 0xfe:
+		if len(input) < 9 {
+			return
+		}
 		num = uint64(input[1]) | uint64(input[2])<<8 | uint64(input[3])<<16 |
 			uint64(input[4])<<24 | uint64(input[5])<<32 | uint64(input[6])<<40 |
 			uint64(input[7])<<48 | uint64(input[8])<<56
@@ -81,6 +94,9 @@ func LengthEncodedInt(input []byte) (num uint64, isNull bool, n int) {
 func LengthEncodedString(b []byte) ([]byte, bool, int, error) {
 
 	num, isNull, n := LengthEncodedInt(b)
+	if n == 0 {
+		return nil, false, 0, io.EOF
+	}
 	if num < 1 {
 		return nil, isNull, n, nil
 	}
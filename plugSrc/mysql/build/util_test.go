@@ -0,0 +1,78 @@
+package build
+
+import (
+	"testing"
+)
+
+func TestLengthEncodedInt(t *testing.T) {
+
+	tests := []struct {
+		b      []byte
+		num    uint64
+		isNull bool
+		n      int
+	}{
+		{[]byte{0x00}, 0, false, 1},
+		{[]byte{0xfa}, 250, false, 1},
+		{[]byte{0xfb}, 0, true, 1},
+		{[]byte{0xfc, 0xfb, 0x00}, 251, false, 3},
+		{[]byte{0xfd, 0x01, 0x02, 0x03}, 0x030201, false, 4},
+		{[]byte{0xfe, 1, 2, 3, 4, 5, 6, 7, 8}, 0x0807060504030201, false, 9},
+		//too short for the length
+		{nil, 0, false, 0},
+		{[]byte{0xfc, 0x01}, 0, false, 0},
+		{[]byte{0xfd, 0x01, 0x02}, 0, false, 0},
+		{[]byte{0xfe, 1, 2, 3, 4, 5, 6, 7}, 0, false, 0},
+	}
+
+	for _, tt := range tests {
+		num, isNull, n := LengthEncodedInt(tt.b)
+		if num != tt.num || isNull != tt.isNull || n != tt.n {
+			t.Errorf("LengthEncodedInt(% x) = %d %v %d, want %d %v %d", tt.b, num, isNull, n, tt.num, tt.isNull, tt.n)
+		}
+	}
+}
+
+func TestLengthEncodedString(t *testing.T) {
+
+	tests := []struct {
+		b      []byte
+		s      string
+		isNull bool
+		n      int
+		err    bool
+	}{
+		{[]byte{0x03, 'a', 'b', 'c', 'd'}, "abc", false, 4, false},
+		{[]byte{0x00}, "", false, 1, false},
+		{[]byte{0xfb}, "", true, 1, false},
+		{[]byte{0xfc, 0x02, 0x00, 'x', 'y'}, "xy", false, 5, false},
+		{[]byte{0x05, 'a', 'b'}, "", false, 6, true},
+		{[]byte{0xfc, 0x02}, "", false, 0, true},
+	}
+
+	for _, tt := range tests {
+		s, isNull, n, err := LengthEncodedString(tt.b)
+		if string(s) != tt.s || isNull != tt.isNull || n != tt.n || (err != nil) != tt.err {
+			t.Errorf("LengthEncodedString(% x) = %q %v %d %v, want %q %v %d", tt.b, s, isNull, n, err, tt.s, tt.isNull, tt.n)
+		}
+	}
+}
+
+func TestReadStringFromByte(t *testing.T) {
+
+	tests := []struct {
+		b []byte
+		s string
+		n int
+	}{
+		{[]byte("root\x00rest"), "root", 4},
+		{[]byte("\x00"), "", 0},
+		{[]byte("unterminated"), "unterminated", 12},
+	}
+
+	for _, tt := range tests {
+		if s, n := ReadStringFromByte(tt.b); s != tt.s || n != tt.n {
+			t.Errorf("ReadStringFromByte(%q) = %q %d, want %q %d", tt.b, s, n, tt.s, tt.n)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/40t/go-sniffer/core/event"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const clusterSlots = 16384
+
+//HashSlot is the cluster slot of a key, CRC16 (XMODEM) of the key
+//or of the part in the first non-empty {hash tag}
+func HashSlot(key []byte) int {
+	if i := bytes.IndexByte(key, '{'); i >= 0 {
+		if j := bytes.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	return int(crc16(key)) % clusterSlots
+}
+
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+//slot of the keys of a command, -1 if they are not
+//all in the same one, as the server refuses (CROSSSLOT)
+func commandSlot(args [][]byte, keys []int) int {
+	slot := HashSlot(args[keys[0]])
+	for _, k := range keys[1:] {
+		if HashSlot(args[k]) != slot {
+			return -1
+		}
+	}
+	return slot
+}
+
+//slotRange is served by a master and its replicas
+type slotRange struct {
+	start    int
+	end      int
+	master   string
+	replicas []string
+}
+
+//clusterMap is the slot map of the cluster, rebuilt from the
+//CLUSTER SLOTS, SHARDS and NODES replies seen on any connection
+type clusterMap struct {
+	mu     sync.Mutex
+	ranges []slotRange
+}
+
+//replace the map, true if it changed
+func (m *clusterMap) update(ranges []slotRange) bool {
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if fmt.Sprint(ranges) == fmt.Sprint(m.ranges) {
+		return false
+	}
+	m.ranges = ranges
+	return true
+}
+
+//node of a slot after a MOVED
+func (m *clusterMap) move(slot int, node string) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, r := range m.ranges {
+		if slot < r.start || slot > r.end {
+			continue
+		}
+		if r.master == node {
+			return
+		}
+
+		//split the range around the slot
+		var split []slotRange
+		if r.start < slot {
+			split = append(split, slotRange{r.start, slot - 1, r.master, r.replicas})
+		}
+		split = append(split, slotRange{slot, slot, node, nil})
+		if slot < r.end {
+			split = append(split, slotRange{slot + 1, r.end, r.master, r.replicas})
+		}
+		m.ranges = append(m.ranges[:i], append(split, m.ranges[i+1:]...)...)
+		return
+	}
+}
+
+//master of a slot, empty if the map is not known
+func (m *clusterMap) node(slot int) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := sort.Search(len(m.ranges), func(i int) bool { return m.ranges[i].end >= slot })
+	if i < len(m.ranges) && m.ranges[i].start <= slot {
+		return m.ranges[i].master
+	}
+	return ""
+}
+
+//resolveCluster reads what the reply of c tells of the cluster:
+//redirects, the slot map, and the masters known to a sentinel.
+//Returns a summary to print instead of the generic one, if any
+func (stm *stream) resolveCluster(c *command, v *Value, e *event.Event) string {
+
+	if v.IsError() {
+		stm.resolveRedirect(c, v, e)
+		return ""
+	}
+
+	sub := ""
+	if len(c.args) > 1 {
+		sub = strings.ToUpper(string(c.args[1]))
+	}
+	switch {
+	case c.name == "CLUSTER" && sub == "SLOTS":
+		stm.updateCluster(clusterFromSlots(v), e.Time)
+	case c.name == "CLUSTER" && sub == "SHARDS":
+		stm.updateCluster(clusterFromShards(v), e.Time)
+	case c.name == "CLUSTER" && sub == "NODES":
+		stm.updateCluster(clusterFromNodes(v), e.Time)
+	case c.name == "SENTINEL":
+		return stm.resolveSentinel(sub, c, v, e)
+	}
+	return ""
+}
+
+//-MOVED slot host:port, the slot has a new master;
+//-ASK slot host:port, the slot is being migrated
+func (stm *stream) resolveRedirect(c *command, v *Value, e *event.Event) {
+
+	fields := strings.Fields(string(v.Str))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return
+	}
+	slot, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return
+	}
+	stm.redirects++
+	e.Set("redirect", fields[0]).
+		Set("redirect_slot", slot).
+		Set("redirect_node", fields[2]).
+		Set("redirects", stm.redirects)
+
+	if fields[0] == "MOVED" {
+		redis.cluster.move(slot, fields[2])
+	}
+}
+
+func (stm *stream) updateCluster(ranges []slotRange, seen time.Time) {
+
+	if len(ranges) == 0 || !redis.cluster.update(ranges) {
+		return
+	}
+
+	e := stm.newEvent(false, seen, 0)
+	e.Operation = "Cluster"
+
+	var list []map[string]interface{}
+	var text []string
+	for _, r := range ranges {
+		list = append(list, map[string]interface{}{
+			"start":    r.start,
+			"end":      r.end,
+			"master":   r.master,
+			"replicas": r.replicas,
+		})
+		line := fmt.Sprintf("%d-%d %s", r.start, r.end, r.master)
+		if len(r.replicas) > 0 {
+			line += " (" + strings.Join(r.replicas, ",") + ")"
+		}
+		text = append(text, line)
+	}
+	e.Set("slots", list)
+	e.Statement = strings.Join(text, ", ")
+	e.Text      = " Cluster slots:\n    " + strings.Join(text, "\n    ")
+	stm.emit.Emit(e)
+}
+
+//[start, end, [host, port, id], replicas...]
+func clusterFromSlots(v *Value) []slotRange {
+
+	var ranges []slotRange
+	for _, r := range v.Elems {
+		if len(r.Elems) < 3 {
+			continue
+		}
+		sr := slotRange{
+			start: int(r.Elems[0].Int),
+			end:   int(r.Elems[1].Int),
+		}
+		for i, n := range r.Elems[2:] {
+			if len(n.Elems) < 2 {
+				continue
+			}
+			addr := joinHostPort(string(n.Elems[0].Str), string(n.Elems[1].Str))
+			if i == 0 {
+				sr.master = addr
+			} else {
+				sr.replicas = append(sr.replicas, addr)
+			}
+		}
+		ranges = append(ranges, sr)
+	}
+	return ranges
+}
+
+//shards of "slots" [start, end ...] and "nodes" [{"ip", "port", "role" ...}],
+//as maps in RESP3 and arrays of pairs in RESP2
+func clusterFromShards(v *Value) []slotRange {
+
+	var ranges []slotRange
+	for _, shard := range v.Elems {
+		fields := pairs(shard)
+		slots, nodes := fields["slots"], fields["nodes"]
+		if slots == nil || nodes == nil {
+			continue
+		}
+
+		var master string
+		var replicas []string
+		for _, n := range nodes.Elems {
+			node := pairs(n)
+			host := node["endpoint"]
+			if host == nil || len(host.Str) == 0 || string(host.Str) == "?" {
+				host = node["ip"]
+			}
+			port := node["port"]
+			if port == nil {
+				port = node["tls-port"]
+			}
+			if host == nil || port == nil {
+				continue
+			}
+			addr := joinHostPort(string(host.Str), string(port.Str))
+			if role := node["role"]; role != nil && string(role.Str) == "master" {
+				master = addr
+			} else {
+				replicas = append(replicas, addr)
+			}
+		}
+		for i := 0; i+1 < len(slots.Elems); i += 2 {
+			ranges = append(ranges, slotRange{
+				start:    int(slots.Elems[i].Int),
+				end:      int(slots.Elems[i+1].Int),
+				master:   master,
+				replicas: replicas,
+			})
+		}
+	}
+	return ranges
+}
+
+//lines of "id host:port@cport[,hostname] flags master ... slots", replicas
+//name the id of their master. Slots are "start-end" or one slot
+func clusterFromNodes(v *Value) []slotRange {
+
+	type node struct {
+		addr  string
+		slots [][2]int
+	}
+	masters  := make(map[string]*node)
+	replicas := make(map[string][]string)
+	var order []string
+
+	for _, line := range strings.Split(string(v.Str), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 8 {
+			continue
+		}
+		addr := f[1]
+		if i := strings.IndexAny(addr, "@,"); i >= 0 {
+			addr = addr[:i]
+		}
+		if f[3] != "-" {
+			replicas[f[3]] = append(replicas[f[3]], addr)
+			continue
+		}
+		n := &node{addr: addr}
+		for _, s := range f[8:] {
+			//slots being imported or migrated, [slot->-id]
+			if strings.HasPrefix(s, "[") {
+				continue
+			}
+			bounds := strings.SplitN(s, "-", 2)
+			start, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				continue
+			}
+			end := start
+			if len(bounds) == 2 {
+				if end, err = strconv.Atoi(bounds[1]); err != nil {
+					continue
+				}
+			}
+			n.slots = append(n.slots, [2]int{start, end})
+		}
+		masters[f[0]] = n
+		order = append(order, f[0])
+	}
+
+	var ranges []slotRange
+	for _, id := range order {
+		n := masters[id]
+		for _, s := range n.slots {
+			ranges = append(ranges, slotRange{
+				start:    s[0],
+				end:      s[1],
+				master:   n.addr,
+				replicas: replicas[id],
+			})
+		}
+	}
+	return ranges
+}
+
+//fields of a map, or of an array of key, value pairs
+func pairs(v *Value) map[string]*Value {
+	m := make(map[string]*Value)
+	for i := 0; i+1 < len(v.Elems); i += 2 {
+		m[string(v.Elems[i].Str)] = v.Elems[i+1]
+	}
+	return m
+}
+
+func joinHostPort(host, port string) string {
+	if strings.Contains(host, ":") {
+		return "[" + host + "]:" + port
+	}
+	return host + ":" + port
+}
@@ -0,0 +1,117 @@
+package build
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashSlot(t *testing.T) {
+
+	if crc := crc16([]byte("123456789")); crc != 0x31C3 {
+		t.Errorf("crc16 %#04x, want 0x31c3", crc)
+	}
+
+	if HashSlot([]byte("{user1000}.following")) != HashSlot([]byte("{user1000}.followers")) {
+		t.Errorf("{user1000}.following and {user1000}.followers in different slots")
+	}
+
+	//the part of the key hashed
+	tests := []struct {
+		key  string
+		same string
+	}{
+		{"{user1000}.following", "user1000"},
+		{"foo{bar}{zap}", "bar"},
+		{"{}foo", "{}foo"},
+		{"foo{}{bar}", "foo{}{bar}"},
+		{"foo{{bar}}zap", "{bar"},
+		{"foo{bar", "foo{bar"},
+	}
+	for _, tt := range tests {
+		if HashSlot([]byte(tt.key)) != int(crc16([]byte(tt.same)))%clusterSlots {
+			t.Errorf("HashSlot(%q) is not the slot of %q", tt.key, tt.same)
+		}
+	}
+	if slot := HashSlot([]byte("foo")); slot != 12182 {
+		t.Errorf("HashSlot(foo) = %d, want 12182", slot)
+	}
+}
+
+//one reply of the server
+func readReply(t *testing.T, wire string) *Value {
+	t.Helper()
+	values := readValues(t, false, wire)
+	if len(values) != 1 {
+		t.Fatalf("%d values", len(values))
+	}
+	return values[0]
+}
+
+func TestClusterFromSlots(t *testing.T) {
+
+	//RESP2 and RESP3 send the same arrays
+	wire := "*2\r\n" +
+		"*4\r\n:0\r\n:5460\r\n" +
+		"*3\r\n$9\r\n127.0.0.1\r\n:30001\r\n$40\r\n09dbe9720cda62f7865eabc5fd8857c5d2678366\r\n" +
+		"*3\r\n$9\r\n127.0.0.1\r\n:30004\r\n$40\r\n821d8ca00d7ccf931ed3ffc7e3db0599d2271abf\r\n" +
+		"*3\r\n:5461\r\n:10922\r\n" +
+		"*4\r\n$7\r\n::ffff1\r\n:30002\r\n$40\r\nc9d93d9f2c0c524ff34cc11838c2003d8c29e013\r\n%0\r\n"
+
+	got := fmt.Sprint(clusterFromSlots(readReply(t, wire)))
+	want := "[{0 5460 127.0.0.1:30001 [127.0.0.1:30004]} {5461 10922 [::ffff1]:30002 []}]"
+	if got != want {
+		t.Errorf("%s, want %s", got, want)
+	}
+}
+
+func TestClusterFromShards(t *testing.T) {
+
+	nodes := func(open, pair string) string {
+		return open + "\r\n" +
+			pair + "\r\n$2\r\nid\r\n$40\r\ne10b7051d6bf2d5febd39a2be297bbaea6084111\r\n" +
+			"$4\r\nport\r\n:30001\r\n$2\r\nip\r\n$9\r\n127.0.0.1\r\n$8\r\nendpoint\r\n$9\r\n127.0.0.1\r\n" +
+			"$4\r\nrole\r\n$6\r\nmaster\r\n" +
+			pair + "\r\n$2\r\nid\r\n$40\r\n1a1e4ccf1e8a7a3e8bb5ef6fb2da7c0ec1ce8d5e\r\n" +
+			"$4\r\nport\r\n:30004\r\n$2\r\nip\r\n$9\r\n127.0.0.1\r\n$8\r\nendpoint\r\n$1\r\n?\r\n" +
+			"$4\r\nrole\r\n$7\r\nreplica\r\n"
+	}
+	tests := []struct {
+		name string
+		wire string
+	}{
+		//arrays of pairs
+		{"resp2", "*1\r\n*4\r\n$5\r\nslots\r\n*4\r\n:0\r\n:100\r\n:200\r\n:5460\r\n$5\r\nnodes\r\n" + nodes("*2", "*10")},
+		{"resp3", "*1\r\n%2\r\n$5\r\nslots\r\n*4\r\n:0\r\n:100\r\n:200\r\n:5460\r\n$5\r\nnodes\r\n" + nodes("*2", "%5")},
+	}
+
+	want := "[{0 100 127.0.0.1:30001 [127.0.0.1:30004]} {200 5460 127.0.0.1:30001 [127.0.0.1:30004]}]"
+	for _, tt := range tests {
+		if got := fmt.Sprint(clusterFromShards(readReply(t, tt.wire))); got != want {
+			t.Errorf("%s: %s, want %s", tt.name, got, want)
+		}
+	}
+}
+
+func TestClusterFromNodes(t *testing.T) {
+
+	lines := "07c37dfeb235213a872192d90877d0cd55635b91 127.0.0.1:30004@31004,replica.example replica e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 0 1426238317239 4 connected\n" +
+		"67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 127.0.0.1:30002@31002 master - 0 1426238316232 2 connected 5461-10922\n" +
+		"e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001@31001 myself,master - 0 0 1 connected 0-5460 [5461->-67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1]\n" +
+		"6ec23923021cf3ffec47632106199cb7f496ce01 127.0.0.1:30005@31005 master - 0 1426238316232 5 connected 10923 10924-16383\n"
+
+	tests := []struct {
+		name string
+		wire string
+	}{
+		{"resp2", fmt.Sprintf("$%d\r\n%s\r\n", len(lines), lines)},
+		{"resp3", fmt.Sprintf("=%d\r\ntxt:%s\r\n", len(lines)+4, lines)},
+	}
+
+	want := "[{5461 10922 127.0.0.1:30002 []} {0 5460 127.0.0.1:30001 [127.0.0.1:30004]} " +
+		"{10923 10923 127.0.0.1:30005 []} {10924 16383 127.0.0.1:30005 []}]"
+	for _, tt := range tests {
+		if got := fmt.Sprint(clusterFromNodes(readReply(t, tt.wire))); got != want {
+			t.Errorf("%s: %s, want %s", tt.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package build
+
+import (
+	"strconv"
+	"strings"
+)
+
+//names of the server commands, inline lines starting
+//with another word are not taken as commands
+var commandNames = map[string]bool{
+	"append": true, "asking": true, "auth": true, "bgrewriteaof": true, "bgsave": true,
+	"bitcount": true, "bitfield": true, "bitfield_ro": true, "bitop": true, "bitpos": true,
+	"blmove": true, "blmpop": true, "blpop": true, "brpop": true, "brpoplpush": true, "bzmpop": true,
+	"bzpopmax": true, "bzpopmin": true, "client": true, "cluster": true, "command": true,
+	"config": true, "copy": true, "dbsize": true, "debug": true, "decr": true, "decrby": true,
+	"del": true, "discard": true, "dump": true, "echo": true, "eval": true, "eval_ro": true,
+	"evalsha": true, "evalsha_ro": true, "exec": true, "exists": true, "expire": true,
+	"expireat": true, "expiretime": true, "failover": true, "fcall": true, "fcall_ro": true,
+	"flushall": true, "flushdb": true, "function": true, "geoadd": true, "geodist": true,
+	"geohash": true, "geopos": true, "georadius": true, "georadius_ro": true,
+	"georadiusbymember": true, "georadiusbymember_ro": true, "geosearch": true,
+	"geosearchstore": true, "get": true, "getbit": true, "getdel": true, "getex": true,
+	"getrange": true, "getset": true, "hdel": true, "hello": true, "hexists": true, "hexpire": true,
+	"hget": true, "hgetall": true, "hincrby": true, "hincrbyfloat": true, "hkeys": true, "hlen": true,
+	"hmget": true, "hmset": true, "hpersist": true, "hrandfield": true, "hscan": true, "hset": true,
+	"hsetnx": true, "hstrlen": true, "httl": true, "hvals": true, "incr": true, "incrby": true,
+	"incrbyfloat": true, "info": true, "keys": true, "lastsave": true, "latency": true, "lcs": true,
+	"lindex": true, "linsert": true, "llen": true, "lmove": true, "lmpop": true, "lolwut": true,
+	"lpop": true, "lpos": true, "lpush": true, "lpushx": true, "lrange": true, "lrem": true,
+	"lset": true, "ltrim": true, "memory": true, "mget": true, "migrate": true, "module": true,
+	"monitor": true, "move": true, "mset": true, "msetnx": true, "multi": true, "object": true,
+	"persist": true, "pexpire": true, "pexpireat": true, "pexpiretime": true, "pfadd": true,
+	"pfcount": true, "pfdebug": true, "pfmerge": true, "pfselftest": true, "ping": true,
+	"psetex": true, "psubscribe": true, "psync": true, "pttl": true, "publish": true, "pubsub": true,
+	"punsubscribe": true, "quit": true, "randomkey": true, "readonly": true, "readwrite": true,
+	"rename": true, "renamenx": true, "replconf": true, "replicaof": true, "reset": true,
+	"restore": true, "restore-asking": true, "role": true, "rpop": true, "rpoplpush": true,
+	"rpush": true, "rpushx": true, "sadd": true, "save": true, "scan": true, "scard": true,
+	"script": true, "sdiff": true, "sdiffstore": true, "select": true, "sentinel": true, "set": true,
+	"setbit": true, "setex": true, "setnx": true, "setrange": true, "shutdown": true, "sinter": true,
+	"sintercard": true, "sinterstore": true, "sismember": true, "slaveof": true, "slowlog": true,
+	"smembers": true, "smismember": true, "smove": true, "sort": true, "sort_ro": true, "spop": true,
+	"spublish": true, "srandmember": true, "srem": true, "sscan": true, "ssubscribe": true,
+	"strlen": true, "subscribe": true, "substr": true, "sunion": true, "sunionstore": true,
+	"sunsubscribe": true, "swapdb": true, "sync": true, "time": true, "touch": true, "ttl": true,
+	"type": true, "unlink": true, "unsubscribe": true, "unwatch": true, "wait": true, "waitaof": true,
+	"watch": true, "xack": true, "xadd": true, "xautoclaim": true, "xclaim": true, "xdel": true,
+	"xgroup": true, "xinfo": true, "xlen": true, "xpending": true, "xrange": true, "xread": true,
+	"xreadgroup": true, "xrevrange": true, "xsetid": true, "xtrim": true, "zadd": true, "zcard": true,
+	"zcount": true, "zdiff": true, "zdiffstore": true, "zincrby": true, "zinter": true,
+	"zintercard": true, "zinterstore": true, "zlexcount": true, "zmpop": true, "zmscore": true,
+	"zpopmax": true, "zpopmin": true, "zrandmember": true, "zrange": true, "zrangebylex": true,
+	"zrangebyscore": true, "zrangestore": true, "zrank": true, "zrem": true, "zremrangebylex": true,
+	"zremrangebyrank": true, "zremrangebyscore": true, "zrevrange": true, "zrevrangebylex": true,
+	"zrevrangebyscore": true, "zrevrank": true, "zscan": true, "zscore": true, "zunion": true,
+	"zunionstore": true,
+}
+
+//keySpec is where the keys of a command are, as in COMMAND INFO:
+//args first to last every step, last < 0 counts from the end.
+//numkeys is the index of a count of keys following it
+type keySpec struct {
+	first   int
+	last    int
+	step    int
+	numkeys int
+}
+
+var (
+	oneKey      = keySpec{1, 1, 1, 0}
+	allKeys     = keySpec{1, -1, 1, 0}
+	twoKeys     = keySpec{1, 2, 1, 0}
+	subcmdKey   = keySpec{2, 2, 1, 0}
+)
+
+var keySpecs = map[string]keySpec{
+	"APPEND": oneKey, "BITCOUNT": oneKey, "BITFIELD": oneKey, "BITFIELD_RO": oneKey, "BITPOS": oneKey,
+	"DECR": oneKey, "DECRBY": oneKey, "DUMP": oneKey, "EXPIRE": oneKey, "EXPIREAT": oneKey,
+	"EXPIRETIME": oneKey, "GEOADD": oneKey, "GEODIST": oneKey, "GEOHASH": oneKey, "GEOPOS": oneKey,
+	"GEORADIUS": oneKey, "GEORADIUS_RO": oneKey, "GEORADIUSBYMEMBER": oneKey,
+	"GEORADIUSBYMEMBER_RO": oneKey, "GEOSEARCH": oneKey, "GET": oneKey, "GETBIT": oneKey,
+	"GETDEL": oneKey, "GETEX": oneKey, "GETRANGE": oneKey, "GETSET": oneKey, "HDEL": oneKey,
+	"HEXISTS": oneKey, "HEXPIRE": oneKey, "HGET": oneKey, "HGETALL": oneKey, "HINCRBY": oneKey,
+	"HINCRBYFLOAT": oneKey, "HKEYS": oneKey, "HLEN": oneKey, "HMGET": oneKey, "HMSET": oneKey,
+	"HPERSIST": oneKey, "HRANDFIELD": oneKey, "HSCAN": oneKey, "HSET": oneKey, "HSETNX": oneKey,
+	"HSTRLEN": oneKey, "HTTL": oneKey, "HVALS": oneKey, "INCR": oneKey, "INCRBY": oneKey,
+	"INCRBYFLOAT": oneKey, "LINDEX": oneKey, "LINSERT": oneKey, "LLEN": oneKey, "LPOP": oneKey,
+	"LPOS": oneKey, "LPUSH": oneKey, "LPUSHX": oneKey, "LRANGE": oneKey, "LREM": oneKey,
+	"LSET": oneKey, "LTRIM": oneKey, "MOVE": oneKey, "PERSIST": oneKey, "PEXPIRE": oneKey,
+	"PEXPIREAT": oneKey, "PEXPIRETIME": oneKey, "PFADD": oneKey, "PSETEX": oneKey, "PTTL": oneKey,
+	"RESTORE": oneKey, "RESTORE-ASKING": oneKey, "RPOP": oneKey, "RPUSH": oneKey, "RPUSHX": oneKey,
+	"SADD": oneKey, "SCARD": oneKey, "SET": oneKey, "SETBIT": oneKey, "SETEX": oneKey,
+	"SETNX": oneKey, "SETRANGE": oneKey, "SISMEMBER": oneKey, "SMEMBERS": oneKey,
+	"SMISMEMBER": oneKey, "SORT": oneKey, "SORT_RO": oneKey, "SPOP": oneKey, "SRANDMEMBER": oneKey,
+	"SREM": oneKey, "SSCAN": oneKey, "STRLEN": oneKey, "SUBSTR": oneKey, "TTL": oneKey,
+	"TYPE": oneKey, "XACK": oneKey, "XADD": oneKey, "XAUTOCLAIM": oneKey, "XCLAIM": oneKey,
+	"XDEL": oneKey, "XLEN": oneKey, "XPENDING": oneKey, "XRANGE": oneKey, "XREVRANGE": oneKey,
+	"XSETID": oneKey, "XTRIM": oneKey, "ZADD": oneKey, "ZCARD": oneKey, "ZCOUNT": oneKey,
+	"ZINCRBY": oneKey, "ZLEXCOUNT": oneKey, "ZMSCORE": oneKey, "ZPOPMAX": oneKey,
+	"ZPOPMIN": oneKey, "ZRANDMEMBER": oneKey, "ZRANGE": oneKey, "ZRANGEBYLEX": oneKey,
+	"ZRANGEBYSCORE": oneKey, "ZRANK": oneKey, "ZREM": oneKey, "ZREMRANGEBYLEX": oneKey,
+	"ZREMRANGEBYRANK": oneKey, "ZREMRANGEBYSCORE": oneKey, "ZREVRANGE": oneKey,
+	"ZREVRANGEBYLEX": oneKey, "ZREVRANGEBYSCORE": oneKey, "ZREVRANK": oneKey, "ZSCAN": oneKey,
+	"ZSCORE": oneKey,
+
+	"DEL": allKeys, "EXISTS": allKeys, "MGET": allKeys, "PFCOUNT": allKeys, "PFMERGE": allKeys,
+	"SDIFF": allKeys, "SDIFFSTORE": allKeys, "SINTER": allKeys, "SINTERSTORE": allKeys,
+	"SUNION": allKeys, "SUNIONSTORE": allKeys, "TOUCH": allKeys, "UNLINK": allKeys, "WATCH": allKeys,
+
+	"BLMOVE": twoKeys, "BRPOPLPUSH": twoKeys, "COPY": twoKeys, "GEOSEARCHSTORE": twoKeys,
+	"LCS": twoKeys, "LMOVE": twoKeys, "RENAME": twoKeys, "RENAMENX": twoKeys, "RPOPLPUSH": twoKeys,
+	"SMOVE": twoKeys, "ZRANGESTORE": twoKeys,
+
+	"OBJECT": subcmdKey, "MEMORY": subcmdKey, "XINFO": subcmdKey, "XGROUP": subcmdKey,
+
+	"MSET":   {1, -1, 2, 0},
+	"MSETNX": {1, -1, 2, 0},
+	"BITOP":  {2, -1, 1, 0},
+
+	//the last argument is the timeout
+	"BLPOP":    {1, -2, 1, 0},
+	"BRPOP":    {1, -2, 1, 0},
+	"BZPOPMAX": {1, -2, 1, 0},
+	"BZPOPMIN": {1, -2, 1, 0},
+
+	"EVAL": {numkeys: 2}, "EVALSHA": {numkeys: 2}, "EVAL_RO": {numkeys: 2}, "EVALSHA_RO": {numkeys: 2},
+	"FCALL": {numkeys: 2}, "FCALL_RO": {numkeys: 2}, "BLMPOP": {numkeys: 2}, "BZMPOP": {numkeys: 2},
+	"ZDIFF": {numkeys: 1}, "ZINTER": {numkeys: 1}, "ZUNION": {numkeys: 1}, "SINTERCARD": {numkeys: 1},
+	"ZINTERCARD": {numkeys: 1}, "LMPOP": {numkeys: 1}, "ZMPOP": {numkeys: 1},
+	"ZDIFFSTORE":  {1, 1, 1, 2},
+	"ZINTERSTORE": {1, 1, 1, 2},
+	"ZUNIONSTORE": {1, 1, 1, 2},
+}
+
+//KeyIndexes returns the positions of the keys in the
+//arguments of a command, args[0] being its name
+func KeyIndexes(args [][]byte) []int {
+
+	if len(args) == 0 {
+		return nil
+	}
+	name := strings.ToUpper(string(args[0]))
+
+	//the keys follow STREAMS, then as many ids
+	if name == "XREAD" || name == "XREADGROUP" {
+		for i := 1; i < len(args); i++ {
+			if strings.EqualFold(string(args[i]), "STREAMS") {
+				n := (len(args) - i - 1) / 2
+				var keys []int
+				for j := 0; j < n; j++ {
+					keys = append(keys, i+1+j)
+				}
+				return keys
+			}
+		}
+		return nil
+	}
+
+	spec, ok := keySpecs[name]
+	if !ok {
+		return nil
+	}
+	var keys []int
+	if spec.first > 0 {
+		last := spec.last
+		if last < 0 {
+			last += len(args)
+		}
+		for i := spec.first; i <= last && i < len(args); i += spec.step {
+			keys = append(keys, i)
+		}
+	}
+	if spec.numkeys > 0 && spec.numkeys < len(args) {
+		n, err := strconv.Atoi(string(args[spec.numkeys]))
+		if err != nil || n < 0 {
+			return keys
+		}
+		for i := spec.numkeys + 1; i <= spec.numkeys+n && i < len(args); i++ {
+			keys = append(keys, i)
+		}
+	}
+	return keys
+}
@@ -1,76 +1,546 @@
 package build
 
 import (
+	"fmt"
+	"github.com/40t/go-sniffer/core/event"
 	"github.com/google/gopacket"
 	"io"
+	"log"
 	"strings"
-	"fmt"
 	"strconv"
-	"bufio"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Redis struct {
 	port int
 	version string
-	cmd chan string
-	done chan bool
+	source map[string]*stream
+	mu sync.Mutex
+
+	//keys mode, commands are aggregated by key instead of printed
+	keys *KeyStats
+	keysTop int
+
+	//slot map of the cluster, from the replies seen
+	cluster clusterMap
+
+	//text, or monitor to print the commands as MONITOR does
+	format string
 }
 
 const (
 	Port       int = 6379
 	Version string = "0.1"
 	CmdPort string = "-p"
+	CmdKeys string = "-keys"
+	CmdKeysTop string = "-keys-top"
+	CmdFormat string = "-format"
+	Protocol string = "redis"
+
+	//commands waiting for their reply are given up as lost
+	//past maxPending, or pendingTimeout after they were sent
+	maxPending     int = 1 << 16
+	pendingTimeout     = time.Minute
 )
 
 var redis = &Redis {
 	port:Port,
 	version:Version,
+	source:make(map[string]*stream),
+	keysTop:DefaultKeysTop,
+	format:FormatText,
 }
 
 func NewInstance() *Redis{
 	return redis
 }
 
-func (red Redis) ResolveStream(net, transport gopacket.Flow, r io.Reader) {
+//stream is a connection, the values of both
+//directions are resolved in the order they are read
+type stream struct {
+	messages chan *message
+	flows    int
+	done     chan bool
+
+	emit     event.Emitter
+	client   string
+	server   string
+
+	//commands waiting for their reply, replies come in the
+	//order of the commands, pipelined or not
+	pending  []*command
+
+	//round-trip of the last command
+	trip     *roundTrip
+
+	//CLIENT REPLY OFF, or SKIP for the next commands
+	replyOff  bool
+	replySkip int
+
+	//replies decoded in full are expected, the others are
+	//trimmed by the reader of the server. Counted when read
+	decoding  int32
+
+	//MULTI ... EXEC being queued
+	tx       *transaction
+
+	//subscriber mode, the server sends messages
+	//the commands did not ask for
+	subscriptions int64
+	subscribed    int32
+	channels      map[string]map[string]bool
+
+	//-MOVED and -ASK replies of the connection
+	redirects     int
+
+	//database selected, and the output of monitor mode
+	db            int
+	monitorOut    event.Emitter
+}
+
+type message struct {
+	isClient bool
+	value    *Value
+	seen     time.Time
+
+	//values before this one were lost
+	gap      bool
+}
+
+type command struct {
+	event *event.Event
+	name  string
+	args  [][]byte
+	keys  []int
+	trip  *roundTrip
+
+	//(un)subscribe, replies still expected
+	confirm int
+	bytes   int
+
+	//its reply is decoded in full
+	decode  bool
+}
+
+//a pipeline is the commands sent before the reply of the first one
+type roundTrip struct {
+	depth   int
+	replied bool
+}
+
+func (red *Redis) ResolveStream(net, transport gopacket.Flow, r io.Reader, emit event.Emitter) {
+
+	//uuid
+	uuid := fmt.Sprintf("%v:%v", net.FastHash(), transport.FastHash())
+
+	//keys mode
+	if red.keys != nil {
+		red.keys.SetOutput(emit)
+		emit = red.keys
+	}
 
-	buf := bufio.NewReader(r)
-	var cmd string
-	var cmdCount = 0
+	red.mu.Lock()
+	stm, ok := red.source[uuid]
+	if !ok {
+		stm = &stream{
+			messages: make(chan *message, 100),
+			done:     make(chan bool),
+			emit:     emit,
+		}
+		stm.client, stm.server = event.Endpoints(net, transport, red.port)
+		if red.format == FormatMonitor {
+			stm.monitorOut = emit
+			stm.emit       = discard
+		}
+		red.source[uuid] = stm
+		go stm.resolve()
+	}
+	stm.flows++
+	red.mu.Unlock()
+
+	//server -> client || client -> server
+	rr := newRespReader(r, transport.Src().String() != strconv.Itoa(red.port))
+	if !rr.isClient {
+		rr.full = stm.decodeFull
+	}
 	for {
+		v, err := rr.next()
+		if err != nil {
+			break
+		}
+		if rr.isClient && decodes(v.Args()) {
+			atomic.AddInt32(&stm.decoding, 1)
+		}
+		stm.messages <- &message{
+			isClient: rr.isClient,
+			value:    v,
+			seen:     event.Seen(r),
+			gap:      rr.gap,
+		}
+	}
+
+	//both directions closed, wait for pending values
+	red.mu.Lock()
+	stm.flows--
+	if stm.flows > 0 {
+		red.mu.Unlock()
+		return
+	}
+	delete(red.source, uuid)
+	red.mu.Unlock()
+
+	close(stm.messages)
+	<-stm.done
+}
+
+func (stm *stream) resolve() {
+	for m := range stm.messages {
+		stm.resolveMessage(m)
+	}
+
+	//transaction without EXEC, commands without reply
+	stm.flushTransaction()
+	for _, c := range stm.pending {
+		stm.emit.Emit(c.event)
+	}
+	stm.pending = nil
+	close(stm.done)
+}
+
+//the commands of a transaction, as they were sent
+func (stm *stream) flushTransaction() {
+	if tx := stm.tx; tx != nil {
+		stm.emit.Emit(tx.multi.event)
+		for _, c := range tx.commands {
+			stm.emit.Emit(c.event)
+		}
+		stm.tx = nil
+	}
+}
+
+//a malformed value must not stop the stream
+func (stm *stream) resolveMessage(m *message) {
+
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println("ERR : Resolve value", err)
+		}
+	}()
+
+	if m.isClient {
+		stm.resolveCommand(m.value, m.seen)
+		return
+	}
+
+	//the replies lost, every command waiting would
+	//be paired with the reply of another one
+	if m.gap {
+		stm.flushTransaction()
+		for len(stm.pending) > 0 {
+			stm.loseReply(stm.popPending())
+		}
+	}
+	stm.resolveReply(m.value, m.seen)
+}
 
-		line, _, _ := buf.ReadLine()
+func (stm *stream) resolveCommand(v *Value, seen time.Time) {
 
-		if len(line) == 0 {
-			buff := make([]byte, 1)
-			_, err := r.Read(buff)
-			if err == io.EOF {
-				red.done <- true
-				return
+	args := v.Args()
+	if len(args) == 0 {
+		return
+	}
+
+	cmd := ""
+	for i, arg := range args {
+		cmd += " " + formatArg(arg)
+		if v.Elems[i].Truncated() {
+			cmd += "..."
+		}
+	}
+
+	name := strings.ToUpper(string(args[0]))
+	if stm.monitorOut != nil {
+		stm.monitor(args, seen, v.Size)
+	}
+
+	e := stm.newEvent(true, seen, v.Size)
+	e.Text      = cmd
+	e.Operation = name
+	e.Statement = strings.TrimSpace(cmd)
+	e.Set("db", stm.db)
+	stm.selectDB(name, args)
+
+	keys := KeyIndexes(args)
+	if len(keys) > 0 {
+		names := make([]string, len(keys))
+		for i, k := range keys {
+			names[i] = string(args[k])
+		}
+		e.Set("keys", names)
+
+		//the slot, and its master when the map is known
+		if slot := commandSlot(args, keys); slot < 0 {
+			e.Set("cross_slot", true)
+		} else {
+			e.Set("slot", slot)
+			if node := redis.cluster.node(slot); node != "" {
+				e.Set("slot_node", node)
 			}
 		}
+	}
 
-		//Filtering useless data
-		if !strings.HasPrefix(string(line), "*") {
-			continue
+	c := &command{
+		event:  e,
+		name:   e.Operation,
+		args:   args,
+		keys:   keys,
+		decode: decodes(args),
+	}
+
+	//CLIENT REPLY OFF and SKIP, the server does not reply
+	if !stm.expectReply(c) {
+		if c.decode {
+			atomic.AddInt32(&stm.decoding, -1)
 		}
+		e.Set("no_reply", true)
+		e.Text += " => (no reply)"
+		stm.emit.Emit(e)
+		return
+	}
+
+	//replies never seen, as of a one-way capture
+	for len(stm.pending) > 0 && (len(stm.pending) >= maxPending || seen.Sub(stm.pending[0].event.Time) > pendingTimeout) {
+		stm.loseReply(stm.popPending())
+	}
+
+	if stm.trip == nil || stm.trip.replied || len(stm.pending) == 0 {
+		stm.trip = &roundTrip{}
+	}
+	stm.trip.depth++
+	c.trip    = stm.trip
+	c.confirm = stm.confirmations(c)
+	stm.pending = append(stm.pending, c)
+}
+
+//false if the server sends no reply to c, CLIENT REPLY
+//SKIP drops the reply of the next command, OFF all of them
+func (stm *stream) expectReply(c *command) bool {
+
+	skip := stm.replySkip > 0
+	if skip {
+		stm.replySkip--
+	}
+	if c.name == "CLIENT" && len(c.args) == 3 && strings.ToUpper(string(c.args[1])) == "REPLY" {
+		switch strings.ToUpper(string(c.args[2])) {
+		case "ON":
+			stm.replyOff = false
+			return true
+		case "OFF":
+			stm.replyOff = true
+			return false
+		case "SKIP":
+			stm.replySkip = 1
+			return false
+		}
+	}
+	return !stm.replyOff && !skip
+}
+
+//a command whose reply was not seen
+func (stm *stream) loseReply(c *command) {
+	c.event.Set("reply_lost", true)
+	c.event.Text += " => (reply lost)"
+	stm.emit.Emit(c.event)
+}
+
+func (stm *stream) resolveReply(v *Value, seen time.Time) {
+
+	e := stm.newEvent(false, seen, v.Size)
+	e.Operation = "Reply"
+	e.Status    = "OK"
+	e.Set("reply_type", v.TypeName())
+	if v.IsError() {
+		e.Status = "ERR"
+		e.Error  = string(v.Str)
+		e.Set("error_code", v.ErrorCode())
+	}
+	switch {
+	case v.Type == respInteger:
+		e.Set("integer", v.Int)
+	case v.IsAggregate():
+		e.Set("elements", v.Len)
+	}
+	reply := v.Summary()
 
-		//Do not display
-		if strings.EqualFold(transport.Src().String(), strconv.Itoa(red.port)) == true {
-			continue
+	if stm.resolvePubSub(v, e) {
+		return
+	}
+
+	//out of band, not the reply of a command
+	if v.Type == respPush || len(stm.pending) == 0 {
+		if v.Type == respPush {
+			e.Operation = "Push"
 		}
+		e.Statement = reply
+		e.Text      = " " + reply
+		stm.emit.Emit(e)
+		return
+	}
 
-		//run
-		l := string(line[1])
-		cmdCount, _ = strconv.Atoi(l)
-		cmd = ""
-		for j := 0; j < cmdCount * 2; j++ {
-			c, _, _ := buf.ReadLine()
-			if j & 1 == 0 {
-				continue
+	c := stm.popPending()
+	if stm.resolveTransaction(c, v, e, reply) {
+		return
+	}
+	if r := stm.resolveCluster(c, v, e); r != "" {
+		reply = r
+	}
+	if redis.keys != nil && len(c.keys) > 0 {
+		e.Set("value_bytes", c.valueSizes(v))
+	}
+	stm.completeCommand(c, e, reply)
+}
+
+//the command the next reply is for
+func (stm *stream) popPending() *command {
+	c := stm.pending[0]
+	c.trip.replied = true
+	if c.decode {
+		atomic.AddInt32(&stm.decoding, -1)
+	}
+	stm.pending[0] = nil
+	stm.pending = stm.pending[1:]
+	return c
+}
+
+//attach the reply to the command, latency is
+//measured between capture timestamps
+func (stm *stream) completeCommand(c *command, resp *event.Event, reply string) {
+
+	req := c.event
+	req.Latency = resp.Time.Sub(req.Time)
+	req.Status  = resp.Status
+	req.Error   = resp.Error
+	for k, v := range resp.Attrs {
+		req.Set(k, v)
+	}
+	req.Set("response_bytes", resp.Bytes)
+	req.Set("pipeline", c.trip.depth)
+
+	req.Text += fmt.Sprintf(" => %s Size:%d Time:%.3fms",
+		reply, resp.Bytes, float64(req.Latency) / float64(time.Millisecond))
+	if c.trip.depth > 1 {
+		req.Text += fmt.Sprintf(" Pipeline:%d", c.trip.depth)
+	}
+	stm.emit.Emit(req)
+}
+
+//replies decoded in full, the others are only summarised
+func decodes(args [][]byte) bool {
+	if len(args) == 0 {
+		return false
+	}
+	name := strings.ToUpper(string(args[0]))
+	_, sub := subscribeKinds[name]
+	return sub || name == "CLUSTER" || name == "SENTINEL"
+}
+
+//the reader of the server keeps the next reply in full,
+//the command is pending or a message of subscriber mode
+func (stm *stream) decodeFull() bool {
+	return atomic.LoadInt32(&stm.decoding) > 0 || atomic.LoadInt32(&stm.subscribed) > 0
+}
+
+func (stm *stream) newEvent(isClient bool, seen time.Time, size int) *event.Event {
+
+	e := &event.Event{
+		Time:     seen,
+		Client:   stm.client,
+		Server:   stm.server,
+		Protocol: Protocol,
+		Bytes:    size,
+	}
+	if isClient {
+		e.Direction = event.Request
+	} else {
+		e.Direction = event.Response
+	}
+	return e
+}
+
+//arguments with spaces, quotes or binary bytes are quoted
+func formatArg(arg []byte) string {
+	if len(arg) == 0 {
+		return `""`
+	}
+	for _, c := range arg {
+		if c <= ' ' || c == '"' || c == '\'' || c == '\\' || c >= 0x7f {
+			return strconv.Quote(string(arg))
+		}
+	}
+	return string(arg)
+}
+
+//size of the value of each key, written by the command
+//or read in the reply, 0 when unknown
+func (c *command) valueSizes(reply *Value) []int {
+
+	sizes := make([]int, len(c.keys))
+
+	//one value per key
+	switch c.name {
+	case "MGET":
+		if reply.Type == respArray && len(reply.Elems) == len(c.keys) {
+			for i, e := range reply.Elems {
+				if !e.IsNull() {
+					sizes[i] = e.Len
+				}
 			}
-			cmd += " " + string(c)
 		}
-		fmt.Println(cmd)
+		return sizes
+	case "MSET", "MSETNX":
+		for i, k := range c.keys {
+			if k+1 < len(c.args) {
+				sizes[i] = len(c.args[k+1])
+			}
+		}
+		return sizes
+	}
+	if len(c.keys) > 1 {
+		return sizes
+	}
+
+	//arguments after the key, or the reply
+	for _, arg := range c.args[c.keys[0]+1:] {
+		sizes[0] += len(arg)
+	}
+	read := 0
+	switch {
+	case reply.Type == respBulk || reply.Type == respVerbatim:
+		read = reply.Len
+	case reply.IsAggregate():
+		read = reply.Size
+	}
+	if read > sizes[0] {
+		sizes[0] = read
+	}
+	return sizes
+}
+
+//report the keys when the capture ends
+func (red *Redis) Flush(emit event.Emitter) {
+	if red.keys != nil {
+		red.keys.SetOutput(emit)
+		red.keys.Flush()
+	}
+}
+
+//keys mode of a live capture, tables due by now
+func (red *Redis) Tick(now time.Time, emit event.Emitter) {
+	if red.keys != nil {
+		red.keys.SetOutput(emit)
+		red.keys.Tick(now)
 	}
 }
 
@@ -82,7 +552,7 @@ func (red *Redis) SetFlag(flg []string)  {
 	if c == 0 {
 		return
 	}
-	if c >> 1 != 1 {
+	if c & 1 != 0 {
 		panic("ERR : Redis num of params")
 	}
 	for i:=0;i<c;i=i+2 {
@@ -100,10 +570,33 @@ func (red *Redis) SetFlag(flg []string)  {
 				panic("ERR : Port(0-65535)")
 			}
 			break
+		case CmdKeys:
+			interval, err := strconv.Atoi(val)
+			if err != nil || interval < 0 {
+				panic("ERR : keys")
+			}
+			redis.keys = NewKeyStats(time.Duration(interval) * time.Second, redis.keysTop)
+		case CmdKeysTop:
+			top, err := strconv.Atoi(val)
+			if err != nil || top < 0 {
+				panic("ERR : keys-top")
+			}
+			redis.keysTop = top
+		case CmdFormat:
+			if val != FormatText && val != FormatMonitor {
+				panic("ERR : format(text, monitor)")
+			}
+			redis.format = val
 		default:
 			panic("ERR : redis's params")
 		}
 	}
+	if redis.keys != nil {
+		redis.keys.top = redis.keysTop
+		if redis.format == FormatMonitor {
+			panic("ERR : keys with format monitor")
+		}
+	}
 }
 
 /**
@@ -0,0 +1,85 @@
+package build
+
+import (
+	"github.com/40t/go-sniffer/core/event"
+	"strings"
+	"testing"
+	"time"
+)
+
+//commands of a connection with their reply, as printed
+func record(t *testing.T, start time.Time, steps ...[2]string) []*event.Event {
+	t.Helper()
+	var rows []*event.Event
+	stm := &stream{emit: event.EmitterFunc(func(e *event.Event) { rows = append(rows, e) })}
+	for i, step := range steps {
+		converse(t, stm, start.Add(time.Duration(i)*time.Second), step[0]+step[1])
+	}
+	return rows
+}
+
+func texts(rows []*event.Event) []string {
+	var list []string
+	for _, e := range rows {
+		list = append(list, strings.SplitN(e.Text, " Size:", 2)[0])
+	}
+	return list
+}
+
+func TestPendingExpired(t *testing.T) {
+
+	//one-way capture, commands are given up after pendingTimeout
+	start := time.Date(2026, 10, 18, 15, 4, 5, 0, time.UTC)
+	var rows []*event.Event
+	stm := &stream{emit: event.EmitterFunc(func(e *event.Event) { rows = append(rows, e) })}
+	converse(t, stm, start, "C*2\r\n$3\r\nGET\r\n$1\r\na\r\n")
+	converse(t, stm, start.Add(pendingTimeout/2), "C*2\r\n$3\r\nGET\r\n$1\r\nb\r\n")
+	if len(rows) != 0 {
+		t.Fatalf("expired before the timeout: %q", texts(rows))
+	}
+	converse(t, stm, start.Add(pendingTimeout+time.Second), "C*2\r\n$3\r\nGET\r\n$1\r\nc\r\n")
+	if len(rows) != 1 || rows[0].Statement != "GET a" || rows[0].Attrs["reply_lost"] != true {
+		t.Fatalf("expired %q", texts(rows))
+	}
+	if len(stm.pending) != 2 {
+		t.Errorf("%d pending", len(stm.pending))
+	}
+}
+
+func TestPendingGap(t *testing.T) {
+
+	//the reply of GET a is cut, GET b is not paired with it
+	rows := record(t, time.Now(),
+		[2]string{"C", "*2\r\n$3\r\nGET\r\n$1\r\na\r\n*2\r\n$3\r\nGET\r\n$1\r\nb\r\n"},
+		[2]string{"S", "$1\r\nabc\r\n:1\r\n"},
+		[2]string{"C", "*1\r\n$4\r\nPING\r\n"},
+		[2]string{"S", "+PONG\r\n"})
+
+	want := []string{" GET a => (reply lost)", " GET b => (reply lost)", " (integer) 1", " PING => PONG"}
+	if got := texts(rows); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("%q, want %q", got, want)
+	}
+}
+
+func TestClientReply(t *testing.T) {
+
+	rows := record(t, time.Now(),
+		[2]string{"C", "*3\r\n$6\r\nCLIENT\r\n$5\r\nREPLY\r\n$4\r\nSKIP\r\n*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n"},
+		[2]string{"C", "*2\r\n$3\r\nGET\r\n$1\r\na\r\n"},
+		[2]string{"S", "$1\r\n1\r\n"},
+		[2]string{"C", "*3\r\n$6\r\nCLIENT\r\n$5\r\nREPLY\r\n$3\r\nOFF\r\n*2\r\n$3\r\nGET\r\n$1\r\nb\r\n"},
+		[2]string{"C", "*3\r\n$6\r\nCLIENT\r\n$5\r\nREPLY\r\n$2\r\nON\r\n"},
+		[2]string{"S", "+OK\r\n"})
+
+	want := []string{
+		" CLIENT REPLY SKIP => (no reply)",
+		" SET a 1 => (no reply)",
+		` GET a => "1"`,
+		" CLIENT REPLY OFF => (no reply)",
+		" GET b => (no reply)",
+		" CLIENT REPLY ON => OK",
+	}
+	if got := texts(rows); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("%q, want %q", got, want)
+	}
+}
@@ -0,0 +1,206 @@
+package build
+
+import (
+	"fmt"
+	"github.com/40t/go-sniffer/core/event"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultKeysTop = 20
+
+	//keys counted per report, more are left out
+	keysTracked = 1 << 20
+)
+
+//KeyStats aggregates commands by key instead of printing them, and
+//reports the hot keys, by requests and by bytes, and the big keys,
+//by the largest value seen. It is the emitter of the streams in keys mode
+type KeyStats struct {
+	mu       sync.Mutex
+	interval event.Interval
+	top      int
+	out      event.Emitter
+	dropped  int
+	keys     map[string]*keyStats
+}
+
+type keyStats struct {
+	key       string
+	requests  int
+	bytesIn   int64
+	bytesOut  int64
+
+	//largest value, and the command it was seen with
+	maxValue  int
+	command   string
+}
+
+func NewKeyStats(interval time.Duration, top int) *KeyStats {
+	return &KeyStats{
+		interval: event.Interval{Every: interval},
+		top:      top,
+		keys:     make(map[string]*keyStats),
+	}
+}
+
+//tables are emitted to out
+func (k *KeyStats) SetOutput(out event.Emitter) {
+	k.mu.Lock()
+	k.out = out
+	k.mu.Unlock()
+}
+
+//add a command event, the bytes of a command are
+//shared by its keys, other events are dropped
+func (k *KeyStats) Emit(e *event.Event) {
+
+	keys, _ := e.Attrs["keys"].([]string)
+	if e.Direction != event.Request || len(keys) == 0 {
+		return
+	}
+	values, _ := e.Attrs["value_bytes"].([]int)
+	out, _    := e.Attrs["response_bytes"].(int)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	due := k.interval.Add(e.Time)
+	for i, key := range keys {
+		s, ok := k.keys[key]
+		if !ok {
+			if len(k.keys) >= keysTracked {
+				k.dropped++
+				continue
+			}
+			s = &keyStats{key: key}
+			k.keys[key] = s
+		}
+		s.requests++
+		s.bytesIn  += int64(e.Bytes / len(keys))
+		s.bytesOut += int64(out / len(keys))
+		if i < len(values) && values[i] > s.maxValue {
+			s.maxValue = values[i]
+			s.command  = e.Operation
+		}
+	}
+
+	if due {
+		k.report()
+	}
+}
+
+//tables are due on the wall clock too, when no
+//command comes to close the report
+func (k *KeyStats) Tick(now time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.interval.Due(now) {
+		k.report()
+	}
+}
+
+//last tables, at the end of the capture
+func (k *KeyStats) Flush() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.report()
+}
+
+//three tables of the top keys: by requests, by bytes read and
+//written, and by largest value. One event per row, the first
+//one of a table also carries its header
+func (k *KeyStats) report() {
+
+	iv := &k.interval
+	if iv.Count == 0 || k.out == nil {
+		return
+	}
+
+	//rate over the report, at least a second
+	seconds := iv.Last.Sub(iv.Start).Seconds()
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	header := fmt.Sprintf("# Keys %s - %s, %d commands, %d keys",
+		iv.Start.Format("2006-01-02 15:04:05"), iv.Last.Format("2006-01-02 15:04:05"), iv.Count, len(k.keys))
+	if k.dropped > 0 {
+		header += fmt.Sprintf(", %d not counted", k.dropped)
+	}
+	header += "\n"
+
+	k.table("requests", header+fmt.Sprintf("# Hot keys by requests\n# %4s %9s %9s  %s\n", "Rank", "Count", "Rate(/s)", "Key"),
+		func(a, b *keyStats) bool { return a.requests > b.requests },
+		func(s *keyStats) string {
+			return fmt.Sprintf("%9d %9.1f", s.requests, float64(s.requests)/seconds)
+		}, seconds)
+
+	k.table("bytes", fmt.Sprintf("# Hot keys by bytes\n# %4s %12s %12s  %s\n", "Rank", "Written", "Read", "Key"),
+		func(a, b *keyStats) bool { return a.bytesIn+a.bytesOut > b.bytesIn+b.bytesOut },
+		func(s *keyStats) string {
+			return fmt.Sprintf("%12d %12d", s.bytesIn, s.bytesOut)
+		}, seconds)
+
+	k.table("value", fmt.Sprintf("# Big keys by largest value\n# %4s %12s %-12s  %s\n", "Rank", "Size", "Command", "Key"),
+		func(a, b *keyStats) bool { return a.maxValue > b.maxValue },
+		func(s *keyStats) string {
+			return fmt.Sprintf("%12d %-12s", s.maxValue, s.command)
+		}, seconds)
+
+	iv.Reset()
+	k.dropped = 0
+	k.keys    = make(map[string]*keyStats)
+}
+
+func (k *KeyStats) table(by, header string, less func(a, b *keyStats) bool, columns func(s *keyStats) string, seconds float64) {
+
+	list := make([]*keyStats, 0, len(k.keys))
+	for _, s := range k.keys {
+		if by == "value" && s.maxValue == 0 {
+			continue
+		}
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		switch {
+		case less(list[i], list[j]):
+			return true
+		case less(list[j], list[i]):
+			return false
+		}
+		return list[i].key < list[j].key
+	})
+	if k.top > 0 && len(list) > k.top {
+		list = list[:k.top]
+	}
+
+	for i, s := range list {
+		e := &event.Event{
+			Time:      k.interval.Last,
+			Protocol:  Protocol,
+			Operation: "Keys",
+			Statement: s.key,
+		}
+		e.Set("rank_by", by).
+			Set("rank", i+1).
+			Set("requests", s.requests).
+			Set("rate", float64(s.requests)/seconds).
+			Set("bytes_written", s.bytesIn).
+			Set("bytes_read", s.bytesOut).
+			Set("max_value_bytes", s.maxValue).
+			Set("from", k.interval.Start).
+			Set("to", k.interval.Last)
+		if s.command != "" {
+			e.Set("max_value_command", s.command)
+		}
+
+		e.Text = fmt.Sprintf("  %4d %s  %s", i+1, columns(s), formatArg([]byte(s.key)))
+		if i == 0 {
+			e.Text = header + e.Text
+		}
+		k.out.Emit(e)
+	}
+}
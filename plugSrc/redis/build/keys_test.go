@@ -0,0 +1,82 @@
+package build
+
+import (
+	"github.com/40t/go-sniffer/core/event"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+//resolve the commands and replies of a connection in order,
+//steps are "C" or "S" followed by the bytes of that direction
+func converse(t *testing.T, stm *stream, seen time.Time, steps ...string) {
+	t.Helper()
+	for _, step := range steps {
+		rr := newRespReader(strings.NewReader(step[1:]), step[0] == 'C')
+		for {
+			v, err := rr.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%q: %v", step, err)
+			}
+			stm.resolveMessage(&message{isClient: rr.isClient, value: v, seen: seen, gap: rr.gap})
+		}
+	}
+}
+
+func TestKeysTransaction(t *testing.T) {
+
+	keys := NewKeyStats(0, 10)
+	var rows []*event.Event
+	keys.SetOutput(event.EmitterFunc(func(e *event.Event) { rows = append(rows, e) }))
+
+	redis.keys = keys
+	defer func() { redis.keys = nil }()
+
+	//commands queued in MULTI are counted by key
+	stm := &stream{emit: keys}
+	converse(t, stm, time.Now(),
+		"C*1\r\n$5\r\nMULTI\r\n", "S+OK\r\n",
+		"C*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\nvalue\r\n*2\r\n$4\r\nINCR\r\n$1\r\nn\r\n",
+		"S+QUEUED\r\n+QUEUED\r\n",
+		"C*1\r\n$4\r\nEXEC\r\n", "S*2\r\n+OK\r\n:1\r\n",
+		"C*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", "S$5\r\nvalue\r\n")
+	keys.Flush()
+
+	requests := make(map[string]int)
+	for _, e := range rows {
+		if e.Attrs["rank_by"] == "requests" {
+			requests[e.Statement] = e.Attrs["requests"].(int)
+		}
+	}
+	if requests["k"] != 2 || requests["n"] != 1 || len(requests) != 2 {
+		t.Errorf("requests by key %v", requests)
+	}
+}
+
+func TestKeysTick(t *testing.T) {
+
+	keys := NewKeyStats(10*time.Second, 10)
+	var rows []*event.Event
+	keys.SetOutput(event.EmitterFunc(func(e *event.Event) { rows = append(rows, e) }))
+
+	start := time.Date(2026, 10, 18, 15, 4, 5, 0, time.UTC)
+	keys.Emit(&event.Event{
+		Time:      start,
+		Direction: event.Request,
+		Operation: "GET",
+		Attrs:     map[string]interface{}{"keys": []string{"k"}},
+	})
+
+	keys.Tick(start.Add(9 * time.Second))
+	if len(rows) != 0 {
+		t.Fatalf("reported before the interval: %d rows", len(rows))
+	}
+	keys.Tick(start.Add(10 * time.Second))
+	if len(rows) == 0 {
+		t.Fatalf("not reported after the interval")
+	}
+}
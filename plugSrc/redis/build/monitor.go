@@ -0,0 +1,127 @@
+package build
+
+import (
+	"fmt"
+	"github.com/40t/go-sniffer/core/event"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatText    = "text"
+	FormatMonitor = "monitor"
+)
+
+//the other events of a stream in monitor mode,
+//only the lines of the commands are printed
+var discard = event.EmitterFunc(func(e *event.Event) {})
+
+//selectDB follows the database of the connection, when the command
+//is read, as the server runs it before the next one of a pipeline.
+//Connections open before the capture are taken to be on 0
+func (stm *stream) selectDB(name string, args [][]byte) {
+	switch name {
+	case "SELECT":
+		if len(args) == 2 {
+			if db, err := strconv.Atoi(string(args[1])); err == nil && db >= 0 {
+				stm.db = db
+			}
+		}
+	case "RESET":
+		stm.db = 0
+	}
+}
+
+//monitor prints the command as MONITOR does:
+//1339518083.107412 [0 127.0.0.1:60866] "keys" "*"
+func (stm *stream) monitor(args [][]byte, seen time.Time, size int) {
+
+	secret := redact(args)
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if secret[i] {
+			quoted[i] = `"(redacted)"`
+		} else {
+			quoted[i] = quoteMonitor(arg)
+		}
+	}
+
+	e := stm.newEvent(true, seen, size)
+	e.Operation = strings.ToUpper(string(args[0]))
+	e.Statement = strings.Join(quoted, " ")
+	e.Text      = fmt.Sprintf("%d.%06d [%d %s] %s", seen.Unix(), seen.Nanosecond()/1000, stm.db, stm.client, e.Statement)
+	e.Set("db", stm.db)
+	stm.monitorOut.Emit(e)
+}
+
+//arguments the server does not print: those of AUTH,
+//and the credentials of HELLO AUTH and MIGRATE AUTH/AUTH2
+func redact(args [][]byte) []bool {
+
+	secret := make([]bool, len(args))
+	switch strings.ToUpper(string(args[0])) {
+	case "AUTH":
+		for i := 1; i < len(args); i++ {
+			secret[i] = true
+		}
+	case "HELLO":
+		for i := 1; i < len(args); i++ {
+			if strings.EqualFold(string(args[i]), "AUTH") && i+2 < len(args) {
+				secret[i+1], secret[i+2] = true, true
+				i += 2
+			}
+		}
+	case "MIGRATE":
+		for i := 6; i < len(args); i++ {
+			switch strings.ToUpper(string(args[i])) {
+			case "AUTH":
+				if i+1 < len(args) {
+					secret[i+1] = true
+					i++
+				}
+			case "AUTH2":
+				if i+2 < len(args) {
+					secret[i+1], secret[i+2] = true, true
+					i += 2
+				}
+			case "KEYS":
+				return secret
+			}
+		}
+	}
+	return secret
+}
+
+//quoteMonitor quotes like sdscatrepr: \\ \" \n \r \t \a \b escaped,
+//other bytes out of the printable range as \xhh
+func quoteMonitor(arg []byte) string {
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range arg {
+		switch c {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\a':
+			b.WriteString(`\a`)
+		case '\b':
+			b.WriteString(`\b`)
+		default:
+			if c >= 0x20 && c <= 0x7e {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, `\x%02x`, c)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,115 @@
+package build
+
+import (
+	"fmt"
+	"github.com/40t/go-sniffer/core/event"
+	"strings"
+	"time"
+)
+
+//transaction is MULTI ... EXEC, the server queues the commands
+//and sends their replies in the one of EXEC
+type transaction struct {
+	multi    *command
+	commands []*command
+
+	//reply to the command while queued, QUEUED or an error
+	queued   []*Value
+	bytes    int
+}
+
+//resolveTransaction groups the commands of MULTI ... EXEC or DISCARD
+//in one record, true if c is part of a transaction
+func (stm *stream) resolveTransaction(c *command, v *Value, resp *event.Event, reply string) bool {
+
+	tx := stm.tx
+	if tx == nil {
+		if c.name != "MULTI" || v.IsError() {
+			return false
+		}
+		stm.tx = &transaction{
+			multi: c,
+			bytes: resp.Bytes,
+		}
+		return true
+	}
+
+	tx.bytes += resp.Bytes
+	if c.name != "EXEC" && c.name != "DISCARD" {
+		tx.commands = append(tx.commands, c)
+		tx.queued   = append(tx.queued, v)
+		return true
+	}
+	stm.tx = nil
+	stm.completeTransaction(tx, c, v, resp, reply)
+	return true
+}
+
+func (stm *stream) completeTransaction(tx *transaction, end *command, v *Value, resp *event.Event, reply string) {
+
+	req := tx.multi.event
+	req.Operation = "MULTI"
+	req.Latency   = resp.Time.Sub(req.Time)
+	req.Status    = resp.Status
+	req.Error     = resp.Error
+	req.Bytes    += end.event.Bytes
+	req.Set("response_bytes", tx.bytes)
+
+	//EXEC replies with one value per queued command, nil
+	//if a WATCHed key changed, an error if one was refused
+	result := "exec"
+	switch {
+	case end.name == "DISCARD":
+		result = "discard"
+	case v.IsNull():
+		result = "aborted"
+		req.Status = "ABORTED"
+	case v.IsError():
+		result = "error"
+	}
+	req.Set("transaction", result)
+
+	statements := []string{"MULTI"}
+	commands   := make([]map[string]interface{}, 0, len(tx.commands))
+	lines      := ""
+	failed     := 0
+	next       := 0
+	for i, c := range tx.commands {
+		req.Bytes += c.event.Bytes
+		statements = append(statements, c.event.Statement)
+
+		r := tx.queued[i]
+		if !r.IsError() && result == "exec" && next < len(v.Elems) {
+			r = v.Elems[next]
+			next++
+		}
+		status := "OK"
+		if r.IsError() {
+			status = "ERR"
+			failed++
+		}
+		commands = append(commands, map[string]interface{}{
+			"statement": c.event.Statement,
+			"reply":     r.Summary(),
+			"status":    status,
+		})
+		lines += fmt.Sprintf("\n    %s => %s", c.event.Statement, r.Summary())
+
+		//keys mode counts the commands, not the transaction
+		if redis.keys != nil && len(c.keys) > 0 {
+			c.event.Set("response_bytes", r.Size)
+			c.event.Set("value_bytes", c.valueSizes(r))
+			stm.emit.Emit(c.event)
+		}
+	}
+	statements = append(statements, end.name)
+
+	req.Statement = strings.Join(statements, "; ")
+	req.Set("commands", commands)
+	if failed > 0 {
+		req.Set("errors", failed)
+	}
+	req.Text = fmt.Sprintf(" %s => %s Size:%d Time:%.3fms", req.Statement,
+		reply, tx.bytes, float64(req.Latency) / float64(time.Millisecond)) + lines
+	stm.emit.Emit(req)
+}
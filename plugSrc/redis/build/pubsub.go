@@ -0,0 +1,157 @@
+package build
+
+import (
+	"fmt"
+	"github.com/40t/go-sniffer/core/event"
+	"strings"
+	"sync/atomic"
+)
+
+//(un)subscribe commands, with the kind of their replies, one per channel
+var subscribeKinds = map[string]string{
+	"SUBSCRIBE":    "subscribe",
+	"PSUBSCRIBE":   "psubscribe",
+	"SSUBSCRIBE":   "ssubscribe",
+	"UNSUBSCRIBE":  "unsubscribe",
+	"PUNSUBSCRIBE": "punsubscribe",
+	"SUNSUBSCRIBE": "sunsubscribe",
+}
+
+//channels of an unsubscribe reply are removed from those of the subscribe
+var unsubscribeKinds = map[string]string{
+	"unsubscribe":  "subscribe",
+	"punsubscribe": "psubscribe",
+	"sunsubscribe": "ssubscribe",
+}
+
+//replies expected by a (un)subscribe command, one per channel,
+//without channels one per channel subscribed to
+func (stm *stream) confirmations(c *command) int {
+
+	kind, ok := subscribeKinds[c.name]
+	if !ok {
+		return 0
+	}
+	if len(c.args) > 1 {
+		return len(c.args) - 1
+	}
+	if n := len(stm.channels[unsubscribeKinds[kind]]); n > 0 {
+		return n
+	}
+	return 1
+}
+
+//resolvePubSub reads the messages of subscriber mode and the replies
+//of (un)subscribe, true if v is one of them. In RESP2 they are arrays,
+//taken as such only in subscriber mode, in RESP3 pushes
+func (stm *stream) resolvePubSub(v *Value, e *event.Event) bool {
+
+	if (v.Type != respArray && v.Type != respPush) || len(v.Elems) < 3 {
+		return false
+	}
+	kind := strings.ToLower(string(v.Elems[0].Str))
+
+	var front *command
+	if len(stm.pending) > 0 {
+		front = stm.pending[0]
+	}
+	if v.Type == respArray && stm.subscriptions == 0 {
+		//replies of the subscribe, or messages on a
+		//connection subscribed before the capture
+		switch {
+		case front != nil && subscribeKinds[front.name] == kind:
+		case front == nil && (kind == "message" || kind == "pmessage" || kind == "smessage"):
+		default:
+			return false
+		}
+	}
+
+	switch kind {
+
+	case "message", "smessage":
+		stm.resolvePublished(e, nil, v.Elems[1], v.Elems[2])
+
+	case "pmessage":
+		if len(v.Elems) < 4 {
+			return false
+		}
+		stm.resolvePublished(e, v.Elems[1], v.Elems[2], v.Elems[3])
+
+	case "subscribe", "psubscribe", "ssubscribe", "unsubscribe", "punsubscribe", "sunsubscribe":
+		if v.Elems[2].Type != respInteger {
+			return false
+		}
+		stm.resolveSubscription(kind, v.Elems[1], v.Elems[2].Int, e)
+
+	default:
+		return false
+	}
+	return true
+}
+
+//a published message, reported as a push
+func (stm *stream) resolvePublished(e *event.Event, pattern, channel, payload *Value) {
+
+	e.Operation = "Message"
+	e.Set("channel", string(channel.Str))
+	e.Set("payload_bytes", payload.Len)
+
+	text := string(channel.Str)
+	if pattern != nil {
+		e.Set("pattern", string(pattern.Str))
+		text += " pattern:" + string(pattern.Str)
+	}
+	e.Statement = text + " " + payload.Summary()
+	e.Text      = fmt.Sprintf(" Message %s Size:%d", e.Statement, e.Bytes)
+
+	//events of a sentinel are published on its channels
+	if string(channel.Str) == "+switch-master" {
+		switchMaster(e, payload)
+	}
+	stm.emit.Emit(e)
+}
+
+//reply of a (un)subscribe for one channel, the command
+//is complete with the reply of its last channel
+func (stm *stream) resolveSubscription(kind string, channel *Value, count int64, e *event.Event) {
+
+	stm.subscriptions = count
+	if count > 0 {
+		atomic.StoreInt32(&stm.subscribed, 1)
+	} else {
+		atomic.StoreInt32(&stm.subscribed, 0)
+	}
+	if stm.channels == nil {
+		stm.channels = make(map[string]map[string]bool)
+	}
+	if from, ok := unsubscribeKinds[kind]; ok {
+		delete(stm.channels[from], string(channel.Str))
+	} else if !channel.IsNull() {
+		if stm.channels[kind] == nil {
+			stm.channels[kind] = make(map[string]bool)
+		}
+		stm.channels[kind][string(channel.Str)] = true
+	}
+
+	reply := fmt.Sprintf("(subscriptions) %d", count)
+	e.Set("subscriptions", count)
+
+	//not asked for, as an unsubscribe of the server
+	if len(stm.pending) == 0 || subscribeKinds[stm.pending[0].name] != kind {
+		e.Operation = strings.ToUpper(kind)
+		e.Statement = string(channel.Str) + " " + reply
+		e.Text      = " " + e.Operation + " " + e.Statement
+		stm.emit.Emit(e)
+		return
+	}
+
+	c := stm.pending[0]
+	c.confirm--
+	c.bytes += e.Bytes
+	if c.confirm > 0 {
+		return
+	}
+	stm.popPending()
+	e.Bytes = c.bytes
+	stm.completeCommand(c, e, reply)
+}
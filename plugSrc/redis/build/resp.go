@@ -0,0 +1,640 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+//RESP2 and RESP3 types
+const (
+	respSimple     = '+'
+	respError      = '-'
+	respInteger    = ':'
+	respBulk       = '$'
+	respArray      = '*'
+	respNull       = '_'
+	respBoolean    = '#'
+	respDouble     = ','
+	respBigNumber  = '('
+	respBulkError  = '!'
+	respVerbatim   = '='
+	respMap        = '%'
+	respSet        = '~'
+	respAttribute  = '|'
+	respPush       = '>'
+
+	//chunks of streamed strings, end of streamed aggregates
+	respChunk      = ';'
+	respEnd        = '.'
+)
+
+const (
+	//longest inline command and header line, as the server
+	maxLineLength  = 64 * 1024
+
+	//proto-max-bulk-len of the server
+	maxBulkLength  = 512 * 1024 * 1024
+
+	//bytes kept of a bulk string, the rest is skipped
+	maxBulkKeep    = 1024 * 1024
+
+	maxDepth       = 32
+	maxElements    = 1 << 24
+
+	//values kept of a reply which is only summarised, its
+	//strings keep summaryLength bytes
+	maxTrimmedValues = 1 << 16
+)
+
+var (
+	errProtocol   = errors.New("ERR : Redis protocol error")
+	errLineLength = errors.New("ERR : Redis line too long")
+)
+
+//Value is a decoded RESP value. Aggregates hold their
+//elements, maps and attributes as key, value pairs
+type Value struct {
+	Type  byte
+	Str   []byte //strings, errors, and the text of numbers
+	Int   int64  //integers, booleans
+	Len   int    //length of strings, count of aggregates, -1 for null
+	Elems []*Value
+	Attrs []*Value
+
+	//bytes on the wire
+	Size  int
+}
+
+func (v *Value) IsNull() bool {
+	return v.Type == respNull || v.Len < 0
+}
+
+func (v *Value) IsError() bool {
+	return v.Type == respError || v.Type == respBulkError
+}
+
+func (v *Value) IsAggregate() bool {
+	switch v.Type {
+	case respArray, respMap, respSet, respPush:
+		return true
+	}
+	return false
+}
+
+//truncated to maxBulkKeep
+func (v *Value) Truncated() bool {
+	return len(v.Str) < v.Len
+}
+
+var typeNames = map[byte]string{
+	respSimple:    "simple",
+	respError:     "error",
+	respInteger:   "integer",
+	respBulk:      "bulk",
+	respArray:     "array",
+	respNull:      "null",
+	respBoolean:   "boolean",
+	respDouble:    "double",
+	respBigNumber: "big_number",
+	respBulkError: "bulk_error",
+	respVerbatim:  "verbatim",
+	respMap:       "map",
+	respSet:       "set",
+	respPush:      "push",
+}
+
+func (v *Value) TypeName() string {
+	if v.IsNull() {
+		return "null"
+	}
+	return typeNames[v.Type]
+}
+
+//ErrorCode is the first word of an error, as MOVED, WRONGTYPE, OOM
+func (v *Value) ErrorCode() string {
+	if i := bytes.IndexByte(v.Str, ' '); i > 0 {
+		return string(v.Str[:i])
+	}
+	return string(v.Str)
+}
+
+//longest string printed in a summary
+const summaryLength = 64
+
+//Summary is a short line of the value, in the style of redis-cli
+func (v *Value) Summary() string {
+
+	if v.IsNull() {
+		return "(nil)"
+	}
+	switch v.Type {
+	case respSimple:
+		return string(v.Str)
+	case respError, respBulkError:
+		return "(error) " + string(v.Str)
+	case respInteger:
+		return "(integer) " + string(v.Str)
+	case respBoolean:
+		if v.Int == 1 {
+			return "(true)"
+		}
+		return "(false)"
+	case respDouble:
+		return "(double) " + string(v.Str)
+	case respBigNumber:
+		return "(big number) " + string(v.Str)
+	case respBulk, respVerbatim:
+		if v.Len > summaryLength {
+			s := v.Str
+			if len(s) > summaryLength {
+				s = s[:summaryLength]
+			}
+			return strconv.Quote(string(s)) + fmt.Sprintf("...(%d bytes)", v.Len)
+		}
+		return strconv.Quote(string(v.Str))
+	case respMap:
+		return fmt.Sprintf("(map) %d pairs", v.Len)
+	}
+	return fmt.Sprintf("(%s) %d elements", v.TypeName(), v.Len)
+}
+
+//Args returns the strings of a command, nil if v is not one
+func (v *Value) Args() [][]byte {
+	if v.Type != respArray || v.IsNull() {
+		return nil
+	}
+	args := make([][]byte, 0, len(v.Elems))
+	for _, e := range v.Elems {
+		switch e.Type {
+		case respBulk, respSimple, respInteger:
+			args = append(args, e.Str)
+		default:
+			return nil
+		}
+	}
+	return args
+}
+
+//respReader reads the values of one direction. After a protocol
+//error, as when bytes were lost, lines are skipped up to one that
+//can start a value: an array for the client, any type for the server
+type respReader struct {
+	r        *bufio.Reader
+	isClient bool
+	lost     bool
+
+	//the value returned by next was read after lost bytes
+	gap      bool
+
+	//replies are trimmed unless full is nil or returns true,
+	//only their summary and sizes are used
+	full     func() bool
+	trim     bool
+	kept     int
+}
+
+func newRespReader(r io.Reader, isClient bool) *respReader {
+	return &respReader{
+		r:        bufio.NewReader(r),
+		isClient: isClient,
+	}
+}
+
+//next value, inline commands are returned as arrays of bulk
+//strings. Only errors of the reader are returned
+func (rr *respReader) next() (*Value, error) {
+
+	for {
+		line, size, err := rr.line()
+		if err == errLineLength {
+			rr.lost = true
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if rr.lost && !rr.canStart(line) {
+			continue
+		}
+
+		var v *Value
+		if isType(line[0]) {
+			rr.trim = !rr.isClient && rr.full != nil && line[0] != respPush && !rr.full()
+			rr.kept = 0
+			v, err = rr.value(line, size, 0)
+
+			//clients only send arrays of strings
+			if err == nil && rr.isClient && v.Args() == nil {
+				err = errProtocol
+			}
+		} else if rr.isClient && !rr.lost {
+			v, err = inline(line, size)
+		} else {
+			err = errProtocol
+		}
+
+		switch err {
+		case nil:
+			rr.gap  = rr.lost
+			rr.lost = false
+			return v, nil
+		case errProtocol, errLineLength:
+			rr.lost = true
+		default:
+			return nil, err
+		}
+	}
+}
+
+func (rr *respReader) canStart(line []byte) bool {
+	if rr.isClient {
+		n, ok := parseInt(line[1:])
+		return line[0] == respArray && ok && n > 0 && n <= maxElements
+	}
+	return isType(line[0])
+}
+
+func isType(c byte) bool {
+	switch c {
+	case respSimple, respError, respInteger, respBulk, respArray,
+		respNull, respBoolean, respDouble, respBigNumber, respBulkError,
+		respVerbatim, respMap, respSet, respAttribute, respPush:
+		return true
+	}
+	return false
+}
+
+//read a line without its terminator, returns its size on the wire.
+//Lines over maxLineLength are skipped with errLineLength
+func (rr *respReader) line() ([]byte, int, error) {
+
+	var line []byte
+	for {
+		b, err := rr.r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, 0, err
+		}
+		if len(line)+len(b) > maxLineLength {
+			if err == bufio.ErrBufferFull {
+				rr.skipLine()
+			}
+			return nil, 0, errLineLength
+		}
+		line = append(line, b...)
+		if err == nil {
+			break
+		}
+	}
+	size := len(line)
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte{'\r'})
+	return line, size, nil
+}
+
+//drop the rest of a long line
+func (rr *respReader) skipLine() {
+	for err := bufio.ErrBufferFull; err == bufio.ErrBufferFull; {
+		_, err = rr.r.ReadSlice('\n')
+	}
+}
+
+//the value of the header line, nested values are read from rr
+func (rr *respReader) value(line []byte, size int, depth int) (*Value, error) {
+
+	if depth > maxDepth {
+		return nil, errProtocol
+	}
+	v := &Value{
+		Type: line[0],
+		Size: size,
+	}
+	body := line[1:]
+
+	switch v.Type {
+
+	case respSimple, respError, respDouble, respBigNumber:
+		v.Str = append([]byte{}, body...)
+		v.Len = len(v.Str)
+
+	case respInteger:
+		n, ok := parseInt(body)
+		if !ok {
+			return nil, errProtocol
+		}
+		v.Str = append([]byte{}, body...)
+		v.Int = n
+
+	case respNull:
+		v.Len = -1
+
+	case respBoolean:
+		switch string(body) {
+		case "t":
+			v.Int = 1
+		case "f":
+		default:
+			return nil, errProtocol
+		}
+
+	case respBulk, respBulkError, respVerbatim:
+		if string(body) == "?" {
+			return v, rr.streamed(v)
+		}
+		n, ok := parseInt(body)
+		if !ok || n < -1 || n > maxBulkLength {
+			return nil, errProtocol
+		}
+		v.Len = int(n)
+		if n < 0 {
+			return v, nil
+		}
+		if err := rr.bulk(v, int(n)); err != nil {
+			return nil, err
+		}
+
+		//format of verbatim strings, as "txt:"
+		if v.Type == respVerbatim && len(v.Str) >= 4 && v.Str[3] == ':' {
+			v.Str = v.Str[4:]
+			v.Len -= 4
+		}
+
+	case respArray, respSet, respPush, respMap, respAttribute:
+		if string(body) == "?" {
+			return v, rr.elements(v, -1, depth)
+		}
+		n, ok := parseInt(body)
+		if !ok || n < -1 || n > maxElements {
+			return nil, errProtocol
+		}
+		v.Len = int(n)
+		if n < 0 {
+			return v, nil
+		}
+		if v.Type == respMap || v.Type == respAttribute {
+			n *= 2
+		}
+		if err := rr.elements(v, int(n), depth); err != nil {
+			return nil, err
+		}
+
+		//attributes come before the value they describe
+		if v.Type == respAttribute {
+			attrs := v.Elems
+			line, size, err := rr.line()
+			if err != nil {
+				return nil, err
+			}
+			if len(line) == 0 || !isType(line[0]) {
+				return nil, errProtocol
+			}
+			next, err := rr.value(line, size, depth)
+			if err != nil {
+				return nil, err
+			}
+			next.Attrs = attrs
+			next.Size += v.Size
+			return next, nil
+		}
+
+	default:
+		return nil, errProtocol
+	}
+	return v, nil
+}
+
+//n elements, up to the end marker if n is -1
+func (rr *respReader) elements(v *Value, n int, depth int) error {
+
+	for i := 0; n < 0 || i < n; i++ {
+		line, size, err := rr.line()
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 {
+			return errProtocol
+		}
+		if n < 0 && line[0] == respEnd {
+			v.Size += size
+			v.Len = i
+			if v.Type == respMap || v.Type == respAttribute {
+				v.Len /= 2
+			}
+			return nil
+		}
+		if !isType(line[0]) {
+			return errProtocol
+		}
+		e, err := rr.value(line, size, depth+1)
+		if err != nil {
+			return err
+		}
+		v.Size += e.Size
+		if rr.trim {
+			if rr.kept >= maxTrimmedValues {
+				continue
+			}
+			rr.kept++
+		}
+		v.Elems = append(v.Elems, e)
+	}
+	return nil
+}
+
+//n bytes and the terminator, bytes over maxBulkKeep are skipped
+func (rr *respReader) bulk(v *Value, n int) error {
+
+	limit := maxBulkKeep
+	if rr.trim {
+		limit = summaryLength
+	}
+	keep := n
+	if keep > limit-len(v.Str) {
+		keep = limit - len(v.Str)
+	}
+	if keep > 0 {
+		b := make([]byte, keep)
+		if _, err := io.ReadFull(rr.r, b); err != nil {
+			return err
+		}
+		v.Str = append(v.Str, b...)
+	}
+	if n > keep {
+		if _, err := io.CopyN(ioutil.Discard, rr.r, int64(n-keep)); err != nil {
+			return err
+		}
+	}
+
+	//not the terminator, the declared length is wrong or bytes
+	//were lost, leave them to find the next value
+	crlf, err := rr.r.Peek(2)
+	if err != nil {
+		return err
+	}
+	if crlf[0] != '\r' || crlf[1] != '\n' {
+		return errProtocol
+	}
+	rr.r.Discard(2)
+	v.Size += n + 2
+	return nil
+}
+
+//streamed string, chunks of ";length" up to ";0"
+func (rr *respReader) streamed(v *Value) error {
+
+	for {
+		line, size, err := rr.line()
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 || line[0] != respChunk {
+			return errProtocol
+		}
+		n, ok := parseInt(line[1:])
+		if !ok || n < 0 || int(n)+v.Len > maxBulkLength {
+			return errProtocol
+		}
+		v.Size += size
+		if n == 0 {
+			return nil
+		}
+		v.Len += int(n)
+		if err := rr.bulk(v, int(n)); err != nil {
+			return err
+		}
+	}
+}
+
+//inline command, arguments split as the server does
+func inline(line []byte, size int) (*Value, error) {
+
+	args, ok := splitArgs(line)
+	if !ok {
+		return nil, errProtocol
+	}
+	if len(args) == 0 {
+		return nil, errProtocol
+	}
+	v := &Value{
+		Type: respArray,
+		Len:  len(args),
+		Size: size,
+	}
+	for _, arg := range args {
+		v.Elems = append(v.Elems, &Value{
+			Type: respBulk,
+			Str:  arg,
+			Len:  len(arg),
+		})
+	}
+	return v, nil
+}
+
+//splitArgs splits an inline command like sdssplitargs: words, "quoted"
+//with \n \r \t \b \a \\ \" \xHH escapes, and 'quoted' with \'. The first
+//word has to be a command, not the bytes of a value read after lost data
+func splitArgs(line []byte) ([][]byte, bool) {
+
+	var args [][]byte
+	i := 0
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i == len(line) {
+			break
+		}
+
+		var arg []byte
+		var quote byte
+		if line[i] == '"' || line[i] == '\'' {
+			quote = line[i]
+			i++
+		}
+		for ; ; i++ {
+			if i == len(line) {
+				//unbalanced quotes
+				if quote != 0 {
+					return nil, false
+				}
+				break
+			}
+			c := line[i]
+			if c < 0x20 && c != '\t' || c == 0x7f {
+				return nil, false
+			}
+			if quote == 0 {
+				if c == ' ' || c == '\t' {
+					break
+				}
+				arg = append(arg, c)
+				continue
+			}
+			if c == quote {
+				//closing quote must be followed by a space
+				i++
+				if i < len(line) && line[i] != ' ' && line[i] != '\t' {
+					return nil, false
+				}
+				break
+			}
+			if c == '\\' && i+1 < len(line) {
+				if quote == '\'' {
+					if line[i+1] == '\'' {
+						i++
+						c = '\''
+					}
+				} else if line[i+1] == 'x' && i+3 < len(line) && isHex(line[i+2]) && isHex(line[i+3]) {
+					n, _ := strconv.ParseUint(string(line[i+2:i+4]), 16, 8)
+					c = byte(n)
+					i += 3
+				} else {
+					i++
+					switch line[i] {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					default:
+						c = line[i]
+					}
+				}
+			}
+			arg = append(arg, c)
+		}
+		if arg == nil {
+			arg = []byte{}
+		}
+		args = append(args, arg)
+	}
+
+	if len(args) > 0 && !commandNames[strings.ToLower(string(args[0]))] {
+		return nil, false
+	}
+	return args, true
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func parseInt(b []byte) (int64, bool) {
+	if len(b) == 0 || len(b) > 20 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	return n, err == nil
+}
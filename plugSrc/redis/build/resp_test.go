@@ -0,0 +1,242 @@
+package build
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//values of one direction, up to the end of wire
+func readValues(t *testing.T, isClient bool, wire string) []*Value {
+	t.Helper()
+	rr := newRespReader(strings.NewReader(wire), isClient)
+	var values []*Value
+	for {
+		v, err := rr.next()
+		if err == io.EOF {
+			return values
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", wire, err)
+		}
+		values = append(values, v)
+	}
+}
+
+func args(v *Value) []string {
+	var list []string
+	for _, arg := range v.Args() {
+		list = append(list, string(arg))
+	}
+	return list
+}
+
+func TestRespCommands(t *testing.T) {
+
+	tests := []struct {
+		name string
+		wire string
+		want [][]string
+	}{
+		{
+			"multi-digit array",
+			"*12\r\n$5\r\nRPUSH\r\n$1\r\nl\r\n" + strings.Repeat("$1\r\nx\r\n", 10),
+			[][]string{append([]string{"RPUSH", "l"}, strings.Split(strings.Repeat("x", 10), "")...)},
+		},
+		{
+			"bulk with crlf",
+			"*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$4\r\na\r\nb\r\n",
+			[][]string{{"SET", "k", "a\r\nb"}},
+		},
+		{
+			"empty bulk",
+			"*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$0\r\n\r\n",
+			[][]string{{"SET", "k", ""}},
+		},
+		{
+			"inline",
+			"PING\r\nset k \"a b\\n\\x41\" 'c\\'d'\n",
+			[][]string{{"PING"}, {"set", "k", "a b\nA", "c'd"}},
+		},
+		{
+			"gap before the array header",
+			"$3\r\nGET\r\n$1\r\nk\r\n*2\r\n$3\r\nGET\r\n$1\r\nx\r\n",
+			[][]string{{"GET", "x"}},
+		},
+		{
+			"gap in a bulk string",
+			"*2\r\n$3\r\nGET\r\n$1\r\nabc\r\n*1\r\n$4\r\nPING\r\n",
+			[][]string{{"PING"}},
+		},
+		{
+			"value bytes after a gap are not inline commands",
+			"*1\r\n$4\r\nPING\r\nfoo bar\r\n*1\r\n$4\r\nQUIT\r\n",
+			[][]string{{"PING"}, {"QUIT"}},
+		},
+	}
+
+	for _, tt := range tests {
+		values := readValues(t, true, tt.wire)
+		var got [][]string
+		for _, v := range values {
+			got = append(got, args(v))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRespReplies(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		wire    string
+		typ     byte
+		summary string
+		len     int
+	}{
+		{"simple", "+OK\r\n", respSimple, "OK", 2},
+		{"error", "-ERR unknown command\r\n", respError, "(error) ERR unknown command", 19},
+		{"integer", ":-12\r\n", respInteger, "(integer) -12", 0},
+		{"null bulk", "$-1\r\n", respBulk, "(nil)", -1},
+		{"null", "_\r\n", respNull, "(nil)", -1},
+		{"bulk with crlf", "$4\r\na\r\nb\r\n", respBulk, `"a\r\nb"`, 4},
+		{"double", ",3.14\r\n", respDouble, "(double) 3.14", 4},
+		{"boolean", "#t\r\n", respBoolean, "(true)", 0},
+		{"verbatim", "=9\r\ntxt:hello\r\n", respVerbatim, `"hello"`, 5},
+		{"streamed string", "$?\r\n;4\r\nHell\r\n;6\r\no worl\r\n;0\r\n", respBulk, `"Hello worl"`, 10},
+		{"streamed array", "*?\r\n:1\r\n:2\r\n.\r\n", respArray, "(array) 2 elements", 2},
+		{"streamed map", "%?\r\n+a\r\n:1\r\n.\r\n", respMap, "(map) 1 pairs", 1},
+		{"nested", "*2\r\n*1\r\n:1\r\n%1\r\n+k\r\n$1\r\nv\r\n", respArray, "(array) 2 elements", 2},
+		{"set", "~2\r\n+a\r\n+b\r\n", respSet, "(set) 2 elements", 2},
+	}
+
+	for _, tt := range tests {
+		values := readValues(t, false, tt.wire)
+		if len(values) != 1 {
+			t.Errorf("%s: %d values", tt.name, len(values))
+			continue
+		}
+		v := values[0]
+		if v.Type != tt.typ || v.Summary() != tt.summary || v.Len != tt.len {
+			t.Errorf("%s: type %c summary %q len %d, want %c %q %d", tt.name, v.Type, v.Summary(), v.Len, tt.typ, tt.summary, tt.len)
+		}
+		if v.Size != len(tt.wire) {
+			t.Errorf("%s: size %d, want %d", tt.name, v.Size, len(tt.wire))
+		}
+	}
+}
+
+func TestRespAttributes(t *testing.T) {
+
+	//example of the RESP3 specification
+	wire := "|1\r\n+key-popularity\r\n%2\r\n$1\r\na\r\n,0.1923\r\n$1\r\nb\r\n,0.0012\r\n" +
+		"*2\r\n:2039123\r\n:9543892\r\n"
+	values := readValues(t, false, wire)
+	if len(values) != 1 {
+		t.Fatalf("%d values", len(values))
+	}
+	v := values[0]
+	if v.Type != respArray || v.Len != 2 || v.Elems[1].Int != 9543892 {
+		t.Errorf("value %s", v.Summary())
+	}
+	if len(v.Attrs) != 2 || string(v.Attrs[0].Str) != "key-popularity" || v.Attrs[1].Len != 2 {
+		t.Errorf("attributes %v", v.Attrs)
+	}
+	if v.Size != len(wire) {
+		t.Errorf("size %d, want %d", v.Size, len(wire))
+	}
+}
+
+func TestRespResync(t *testing.T) {
+
+	//a reply cut by lost bytes, the next ones are still read
+	wire := "$1\r\nabc\r\n+OK\r\n:5\r\n"
+	values := readValues(t, false, wire)
+	var got []string
+	for _, v := range values {
+		got = append(got, v.Summary())
+	}
+	if want := []string{"OK", "(integer) 5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("%q, want %q", got, want)
+	}
+
+	//a line over maxLineLength is skipped
+	wire = "+" + strings.Repeat("x", maxLineLength+1) + "\r\n:1\r\n"
+	values = readValues(t, false, wire)
+	if len(values) != 1 || values[0].Int != 1 {
+		t.Errorf("after a long line: %d values", len(values))
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+
+	tests := []struct {
+		line string
+		want []string
+		ok   bool
+	}{
+		{"get k", []string{"get", "k"}, true},
+		{"  set\tk   v  ", []string{"set", "k", "v"}, true},
+		{`set k "a\"b\\c\x41\x4"`, []string{"set", "k", `a"b\cAx4`}, true},
+		{`set k "\n\r\t\b\a"`, []string{"set", "k", "\n\r\t\b\a"}, true},
+		{`set k 'it\'s \n'`, []string{"set", "k", `it's \n`}, true},
+		{`set k ""`, []string{"set", "k", ""}, true},
+		{`set k "v`, nil, false},
+		{`set k 'v`, nil, false},
+		{`set k "v"x`, nil, false},
+		{"set k \x01", nil, false},
+		{"foo bar", nil, false},
+		{"", nil, true},
+	}
+
+	for _, tt := range tests {
+		list, ok := splitArgs([]byte(tt.line))
+		var got []string
+		for _, arg := range list {
+			got = append(got, string(arg))
+		}
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitArgs(%q) = %q %v, want %q %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRespTrimmed(t *testing.T) {
+
+	big := strings.Repeat("x", 1000)
+	many := strings.Repeat(":1\r\n", maxTrimmedValues+10)
+	tests := []struct {
+		name    string
+		wire    string
+		full    bool
+		summary string
+		kept    int
+	}{
+		{"bulk", "$1000\r\n" + big + "\r\n", false, strconv.Quote(big[:summaryLength]) + "...(1000 bytes)", summaryLength},
+		{"bulk in full", "$1000\r\n" + big + "\r\n", true, strconv.Quote(big[:summaryLength]) + "...(1000 bytes)", 1000},
+		{"array", "*" + strconv.Itoa(maxTrimmedValues+10) + "\r\n" + many, false, fmt.Sprintf("(array) %d elements", maxTrimmedValues+10), maxTrimmedValues},
+		{"streamed array", "*?\r\n" + many + ".\r\n", false, fmt.Sprintf("(array) %d elements", maxTrimmedValues+10), maxTrimmedValues},
+		{"push", ">2\r\n$7\r\nmessage\r\n$1000\r\n" + big + "\r\n", false, "(push) 2 elements", 2},
+	}
+
+	for _, tt := range tests {
+		rr := newRespReader(strings.NewReader(tt.wire), false)
+		rr.full = func() bool { return tt.full }
+		v, err := rr.next()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		kept := len(v.Str)
+		if v.IsAggregate() {
+			kept = len(v.Elems)
+		}
+		if v.Summary() != tt.summary || kept != tt.kept || v.Size != len(tt.wire) {
+			t.Errorf("%s: %q kept %d size %d, want %q %d %d", tt.name, v.Summary(), kept, v.Size, tt.summary, tt.kept, len(tt.wire))
+		}
+	}
+}
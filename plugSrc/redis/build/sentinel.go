@@ -0,0 +1,40 @@
+package build
+
+import (
+	"fmt"
+	"github.com/40t/go-sniffer/core/event"
+	"strings"
+)
+
+//replies of a sentinel, the lookups of a master by the clients
+func (stm *stream) resolveSentinel(sub string, c *command, v *Value, e *event.Event) string {
+
+	if sub != "GET-MASTER-ADDR-BY-NAME" || len(c.args) < 3 {
+		return ""
+	}
+	e.Set("master_name", string(c.args[2]))
+	if v.IsNull() || len(v.Elems) != 2 {
+		return ""
+	}
+	addr := joinHostPort(string(v.Elems[0].Str), string(v.Elems[1].Str))
+	e.Set("master_addr", addr)
+	return addr
+}
+
+//+switch-master "name old-ip old-port new-ip new-port", a failover
+func switchMaster(e *event.Event, payload *Value) {
+
+	f := strings.Fields(string(payload.Str))
+	if len(f) != 5 {
+		return
+	}
+	from := joinHostPort(f[1], f[2])
+	to   := joinHostPort(f[3], f[4])
+
+	e.Operation = "Switch Master"
+	e.Statement = fmt.Sprintf("%s %s -> %s", f[0], from, to)
+	e.Text      = " Switch Master " + e.Statement
+	e.Set("master_name", f[0]).
+		Set("old_master", from).
+		Set("new_master", to)
+}